@@ -0,0 +1,97 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var (
+	// JSON is the default codec, records are stored as plain JSON objects.
+	JSON Codec = jsonCodec{}
+	// Gob encodes records with encoding/gob, every record holds its own type information.
+	Gob Codec = gobCodec{}
+	// MessagePack encodes records as MessagePack maps.
+	MessagePack Codec = msgpackCodec{}
+	// CBOR encodes records as CBOR maps, times are encoded as RFC 3339 strings to keep their precision.
+	CBOR Codec = cborCodec{}
+
+	cborEncMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+)
+
+type jsonCodec struct{}
+type gobCodec struct{}
+type msgpackCodec struct{}
+type cborCodec struct{}
+
+func (jsonCodec) ID() byte {
+	return '{'
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+func (gobCodec) ID() byte {
+	return 0x01
+}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+func (msgpackCodec) ID() byte {
+	return 0x02
+}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(b []byte, v interface{}) error {
+	return msgpack.Unmarshal(b, v)
+}
+
+func (cborCodec) ID() byte {
+	return 0x03
+}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cborEncMode.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(b []byte, v interface{}) error {
+	return cbor.Unmarshal(b, v)
+}
@@ -0,0 +1,131 @@
+// Package codec serializes the models persisted by the collections.
+// Every record starts with the ID of the codec it was encoded with, so records of different codecs can be mixed,
+// which allows to migrate a database from one codec to another as its models are saved.
+package codec
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Codec encodes and decodes values.
+type Codec interface {
+	// ID is the first byte of every record encoded by the codec.
+	ID() byte
+	Name() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+const (
+	// IDs from MinCustomID up to and including MaxCustomID are free for custom codecs
+	MinCustomID byte = 0x10
+	MaxCustomID byte = 0x3f
+)
+
+var (
+	codecs = make(map[byte]Codec)
+	mu     sync.RWMutex
+)
+
+func init() {
+	for _, c := range []Codec{JSON, Gob, MessagePack, CBOR} {
+		codecs[c.ID()] = c
+	}
+}
+
+// Register registers a custom codec, so records encoded with it can be decoded.
+func Register(c Codec) error {
+	if c.ID() < MinCustomID || c.ID() > MaxCustomID {
+		return fmt.Errorf("invalid codec id %#x for codec %s", c.ID(), c.Name())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if other, ok := codecs[c.ID()]; ok {
+		return fmt.Errorf("duplicate codec id %#x for codecs %s and %s", c.ID(), other.Name(), c.Name())
+	}
+
+	codecs[c.ID()] = c
+
+	return nil
+}
+
+// Lookup returns the codec with the given ID.
+func Lookup(id byte) (Codec, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	c, ok := codecs[id]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown codec id %#x", id)
+	}
+
+	return c, nil
+}
+
+// Of returns the codec a record was encoded with.
+func Of(b []byte) (Codec, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty record")
+	}
+
+	return Lookup(b[0])
+}
+
+// Codecs returns the registered codecs, ordered by ID.
+func Codecs() []Codec {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	cs := make([]Codec, 0, len(codecs))
+
+	for _, c := range codecs {
+		cs = append(cs, c)
+	}
+
+	sort.Slice(cs, func(a, b int) bool {
+		return cs[a].ID() < cs[b].ID()
+	})
+
+	return cs
+}
+
+// Encode encodes v with the codec, prefixed by the ID of the codec.
+// JSON records are not prefixed, the opening brace of the object serves as ID.
+func Encode(c Codec, v interface{}) ([]byte, error) {
+	b, err := c.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ID() == JSON.ID() {
+		if len(b) == 0 || b[0] != c.ID() {
+			return nil, fmt.Errorf("invalid record, %s records should be objects", c.Name())
+		}
+
+		return b, nil
+	}
+
+	return append([]byte{c.ID()}, b...), nil
+}
+
+// Decode decodes a record into v, with the codec it was encoded with.
+func Decode(b []byte, v interface{}) (Codec, error) {
+	c, err := Of(b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ID() != JSON.ID() {
+		b = b[1:]
+	}
+
+	return c, c.Unmarshal(b, v)
+}
@@ -0,0 +1,92 @@
+package codec
+
+import (
+	"errors"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+	"time"
+)
+
+type TestCodec struct {
+	id byte
+}
+
+func (c TestCodec) ID() byte                                { return c.id }
+func (c TestCodec) Name() string                            { return "test" }
+func (c TestCodec) Marshal(_ interface{}) ([]byte, error)   { return []byte("test"), nil }
+func (c TestCodec) Unmarshal(_ []byte, _ interface{}) error { return errors.New("test") }
+
+type TestRecord struct {
+	A string
+	B int
+	C time.Time
+}
+
+func TestRegister(t *testing.T) {
+	ExpectedError(t, Register(TestCodec{id: 0x01}), "invalid codec id 0x1 for codec test")
+	ExpectedError(t, Register(TestCodec{id: '{'}), "invalid codec id 0x7b for codec test")
+
+	ExpectedNoError(t, Register(TestCodec{id: MaxCustomID}))
+
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		delete(codecs, MaxCustomID)
+	}()
+
+	ExpectedError(t, Register(TestCodec{id: MaxCustomID}), "duplicate codec id 0x3f for codecs test and test")
+
+	c, err := Lookup(MaxCustomID)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, c, Codec(TestCodec{id: MaxCustomID}))
+
+	_, err = Lookup(0xff)
+
+	ExpectedError(t, err, "unknown codec id 0xff")
+
+	cs := Codecs()
+
+	ExpectedEqual(t, len(cs), 5)
+	ExpectedEqual(t, cs[0], Gob)
+	ExpectedEqual(t, cs[4], JSON)
+}
+
+func TestEncode(t *testing.T) {
+	r := &TestRecord{A: "a", B: 1, C: time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)}
+
+	for _, c := range []Codec{JSON, Gob, MessagePack, CBOR} {
+		b, err := Encode(c, r)
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, b[0], c.ID())
+
+		d, err := Of(b)
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, d, c)
+
+		dr := &TestRecord{}
+
+		d, err = Decode(b, dr)
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, d, c)
+		ExpectedEqual(t, dr.A, r.A)
+		ExpectedEqual(t, dr.B, r.B)
+		ExpectedEqualF(t, dr.C.Equal(r.C), true, false, c.Name()+" should keep the time")
+	}
+
+	_, err := Encode(JSON, []int{1})
+
+	ExpectedError(t, err, "invalid record, json records should be objects")
+
+	_, err = Of(nil)
+
+	ExpectedError(t, err, "empty record")
+
+	_, err = Decode([]byte{0xff}, &TestRecord{})
+
+	ExpectedError(t, err, "unknown codec id 0xff")
+}
@@ -0,0 +1,261 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"peterdekok.nl/gotools/borm/storage"
+	"time"
+)
+
+// ErrBackupUnsupported is returned when backing up or restoring collections which are not stored in a database file.
+var ErrBackupUnsupported = errors.New("backups are not supported by the storage")
+
+// Backup writes a consistent copy of the database to w, while the collections remain usable.
+// The copy is a database file, which can be opened as is or restored with RestoreFrom.
+func (cs *Collections) Backup(w io.Writer) (int64, error) {
+	wt, ok := cs.store.(io.WriterTo)
+
+	if !ok {
+		return 0, ErrBackupUnsupported
+	}
+
+	n, err := wt.WriteTo(w)
+
+	if err != nil {
+		cs.log.WithError(err).Error("Failed to backup database")
+
+		return n, fmt.Errorf("failed to backup database: %s", err)
+	}
+
+	return n, nil
+}
+
+// BackupToFile writes a consistent copy of the database to the file at path.
+// The backup is written to a temporary file first, so the file at path is either replaced by a complete backup or left as is.
+func (cs *Collections) BackupToFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+
+	if err != nil {
+		cs.log.WithError(err).Error("Failed to backup database")
+
+		return fmt.Errorf("failed to backup database: %s", err)
+	}
+
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	if _, err := cs.Backup(f); err != nil {
+		return err
+	}
+
+	err = syncFile(f, cs.options.fileMode)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		cs.log.WithError(err).Error("Failed to backup database")
+
+		return fmt.Errorf("failed to backup database: %s", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		cs.log.WithError(err).Error("Failed to backup database")
+
+		return fmt.Errorf("failed to backup database: %s", err)
+	}
+
+	return nil
+}
+
+// BackupHandler returns a handler streaming a backup of the database to GET requests.
+// The backup holds every model, the handler does not authenticate requests itself,
+// so it should only be mounted behind authentication, e.g.:
+//
+//	http.Handle("/backup", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//		user, pass, ok := r.BasicAuth()
+//
+//		if !ok || subtle.ConstantTimeCompare([]byte(user+":"+pass), []byte(credentials)) != 1 {
+//			w.Header().Set("WWW-Authenticate", `Basic realm="backup"`)
+//
+//			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+//
+//			return
+//		}
+//
+//		cs.BackupHandler().ServeHTTP(w, r)
+//	}))
+func (cs *Collections) BackupHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		if _, ok := cs.store.(io.WriterTo); !ok {
+			http.Error(w, ErrBackupUnsupported.Error(), http.StatusNotImplemented)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", cs.name+".db"))
+
+		n, err := cs.Backup(w)
+
+		// Once the backup is being sent, the status can no longer be changed
+		if err != nil && n == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// RestoreFrom replaces the database by the backup at path, it should be called before collections are registered.
+// The backup is validated before it replaces the database file, which happens by an atomic rename.
+// Only collections stored in a database file, which they opened themselves, can be restored.
+func (cs *Collections) RestoreFrom(path string) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	err := cs.restoreFrom(path)
+
+	if err != nil {
+		cs.log.WithError(err).WithField("backup", path).Error("Failed to restore backup")
+
+		return fmt.Errorf("failed to restore backup: %w", err)
+	}
+
+	return nil
+}
+
+func (cs *Collections) restoreFrom(path string) error {
+	if _, ok := cs.store.(*storage.Bolt); !ok || cs.options.storage != nil {
+		return ErrBackupUnsupported
+	}
+
+	if len(cs.c) > 0 {
+		return errors.New("collections already registered")
+	}
+
+	if cs.store.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	if err := validateBackup(path, cs.options.dbTimeout); err != nil {
+		return fmt.Errorf("invalid backup: %s", err)
+	}
+
+	tmp, err := copyBackup(path, cs.options.file, cs.options.fileMode)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	if err := cs.store.Close(); err != nil {
+		return err
+	}
+
+	renameErr := os.Rename(tmp, cs.options.file)
+
+	// The store is reopened either way, on the restored or the original file
+	store, err := storage.OpenBolt(cs.options.file, cs.options.fileMode, cs.options.boltOptions())
+
+	if err != nil {
+		return err
+	}
+
+	cs.store = store
+
+	return renameErr
+}
+
+// validateBackup checks the consistency of a database file, without changing it.
+func validateBackup(path string, timeout time.Duration) error {
+	// Bolt creates missing files, even when opened read-only
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	if err := storage.CheckBolt(path); err != nil {
+		return err
+	}
+
+	db, err := bolt.Open(path, 0400, &bolt.Options{ReadOnly: true, Timeout: timeout})
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		var first error
+
+		// The channel is drained, as the check runs until it is done
+		for err := range tx.Check() {
+			if first == nil {
+				first = err
+			}
+		}
+
+		return first
+	})
+}
+
+// copyBackup copies the backup to a temporary file next to the database file, so it can be renamed to replace it.
+func copyBackup(path, file string, mode os.FileMode) (string, error) {
+	src, err := os.Open(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer src.Close()
+
+	dst, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(dst, src)
+
+	if err == nil {
+		err = syncFile(dst, mode)
+	}
+
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		_ = os.Remove(dst.Name())
+
+		return "", err
+	}
+
+	return dst.Name(), nil
+}
+
+// syncFile sets the mode of the file and flushes it to disk.
+func syncFile(f *os.File, mode os.FileMode) error {
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,190 @@
+package collection
+
+import (
+	"bytes"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+)
+
+func TestCollections_Backup(t *testing.T) {
+	defer os.Remove("testdata/backup.db")
+	defer os.Remove("testdata/backup-copy.db")
+
+	cs, err := Open(&Options{file: "testdata/backup.db"})
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	ExpectedNoError(t, c.Create(mA))
+
+	var buf bytes.Buffer
+
+	n, err := cs.Backup(&buf)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, n, int64(buf.Len()))
+
+	ExpectedNoError(t, cs.BackupToFile("testdata/backup-copy.db"))
+
+	b, err := ioutil.ReadFile("testdata/backup-copy.db")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, b, buf.Bytes())
+
+	fi, err := os.Stat("testdata/backup-copy.db")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, fi.Mode(), os.FileMode(0600))
+
+	// The backup is a database file holding the models
+	db, err := bolt.Open("testdata/backup-copy.db", 0600, nil)
+
+	ExpectedNoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		ExpectedNoZeroValueF(t, tx.Bucket([]byte("TestCollectionStructB")).Get([]byte(mA.Id().String())), false, "expected the model in the backup")
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+	ExpectedNoError(t, db.Close())
+
+	err = cs.BackupToFile("testdata/missing/backup.db")
+
+	ExpectedEqualF(t, err != nil, true, false, "expected an error for a missing directory")
+}
+
+func TestCollections_BackupHandler(t *testing.T) {
+	defer os.Remove("testdata/handler.db")
+
+	cs, err := Open(&Options{file: "testdata/handler.db"})
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+	ExpectedNoError(t, c.Create(&TestCollectionStructB{FieldA: "test-aaa"}))
+
+	var buf bytes.Buffer
+
+	_, err = cs.Backup(&buf)
+
+	ExpectedNoError(t, err)
+
+	rec := httptest.NewRecorder()
+
+	cs.BackupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/backup", nil))
+
+	ExpectedEqual(t, rec.Code, http.StatusOK)
+	ExpectedEqual(t, rec.Header().Get("Content-Type"), "application/octet-stream")
+	ExpectedEqual(t, rec.Header().Get("Content-Disposition"), `attachment; filename="handler.db"`)
+	ExpectedEqual(t, rec.Body.Bytes(), buf.Bytes())
+
+	rec = httptest.NewRecorder()
+
+	cs.BackupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/backup", nil))
+
+	ExpectedEqual(t, rec.Code, http.StatusMethodNotAllowed)
+
+	csB, err := Open(&Options{memory: true})
+
+	ExpectedNoError(t, err)
+
+	rec = httptest.NewRecorder()
+
+	csB.BackupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/backup", nil))
+
+	ExpectedEqual(t, rec.Code, http.StatusNotImplemented)
+
+	_, err = csB.Backup(&buf)
+
+	ExpectedEqual(t, err, ErrBackupUnsupported)
+}
+
+func TestCollections_RestoreFrom(t *testing.T) {
+	defer os.Remove("testdata/restore.db")
+	defer os.Remove("testdata/restore-backup.db")
+	defer os.Remove("testdata/restore-invalid.db")
+
+	csA, err := Open(&Options{file: "testdata/restore.db"})
+
+	ExpectedNoError(t, err)
+
+	cA, err := csA.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	ExpectedNoError(t, cA.Create(mA))
+	ExpectedNoError(t, csA.BackupToFile("testdata/restore-backup.db"))
+
+	err = csA.RestoreFrom("testdata/restore-backup.db")
+
+	ExpectedError(t, err, "failed to restore backup: collections already registered")
+
+	ExpectedNoError(t, mA.Delete())
+	ExpectedNoError(t, cA.Purge(mA))
+	ExpectedNoError(t, cA.Create(&TestCollectionStructB{FieldA: "test-bbb"}))
+	ExpectedNoError(t, csA.Close())
+
+	csB, err := Open(&Options{file: "testdata/restore.db"})
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, csB.Close())
+	}()
+
+	if err := ioutil.WriteFile("testdata/restore-invalid.db", []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = csB.RestoreFrom("testdata/restore-invalid.db")
+
+	ExpectedError(t, err, "failed to restore backup: invalid backup: invalid database")
+
+	err = csB.RestoreFrom("testdata/restore-missing.db")
+
+	ExpectedError(t, err, "failed to restore backup: invalid backup: stat testdata/restore-missing.db: no such file or directory")
+
+	ExpectedNoError(t, csB.RestoreFrom("testdata/restore-backup.db"))
+
+	cB, err := csB.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, cB.Count(), 1)
+	ExpectedEqual(t, cB.MustFind(mA.Id()).(*TestCollectionStructB).FieldA, "test-aaa")
+
+	// The restored database is used for writes
+	ExpectedNoError(t, cB.Create(&TestCollectionStructB{FieldA: "test-ccc"}))
+
+	csC, err := Open(&Options{memory: true})
+
+	ExpectedNoError(t, err)
+
+	err = csC.RestoreFrom("testdata/restore-backup.db")
+
+	ExpectedEqualF(t, errors.Is(err, ErrBackupUnsupported), true, false, "expected restoring memory storage to be unsupported")
+}
@@ -0,0 +1,398 @@
+package collection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"peterdekok.nl/gotools/borm/encrypt"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	"time"
+)
+
+// Bucket holding the change log, keyed by sequence number.
+const changesBucket = "_changes"
+
+// Key of the last sequence number of the change log in the meta bucket.
+const changeSeqKey = "change-seq"
+
+// ErrChangesTrimmed is returned when changes are requested which were removed from the change log by its retention.
+var ErrChangesTrimmed = errors.New("changes trimmed from the change log")
+
+// errChangesKept stops iterating the change log at the first entry which is retained
+var errChangesKept = errors.New("changes kept")
+
+// Change is an entry of the change log, see WithChangeLog.
+type Change struct {
+	// Sequence number of the change, increasing by one for every change
+	Seq        uint64
+	Type       EventType
+	Collection string
+	Id         uuid.UUID
+	// Time of the change, by the clock of the collections
+	Time time.Time
+	// Model as stored by the change, nil for purged models and models of collections which are not registered
+	Model model.Interface
+}
+
+// changeEntry is a change as stored in the change log.
+// The record is stored as in the bucket of the collection, so it is compressed and encrypted alike.
+type changeEntry struct {
+	Type       EventType `json:"type"`
+	Collection string    `json:"collection"`
+	Id         uuid.UUID `json:"id"`
+	Time       time.Time `json:"time"`
+	Record     []byte    `json:"record,omitempty"`
+}
+
+// ChangesSince returns the changes of the change log after sequence number seq, in order.
+// Consumers resume by passing the sequence number of the last change they processed, zero returns all retained changes.
+// ErrChangesTrimmed is returned when changes after seq were already removed by the retention of the change log.
+func (cs *Collections) ChangesSince(seq uint64) ([]*Change, error) {
+	changes, err := cs.changesSince(seq)
+
+	if err != nil {
+		cs.log.WithError(err).Error("Failed to read changes")
+
+		return nil, fmt.Errorf("failed to read changes: %w", err)
+	}
+
+	return changes, nil
+}
+
+func (cs *Collections) changesSince(seq uint64) ([]*Change, error) {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	changes := make([]*Change, 0)
+
+	err := cs.store.View(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(changesBucket))
+
+		if b == nil {
+			return nil
+		}
+
+		first := true
+
+		return b.ForEach(func(k, v []byte) error {
+			n := binary.BigEndian.Uint64(k)
+
+			if first && seq > 0 && n > seq+1 {
+				return ErrChangesTrimmed
+			}
+
+			first = false
+
+			if n <= seq {
+				return nil
+			}
+
+			c, err := cs.change(n, v)
+
+			if err != nil {
+				return err
+			}
+
+			changes = append(changes, c)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// change decodes an entry of the change log, the collections should be locked.
+func (cs *Collections) change(seq uint64, v []byte) (*Change, error) {
+	var e changeEntry
+
+	if err := json.Unmarshal(v, &e); err != nil {
+		return nil, err
+	}
+
+	c := &Change{
+		Seq:        seq,
+		Type:       e.Type,
+		Collection: e.Collection,
+		Id:         e.Id,
+		Time:       e.Time,
+	}
+
+	if col, ok := cs.c[e.Collection]; ok && e.Record != nil {
+		var err error
+
+		if c.Model, err = col.unseal([]byte(e.Id.String()), e.Record); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// logChange appends the change of the model to the change log, when enabled.
+// The model should be written in the transaction already, the collection should be locked.
+func (c *Collection) logChange(t *Tx, typ EventType, id uuid.UUID) error {
+	if !c.root.changeLog {
+		return nil
+	}
+
+	e := &changeEntry{
+		Type:       typ,
+		Collection: c.name,
+		Id:         id,
+		Time:       c.Now(),
+	}
+
+	if typ != Purged {
+		e.Record = t.tx.Bucket([]byte(c.name)).Get([]byte(id.String()))
+	}
+
+	return c.root.appendChange(t.tx, e)
+}
+
+// appendChange stores the entry with the next sequence number and applies the retention of the change log.
+func (cs *Collections) appendChange(tx storage.Tx, e *changeEntry) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+
+	if err != nil {
+		return err
+	}
+
+	var seq uint64
+
+	if v := meta.Get([]byte(changeSeqKey)); len(v) == 8 {
+		seq = binary.BigEndian.Uint64(v)
+	}
+
+	seq++
+
+	k := make([]byte, 8)
+
+	binary.BigEndian.PutUint64(k, seq)
+
+	if err := meta.Put([]byte(changeSeqKey), k); err != nil {
+		return err
+	}
+
+	v, err := json.Marshal(e)
+
+	if err != nil {
+		return err
+	}
+
+	b, err := tx.CreateBucketIfNotExists([]byte(changesBucket))
+
+	if err != nil {
+		return err
+	}
+
+	if err := b.Put(k, v); err != nil {
+		return err
+	}
+
+	return cs.trimChanges(b, seq, e.Time)
+}
+
+// trimChanges removes the entries of the change log which are no longer retained, last is the newest sequence number.
+// Entries are removed from the oldest, so the retained entries remain consecutive.
+func (cs *Collections) trimChanges(b storage.Bucket, last uint64, now time.Time) error {
+	if cs.changeMaxAge == 0 && cs.changeMaxCount == 0 {
+		return nil
+	}
+
+	trimmed := make([][]byte, 0)
+
+	err := b.ForEach(func(k, v []byte) error {
+		seq := binary.BigEndian.Uint64(k)
+
+		if cs.changeMaxCount > 0 && last-seq >= uint64(cs.changeMaxCount) {
+			trimmed = append(trimmed, append([]byte(nil), k...))
+
+			return nil
+		}
+
+		if cs.changeMaxAge > 0 {
+			var e changeEntry
+
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+
+			if now.Sub(e.Time) > cs.changeMaxAge {
+				trimmed = append(trimmed, append([]byte(nil), k...))
+
+				return nil
+			}
+		}
+
+		return errChangesKept
+	})
+
+	if err != nil && err != errChangesKept {
+		return err
+	}
+
+	// Deleted once iterated, as keys should not be deleted while iterating
+	for _, k := range trimmed {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rotateChanges re-encrypts the records of the change log which are not encrypted with the key, returning their number.
+// Entries are re-encrypted in batches like the records of the collections, entries of other collections are left as is.
+func (cs *Collections) rotateChanges(id uint32, cols []*Collection) (int, error) {
+	byName := make(map[string]*Collection, len(cols))
+
+	for _, c := range cols {
+		byName[c.name] = c
+	}
+
+	var after []byte
+
+	total := 0
+
+	for done := false; !done; {
+		err := cs.store.Update(func(tx storage.Tx) error {
+			b := tx.Bucket([]byte(changesBucket))
+
+			if b == nil {
+				done = true
+
+				return nil
+			}
+
+			var keys [][]byte
+			var entries []*changeEntry
+
+			err := b.ForEach(func(k, v []byte) error {
+				if after != nil && bytes.Compare(k, after) <= 0 {
+					return nil
+				}
+
+				if len(keys) == rotateBatchSize {
+					return errBatchFull
+				}
+
+				after = append(after[:0], k...)
+
+				e := &changeEntry{}
+
+				if err := json.Unmarshal(v, e); err != nil {
+					return err
+				}
+
+				if _, ok := byName[e.Collection]; !ok || e.Record == nil {
+					return nil
+				}
+
+				if kid, err := encrypt.KeyID(e.Record); err != nil || kid != id {
+					keys = append(keys, append([]byte{}, k...))
+					entries = append(entries, e)
+				}
+
+				return nil
+			})
+
+			if err != nil && err != errBatchFull {
+				return err
+			}
+
+			done = err == nil
+
+			for x, k := range keys {
+				e := entries[x]
+
+				if e.Record, err = byName[e.Collection].reseal([]byte(e.Id.String()), e.Record); err != nil {
+					return fmt.Errorf("failed to re-encrypt change %d: %s", binary.BigEndian.Uint64(k), err)
+				}
+
+				if err := putChange(b, k, e); err != nil {
+					return err
+				}
+			}
+
+			total += len(keys)
+
+			return nil
+		})
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// migrateChanges runs the migrations on the records of the change log of the collection, so they keep
+// decoding into the model.
+func (c *Collection) migrateChanges(tx storage.Tx, ms []Migration) error {
+	b := tx.Bucket([]byte(changesBucket))
+
+	if b == nil {
+		return nil
+	}
+
+	var keys [][]byte
+	var entries []*changeEntry
+
+	err := b.ForEach(func(k, v []byte) error {
+		e := &changeEntry{}
+
+		if err := json.Unmarshal(v, e); err != nil {
+			return err
+		}
+
+		if e.Collection == c.name && e.Record != nil {
+			keys = append(keys, append([]byte{}, k...))
+			entries = append(entries, e)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for x, k := range keys {
+		e := entries[x]
+
+		if e.Record, err = c.migrateRecord([]byte(e.Id.String()), e.Record, ms); err != nil {
+			return fmt.Errorf("failed to migrate change %d: %s", binary.BigEndian.Uint64(k), err)
+		}
+
+		if !tx.Writable() {
+			continue
+		}
+
+		if err := putChange(b, k, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// putChange stores the entry of the change log with key k.
+func putChange(b storage.Bucket, k []byte, e *changeEntry) error {
+	v, err := json.Marshal(e)
+
+	if err != nil {
+		return err
+	}
+
+	return b.Put(k, v)
+}
@@ -0,0 +1,294 @@
+package collection
+
+import (
+	"encoding/json"
+	"errors"
+	"peterdekok.nl/gotools/borm/encrypt"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+	"time"
+)
+
+type TestChangeUser struct {
+	model.Model
+	Name string
+}
+
+func testChangeCollections(t *testing.T, opts ...Option) (*Collections, model.CollectionInterface) {
+	opt, err := NewOptions(append([]Option{WithInMemory()}, opts...)...)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := Open(opt)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := cs.Register(&TestChangeUser{})
+
+	ExpectedNoError(t, err)
+
+	return cs, c
+}
+
+func TestCollections_ChangesSince(t *testing.T) {
+	cs, c := testChangeCollections(t, WithChangeLog(0, 0))
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	changes, err := cs.ChangesSince(0)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(changes), 0)
+
+	u := &TestChangeUser{Name: "alice"}
+
+	ExpectedNoError(t, c.Create(u))
+
+	u.Name = "bob"
+
+	ExpectedNoError(t, u.Save())
+	ExpectedNoError(t, u.Delete())
+	ExpectedNoError(t, u.Restore())
+	ExpectedNoError(t, u.Delete())
+	ExpectedNoError(t, c.Purge(u))
+
+	changes, err = cs.ChangesSince(0)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(changes), 6)
+
+	types := []EventType{Created, Updated, Deleted, Restored, Deleted, Purged}
+
+	for x, change := range changes {
+		ExpectedEqual(t, change.Seq, uint64(x+1))
+		ExpectedEqual(t, change.Type, types[x])
+		ExpectedEqual(t, change.Collection, "TestChangeUser")
+		ExpectedEqual(t, change.Id, u.Id())
+		ExpectedEqualF(t, change.Time.IsZero(), false, false, "expected the time of the change")
+	}
+
+	ExpectedEqual(t, changes[0].Model.(*TestChangeUser).Name, "alice")
+	ExpectedEqual(t, changes[1].Model.(*TestChangeUser).Name, "bob")
+	ExpectedEqual(t, changes[1].Model.Version(), uint64(2))
+	ExpectedEqual(t, changes[2].Model.Deleted(), true)
+	ExpectedEqual(t, changes[5].Model, model.Interface(nil))
+
+	// Resuming from a sequence number
+	changes, err = cs.ChangesSince(4)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(changes), 2)
+	ExpectedEqual(t, changes[0].Seq, uint64(5))
+
+	// Rolled back transactions are not logged
+	err = cs.Transaction(func(tx *Tx) error {
+		if err := tx.Create(c, &TestChangeUser{Name: "carol"}); err != nil {
+			return err
+		}
+
+		return errors.New("failed")
+	})
+
+	ExpectedError(t, err, "failed to commit transaction: failed")
+
+	ExpectedNoError(t, c.Create(&TestChangeUser{Name: "dave"}))
+
+	changes, err = cs.ChangesSince(6)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(changes), 1)
+	ExpectedEqual(t, changes[0].Seq, uint64(7))
+	ExpectedEqual(t, changes[0].Model.(*TestChangeUser).Name, "dave")
+
+	// Models of collections which are not registered are not decoded
+	delete(cs.c, "TestChangeUser")
+
+	changes, err = cs.ChangesSince(6)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, changes[0].Model, model.Interface(nil))
+}
+
+func TestCollections_ChangesSince_disabled(t *testing.T) {
+	cs, c := testChangeCollections(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	ExpectedNoError(t, c.Create(&TestChangeUser{}))
+
+	changes, err := cs.ChangesSince(0)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(changes), 0)
+}
+
+func TestCollections_ChangesSince_retention(t *testing.T) {
+	cs, c := testChangeCollections(t, WithChangeLog(0, 2))
+
+	for x := 0; x < 5; x++ {
+		ExpectedNoError(t, c.Create(&TestChangeUser{}))
+	}
+
+	changes, err := cs.ChangesSince(0)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(changes), 2)
+	ExpectedEqual(t, changes[0].Seq, uint64(4))
+
+	changes, err = cs.ChangesSince(3)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(changes), 2)
+
+	_, err = cs.ChangesSince(2)
+
+	ExpectedError(t, err, "failed to read changes: changes trimmed from the change log")
+	ExpectedEqualF(t, errors.Is(err, ErrChangesTrimmed), true, false, "expected the trimmed error")
+
+	ExpectedNoError(t, cs.Close())
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cs, c = testChangeCollections(t, WithChangeLog(time.Hour, 0), WithClock(func() time.Time { return now }))
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	ExpectedNoError(t, c.Create(&TestChangeUser{}))
+
+	now = now.Add(30 * time.Minute)
+
+	ExpectedNoError(t, c.Create(&TestChangeUser{}))
+
+	now = now.Add(45 * time.Minute)
+
+	ExpectedNoError(t, c.Create(&TestChangeUser{}))
+
+	changes, err = cs.ChangesSince(0)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(changes), 2)
+	ExpectedEqual(t, changes[0].Seq, uint64(2))
+}
+
+func TestCollections_ChangesSince_rotateKey(t *testing.T) {
+	keyring := encrypt.NewKeyring()
+
+	ExpectedNoError(t, keyring.Add(1, encrypt.AESGCM, []byte("0123456789abcdef0123456789abcdef")))
+
+	cs, c := testChangeCollections(t, WithChangeLog(0, 0), WithEncryption(keyring))
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	rotateBatchSize = 2
+
+	defer func() {
+		rotateBatchSize = 500
+	}()
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		ExpectedNoError(t, c.Create(&TestChangeUser{Name: name}))
+	}
+
+	ExpectedNoError(t, keyring.Add(2, encrypt.XChaCha20Poly1305, []byte("abcdef0123456789abcdef0123456789")))
+	ExpectedNoError(t, cs.RotateKey(2))
+	ExpectedNoError(t, keyring.Remove(1))
+
+	err := cs.store.View(func(tx storage.Tx) error {
+		return tx.Bucket([]byte(changesBucket)).ForEach(func(k, v []byte) error {
+			var e changeEntry
+
+			ExpectedNoError(t, json.Unmarshal(v, &e))
+
+			id, err := encrypt.KeyID(e.Record)
+
+			ExpectedNoError(t, err)
+			ExpectedEqual(t, id, uint32(2))
+
+			return nil
+		})
+	})
+
+	ExpectedNoError(t, err)
+
+	changes, err := cs.ChangesSince(0)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(changes), 3)
+	ExpectedEqual(t, changes[2].Model.(*TestChangeUser).Name, "carol")
+}
+
+func TestCollections_ChangesSince_migrate(t *testing.T) {
+	cs, err := Open(&Options{memory: true, changeLog: true})
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	c, err := cs.Register(&TestMigrationUser{})
+
+	ExpectedNoError(t, err)
+
+	m := &TestMigrationUser{Name: "john doe", Age: "42"}
+
+	ExpectedNoError(t, c.Create(m))
+
+	// The records and changes are stored as another model type, which should be migrated
+	copyBucket(t, cs.store, "TestMigrationUser", "TestMigrationPerson")
+
+	err = cs.store.Update(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(changesBucket))
+
+		entries := make(map[string]*changeEntry)
+
+		err := b.ForEach(func(k, v []byte) error {
+			e := &changeEntry{}
+
+			entries[string(k)] = e
+
+			return json.Unmarshal(v, e)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for k, e := range entries {
+			e.Collection = "TestMigrationPerson"
+
+			if err := putChange(b, []byte(k), e); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	_, err = cs.Register(&TestMigrationPerson{}, WithMigrations(migrationsPerson...))
+
+	ExpectedNoError(t, err)
+
+	changes, err := cs.ChangesSince(0)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(changes), 1)
+	ExpectedEqual(t, changes[0].Model.(*TestMigrationPerson).FullName, "JOHN DOE")
+	ExpectedEqual(t, changes[0].Model.(*TestMigrationPerson).Age, 42)
+}
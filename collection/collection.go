@@ -5,27 +5,48 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
-	bolt "go.etcd.io/bbolt"
 	"path/filepath"
+	"peterdekok.nl/gotools/borm/codec"
+	"peterdekok.nl/gotools/borm/compress"
+	"peterdekok.nl/gotools/borm/encrypt"
 	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
 	"peterdekok.nl/gotools/logger"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type Options struct {
-	file      string
-	dbTimeout time.Duration
-}
-
 type Collections struct {
 	c map[string]*Collection
 
-	name string
-	db   *bolt.DB
-	log  *logrus.Entry
+	name    string
+	store   storage.Storage
+	options *Options
+	codec   codec.Codec
+	log     *logrus.Entry
+	now     func() time.Time
+
+	compressor           compress.Compressor
+	compressionThreshold int
+
+	keyring *encrypt.Keyring
+	keys    encrypt.KeyProvider
+
+	changeLog      bool
+	changeMaxAge   time.Duration
+	changeMaxCount int
+
+	watchers map[*watcher]struct{}
+	watchMu  sync.Mutex
+
+	// Held while committing a transaction and sending its events, so events are sent in order of commit
+	commitMu sync.Mutex
+	// The *Tx being committed, so transactions started within it are detected
+	active atomic.Value
 
 	sync.RWMutex
 }
@@ -34,6 +55,26 @@ type Collection struct {
 	m  map[uuid.UUID]model.Interface
 	mt reflect.Type
 
+	indexes    map[string]*index
+	uniques    []*unique
+	validators []*validator
+
+	// Versions of the models as stored in the database
+	versions map[uuid.UUID]uint64
+
+	migrations    []Migration
+	schemaVersion uint64
+
+	// Whether previous versions of the models are kept, see WithHistory
+	history bool
+
+	// Codec of the collection, the codec of the collections is used when nil
+	codec codec.Codec
+
+	// Compressor of the collection, the compressor of the collections is used when nil
+	compressor           compress.Compressor
+	compressionThreshold int
+
 	name string
 	log  *logrus.Entry
 	root *Collections
@@ -41,65 +82,76 @@ type Collection struct {
 	sync.RWMutex
 }
 
+// RegisterOption configures a single collection, see Collections.Register.
+type RegisterOption func(c *Collection)
+
 var (
+	// ErrConflict is returned when a model is saved, while it was changed since it was loaded or last saved.
+	// Find, MustFind and All return the instances shared by the collection, a save of one is seen by all holders,
+	// so only saves of other instances conflict. Use FindDetached to get an instance of your own.
+	ErrConflict = errors.New("version conflict")
+	// ErrReadOnly is returned when a model is changed in collections opened read-only.
+	ErrReadOnly = errors.New("collections are read-only")
+	// ErrNestedTransaction is returned when a transaction is started within another one by the same goroutine,
+	// like the model's own methods do when called within the function passed to Collections.Transaction.
+	ErrNestedTransaction = errors.New("nested transaction")
+
 	log logger.Logger
-	DefaultOptions = &Options{
-		file:      "models.db",
-		dbTimeout: 50 * time.Millisecond,
-	}
 )
 
 func init() {
 	log = logger.New("borm.collection")
 }
 
-func (opt *Options) complete() *Options {
-	if reflect.ValueOf(opt.file).IsZero() {
-		opt.file = DefaultOptions.file
-	}
-
-	// Adding 50 ms, due to flock retry delay being subtracted from timeout
-	opt.dbTimeout += DefaultOptions.dbTimeout
-
-	return opt
-}
-
-func (opt *Options) String() string {
-	strs := make([]string, 0, 1)
+// Init opens the database of the collections, it panics when the database can not be opened.
+// Use Open to handle the error instead.
+func Init(options *Options) *Collections {
+	cs, err := open(options)
 
-	strs = append(strs, fmt.Sprintf(" file-path: %s", opt.file))
-	strs = append(strs, fmt.Sprintf("db-timeout: %s", opt.dbTimeout))
+	if err != nil {
+		panic(err)
+	}
 
-	return strings.Join(strs, ", ")
+	return cs
 }
 
-func Init(options *Options) *Collections {
+func open(options *Options) (*Collections, error) {
 	// Note: We don't need to worry about using the same file twice.
 	// BBolt will lock the file once in use.
 	if options == nil {
 		options = &Options{}
 	}
 
+	if err := options.validate(); err != nil {
+		log.WithError(err).Error("Invalid options")
+
+		return nil, fmt.Errorf("%w: %s", ErrInvalidOptions, err)
+	}
+
 	options.complete()
 
 	dbName := strings.TrimSuffix(filepath.Base(options.file), filepath.Ext(options.file))
 
-	l := log.WithField("db", dbName).WithField("options", options)
+	l := options.logger.WithField("db", dbName).WithField("options", options)
 
 	l.Debug("Initializing collection")
 
-	// Open the collection data file from the options.
-	// The default location is the `models.db` file in the current working directory
-	db, err := bolt.Open(options.file, 0600, &bolt.Options{
-		Timeout:      options.dbTimeout,
-		NoGrowSync:   false,
-		FreelistType: bolt.FreelistArrayType,
-	})
+	store := options.storage
 
-	if err != nil {
-		l.WithError(err).Error("Failed to open database")
+	if store == nil && options.memory {
+		store = storage.NewMemory()
+	} else if store == nil {
+		var err error
 
-		panic(err)
+		// Open the collection data file from the options.
+		// The default location is the `models.db` file in the current working directory
+		store, err = storage.OpenBolt(options.file, options.fileMode, options.boltOptions())
+
+		if err != nil {
+			l.WithError(err).Error("Failed to open database")
+
+			return nil, err
+		}
 	}
 
 	l.Debug("Collection initialized")
@@ -107,13 +159,42 @@ func Init(options *Options) *Collections {
 	return &Collections{
 		c: make(map[string]*Collection),
 
-		name: dbName,
-		db:   db,
-		log:  l,
+		name:    dbName,
+		store:   store,
+		options: options,
+		codec:   options.codec,
+		log:     l,
+		now:     options.clock,
+
+		compressor:           options.compressor,
+		compressionThreshold: options.compressionThreshold,
+
+		keyring: options.keyring,
+		keys:    options.keys,
+
+		changeLog:      options.changeLog,
+		changeMaxAge:   options.changeMaxAge,
+		changeMaxCount: options.changeMaxCount,
+	}, nil
+}
+
+// WithCollectionCodec sets the codec of the collection, overriding the codec of the collections.
+func WithCollectionCodec(c codec.Codec) RegisterOption {
+	return func(col *Collection) {
+		col.codec = c
 	}
 }
 
-func (cs *Collections) Register(mi model.Interface) (model.CollectionInterface, error) {
+// WithCollectionCompression compresses the records of the collection with the compressor,
+// overriding the compression of the collections, see WithCompression.
+func WithCollectionCompression(c compress.Compressor, threshold int) RegisterOption {
+	return func(col *Collection) {
+		col.compressor = c
+		col.compressionThreshold = threshold
+	}
+}
+
+func (cs *Collections) Register(mi model.Interface, opts ...RegisterOption) (model.CollectionInterface, error) {
 	iv, _, err := model.CheckInterface(mi)
 
 	if err != nil {
@@ -137,22 +218,69 @@ func (cs *Collections) Register(mi model.Interface) (model.CollectionInterface,
 		return nil, fmt.Errorf("failed to register model: %s", err)
 	}
 
+	c, err := cs.newCollection(iv.Type(), l, opts)
+
+	if err != nil {
+		l.WithError(err).Error("Failed to register model")
+
+		return nil, fmt.Errorf("failed to register model: %s", err)
+	}
+
+	if _, err := c.migrate(false); err != nil {
+		l.WithError(err).Error("Failed to register model")
+
+		return nil, fmt.Errorf("failed to register model: %s", err)
+	}
+
+	stale, err := c.load()
+
+	if err == nil && len(stale) > 0 {
+		err = c.persistIndexes(stale)
+	}
+
+	if err != nil {
+		l.WithError(err).Error("Failed to register model")
+
+		return nil, fmt.Errorf("failed to register model: %s", err)
+	}
+
+	cs.c[name] = c
+
+	return c, nil
+}
+
+// newCollection creates a collection of the model type, which is not registered yet.
+func (cs *Collections) newCollection(mt reflect.Type, l *logrus.Entry, opts []RegisterOption) (*Collection, error) {
 	c := &Collection{
 		m:  make(map[uuid.UUID]model.Interface),
-		mt: iv.Type(),
+		mt: mt,
+
+		versions: make(map[uuid.UUID]uint64),
 
-		name: name,
+		name: mt.Name(),
 		log:  l,
 		root: cs,
 	}
 
-	if err := c.load(); err != nil {
-		l.WithError(err).Error("Failed to register model")
+	for _, o := range opts {
+		o(c)
+	}
 
-		return nil, fmt.Errorf("failed to register model: %s", err)
+	if c.compressionThreshold < 0 {
+		return nil, fmt.Errorf("invalid compression threshold %d", c.compressionThreshold)
 	}
 
-	cs.c[name] = c
+	if err := c.initIndexes(); err != nil {
+		return nil, err
+	}
+
+	if err := c.initUniques(); err != nil {
+		return nil, err
+	}
+
+	if err := c.initValidators(); err != nil {
+		return nil, err
+	}
 
 	return c, nil
 }
@@ -168,46 +296,276 @@ func (cs *Collections) Get(name string) (model.CollectionInterface, error) {
 	return nil, fmt.Errorf("collection %s not found", name)
 }
 
+// ReadOnly reports whether the collections were opened read-only, see WithReadOnly.
+func (cs *Collections) ReadOnly() bool {
+	return cs.store.ReadOnly()
+}
+
+// InMemory reports whether the collections are kept in memory only, see WithInMemory.
+func (cs *Collections) InMemory() bool {
+	_, ok := cs.store.(*storage.Memory)
+
+	return ok
+}
+
+// reopener is implemented by storages which can open their database file again, see storage.Bolt.
+type reopener interface {
+	Reopen() error
+}
+
+// Refresh re-syncs the models of all registered collections from the database.
+// Models which were removed from the database are removed from the collections,
+// the other models are replaced by newly loaded instances.
+// A database file opened read-only is opened again first, so the collections read the snapshot
+// which replaced it since, see WithReadOnly.
+func (cs *Collections) Refresh() error {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	if r, ok := cs.store.(reopener); ok && cs.store.ReadOnly() {
+		if err := r.Reopen(); err != nil {
+			cs.log.WithError(err).Error("Failed to reopen database")
+
+			return fmt.Errorf("failed to reopen database: %s", err)
+		}
+	}
+
+	for name, c := range cs.c {
+		if err := c.refresh(); err != nil {
+			cs.log.WithField("collection", name).WithError(err).Error("Failed to refresh collection")
+
+			return fmt.Errorf("failed to refresh collection %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
 func (cs *Collections) Close() error {
 	cs.Lock()
 	defer cs.Unlock()
 
-	return cs.db.Close()
+	cs.unwatchAll()
+
+	return cs.store.Close()
+}
+
+// Now returns the current time of the clock of the collections, it is used to timestamp the models.
+func (c *Collection) Now() time.Time {
+	return c.root.now()
+}
+
+// Codec returns the codec the models of the collection are encoded with when saved.
+func (c *Collection) Codec() codec.Codec {
+	if c.codec != nil {
+		return c.codec
+	}
+
+	if c.root.codec != nil {
+		return c.root.codec
+	}
+
+	return codec.JSON
 }
 
 func (c *Collection) Load() error {
 	c.Lock()
-	defer c.Unlock()
+	stale, err := c.load()
+	c.Unlock()
+
+	if err != nil || len(stale) == 0 {
+		return err
+	}
 
-	return c.load()
+	// Persisted outside the collection lock, write transactions take the database lock before the collection lock
+	return c.persistIndexes(stale)
 }
 
-func (c *Collection) load() error {
-	return c.root.db.View(func(tx *bolt.Tx) error {
+func (c *Collection) refresh() error {
+	c.Lock()
+	c.m = make(map[uuid.UUID]model.Interface)
+	c.versions = make(map[uuid.UUID]uint64)
+	stale, err := c.load()
+	c.Unlock()
+
+	if err != nil || len(stale) == 0 {
+		return err
+	}
+
+	return c.persistIndexes(stale)
+}
+
+// load reads the models and indexes from the database.
+// The names of the indexes which should be persisted again are returned.
+func (c *Collection) load() ([]string, error) {
+	var stale []string
+
+	err := c.root.store.View(func(tx storage.Tx) error {
 		b := tx.Bucket([]byte(c.name))
 
-		if b == nil {
-			return nil
-		}
+		if b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				if v == nil {
+					return nil
+				}
 
-		return b.ForEach(func(k, v []byte) error {
-			if v == nil {
-				return nil
-			}
+				nmi, err := c.unseal(k, v)
 
-			var nmi model.Interface
+				if err != nil {
+					return err
+				}
 
-			nmiV := reflect.ValueOf(&nmi)
-			nmiV.Elem().Set(reflect.New(c.mt))
+				if h, ok := nmi.(model.AfterLoader); ok {
+					h.AfterLoad()
+				}
+
+				c.m[nmi.Id()] = nmi
+				c.versions[nmi.Id()] = nmi.Version()
+
+				return nil
+			})
 
-			if _, err := model.Unmarshal(v, nmi, c); err != nil {
+			if err != nil {
 				return err
 			}
+		}
 
-			c.m[nmi.Id()] = nmi
+		var err error
 
-			return nil
-		})
+		stale, err = c.loadIndexes(b)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.loadUniques()
+
+	return stale, nil
+}
+
+// Find returns the model with the given id.
+// Soft deleted models are not found, unless requested by scope.
+func (c *Collection) Find(id uuid.UUID, scope ...model.Scope) (model.Interface, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if i, ok := c.m[id]; ok && model.ScopeOf(scope).Includes(i) {
+		return i, nil
+	}
+
+	return nil, fmt.Errorf("model %s not found", id)
+}
+
+// MustFind is like Find, but panics when the model is not found.
+func (c *Collection) MustFind(id uuid.UUID, scope ...model.Scope) model.Interface {
+	i, err := c.Find(id, scope...)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return i
+}
+
+// FindDetached returns a new instance of the model with the given id as it is stored, detached from the instance
+// Find returns. Saving it is checked against the stored version, so concurrent changes to copies of one model
+// conflict instead of overwriting each other, a saved copy replaces the instance in the collection.
+// Soft deleted models are not found, unless requested by scope.
+func (c *Collection) FindDetached(id uuid.UUID, scope ...model.Scope) (model.Interface, error) {
+	var i model.Interface
+
+	err := c.root.store.View(func(tx storage.Tx) error {
+		var err error
+
+		i, err = c.stored(tx, id)
+
+		return err
+	})
+
+	if err != nil {
+		c.log.WithError(err).Error("Failed to find model")
+
+		return nil, fmt.Errorf("failed to find model: %s", err)
+	}
+
+	if i == nil || !model.ScopeOf(scope).Includes(i) {
+		return nil, fmt.Errorf("model %s not found", id)
+	}
+
+	if h, ok := i.(model.AfterLoader); ok {
+		h.AfterLoad()
+	}
+
+	return i, nil
+}
+
+// All returns the models of the collection, ordered by creation.
+// Soft deleted models are left out, unless requested by scope.
+func (c *Collection) All(scope ...model.Scope) []model.Interface {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.all(model.ScopeOf(scope))
+}
+
+// Count returns the number of models in the collection.
+// Soft deleted models are not counted, unless requested by scope.
+func (c *Collection) Count(scope ...model.Scope) int {
+	c.RLock()
+	defer c.RUnlock()
+
+	s := model.ScopeOf(scope)
+
+	if s == model.WithDeleted {
+		return len(c.m)
+	}
+
+	n := 0
+
+	for _, i := range c.m {
+		if s.Includes(i) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Each calls fn for every model in the collection, ordered by creation, until fn returns false.
+// Soft deleted models are skipped, unless requested by scope.
+// The models are collected up front, fn is free to modify the collection.
+func (c *Collection) Each(fn func(i model.Interface) bool, scope ...model.Scope) {
+	for _, i := range c.All(scope...) {
+		if !fn(i) {
+			return
+		}
+	}
+}
+
+func (c *Collection) all(s model.Scope) []model.Interface {
+	is := make([]model.Interface, 0, len(c.m))
+
+	for _, i := range c.m {
+		if s.Includes(i) {
+			is = append(is, i)
+		}
+	}
+
+	sortByCreation(is)
+
+	return is
+}
+
+func sortByCreation(is []model.Interface) {
+	sort.Slice(is, func(a, b int) bool {
+		if is[a].CreatedAt().Equal(is[b].CreatedAt()) {
+			return is[a].Id().String() < is[b].Id().String()
+		}
+
+		return is[a].CreatedAt().Before(is[b].CreatedAt())
 	})
 }
 
@@ -220,54 +578,368 @@ func (c *Collection) Create(i model.Interface) error {
 }
 
 func (c *Collection) Save(i model.Interface) error {
-	ic := i.Collection()
+	return c.saveIn(nil, i)
+}
 
-	if c != ic {
-		err := errors.New("save called with model of other collection")
+// Delete persists a soft deleted model.
+// The model should be stamped as deleted, use the model's Delete method to do so.
+func (c *Collection) Delete(i model.Interface) error {
+	return c.deleteIn(nil, i)
+}
+
+// Restore persists a model of which the soft delete was reverted.
+// The model should no longer be stamped as deleted, use the model's Restore method to do so.
+func (c *Collection) Restore(i model.Interface) error {
+	return c.restoreIn(nil, i)
+}
+
+// Purge permanently removes a soft deleted model from the collection and the database.
+func (c *Collection) Purge(i model.Interface) error {
+	return c.purgeIn(nil, i)
+}
+
+// PurgeDeletedBefore permanently removes all models soft deleted before the cutoff.
+// All models are removed in a single transaction, the number of purged models is returned.
+func (c *Collection) PurgeDeletedBefore(t time.Time) (int, error) {
+	n := 0
 
+	err := c.root.transaction(func(tx *Tx) error {
+		for _, i := range c.deletedBefore(t) {
+			if err := c.purge(tx, i); err != nil {
+				return err
+			}
+
+			n++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		c.log.WithError(err).Error("Failed to purge models")
+
+		return 0, fmt.Errorf("failed to purge models: %s", err)
+	}
+
+	return n, nil
+}
+
+// The *In variants persist within the given transaction, a nil transaction persists in a transaction of its own.
+
+func (c *Collection) saveIn(t *Tx, i model.Interface) error {
+	if err := c.save(t, i, Updated); err != nil {
 		c.log.WithError(err).Error("Failed to save model")
 
-		return fmt.Errorf("failed to save model: %s", err)
+		return fmt.Errorf("failed to save model: %w", err)
 	}
 
-	v, err := i.Marshal()
+	return nil
+}
+
+func (c *Collection) deleteIn(t *Tx, i model.Interface) error {
+	var err error
+
+	if !i.Deleted() {
+		err = errors.New("model not deleted")
+	} else {
+		err = c.save(t, i, Deleted)
+	}
 
 	if err != nil {
-		c.log.WithError(err).Error("Failed to save model")
+		c.log.WithError(err).Error("Failed to delete model")
+
+		return fmt.Errorf("failed to delete model: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Collection) restoreIn(t *Tx, i model.Interface) error {
+	var err error
+
+	if i.Deleted() {
+		err = errors.New("model still deleted")
+	} else {
+		err = c.save(t, i, Restored)
+	}
 
-		return fmt.Errorf("failed to save model: %s", err)
+	if err != nil {
+		c.log.WithError(err).Error("Failed to restore model")
+
+		return fmt.Errorf("failed to restore model: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Collection) purgeIn(t *Tx, i model.Interface) error {
+	if err := c.purge(t, i); err != nil {
+		c.log.WithError(err).Error("Failed to purge model")
+
+		return fmt.Errorf("failed to purge model: %s", err)
+	}
+
+	return nil
+}
+
+// deletedBefore returns the models soft deleted before the cutoff.
+func (c *Collection) deletedBefore(t time.Time) []model.Interface {
+	c.RLock()
+	defer c.RUnlock()
+
+	is := make([]model.Interface, 0)
+
+	for _, i := range c.m {
+		if i.Deleted() && i.DeletedAt().Before(t) {
+			is = append(is, i)
+		}
+	}
+
+	return is
+}
+
+func (c *Collection) purge(t *Tx, i model.Interface) error {
+	if t == nil {
+		return c.root.transaction(func(t *Tx) error {
+			return c.purge(t, i)
+		})
+	}
+
+	if c != i.Collection() {
+		return errors.New("purge called with model of other collection")
+	}
+
+	if !i.Deleted() {
+		return errors.New("model not deleted")
 	}
 
 	c.Lock()
 	defer c.Unlock()
 
-	if ei, exists := c.m[i.Id()]; exists {
-		if ei != i {
-			err := errors.New("duplicate model")
+	id := i.Id()
+
+	if ei, exists := c.m[id]; !exists || ei != i {
+		return errors.New("unknown model")
+	}
+
+	b := t.tx.Bucket([]byte(c.name))
+
+	if b == nil {
+		return errors.New("bucket missing")
+	}
+
+	var old model.Interface
+
+	watched := c.root.watched(c.name)
 
-			c.log.WithError(err).Error("Failed to save model")
+	if watched {
+		var err error
 
-			return fmt.Errorf("failed to save model: %s", err)
+		if old, err = c.stored(t.tx, id); err != nil {
+			return err
 		}
 	}
 
-	err = c.root.db.Update(func(tx *bolt.Tx) error {
-		b, _ := tx.CreateBucketIfNotExists([]byte(c.name))
+	if err := b.Delete([]byte(id.String())); err != nil {
+		return err
+	}
 
-		if err := b.Put([]byte(i.Id().String()), v); err != nil {
+	if err := c.deleteIndexes(b, id); err != nil {
+		return err
+	}
+
+	if err := c.deleteHistory(b, id); err != nil {
+		return err
+	}
+
+	t.onRollback(c.snapshot(id))
+
+	if err := c.logChange(t, Purged, id); err != nil {
+		return err
+	}
+
+	if watched {
+		if err := c.event(t, Purged, id, old); err != nil {
 			return err
 		}
+	}
 
-		return nil
-	})
+	delete(c.m, id)
+	delete(c.versions, id)
+	c.unindex(id)
+	c.unconstrain(id)
+
+	return nil
+}
+
+// save persists the model, typ is the type of the change of models which already exist.
+func (c *Collection) save(t *Tx, i model.Interface, typ EventType) error {
+	if t == nil {
+		return c.root.transaction(func(t *Tx) error {
+			return c.save(t, i, typ)
+		})
+	}
+
+	ic := i.Collection()
+
+	if c != ic {
+		return errors.New("save called with model of other collection")
+	}
+
+	// Validated before locking the collection, so validators can query the collection.
+	// Deletes and restores only change the timestamps, models stored before their rules were declared can be deleted.
+	if typ != Deleted && typ != Restored {
+		if err := c.validate(i); err != nil {
+			return err
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	id := i.Id()
+
+	// Another instance of the model may have replaced it by a reload, it is saved when it is not outdated
+	ei, exists := c.m[id]
+
+	if exists && ei != i && !i.Exists() {
+		return errors.New("duplicate model")
+	}
+
+	if !exists {
+		typ = Created
+	}
+
+	stored := c.versions[id]
+
+	if i.Version() != stored {
+		return fmt.Errorf("%w: model %s has version %d, stored version is %d", ErrConflict, id, i.Version(), stored)
+	}
+
+	uniqueKeys, err := c.uniqueKeys(i)
 
 	if err != nil {
-		c.log.WithError(err).Error("Failed to save model")
+		return err
+	}
+
+	keys := c.indexKeys(i)
 
-		return fmt.Errorf("failed to save model: %s", err)
+	var old model.Interface
+
+	watched := c.root.watched(c.name)
+
+	if watched {
+		if old, err = c.stored(t.tx, id); err != nil {
+			return err
+		}
+	}
+
+	if c.history {
+		if err := c.archive(t.tx, id); err != nil {
+			return err
+		}
 	}
 
-	c.m[i.Id()] = i
+	model.SetVersion(i, stored+1)
+
+	if err := c.write(t.tx, i, keys); err != nil {
+		model.SetVersion(i, stored)
+
+		return err
+	}
+
+	t.onRollback(func() {
+		model.SetVersion(i, stored)
+	})
+
+	t.onRollback(c.snapshot(id))
+
+	if err := c.logChange(t, typ, id); err != nil {
+		return err
+	}
+
+	if watched {
+		if err := c.event(t, typ, id, old); err != nil {
+			return err
+		}
+	}
+
+	c.m[id] = i
+	c.versions[id] = i.Version()
+	c.index(id, keys)
+	c.constrain(id, uniqueKeys)
 
 	return nil
 }
+
+// write persists the model and its index keys.
+func (c *Collection) write(tx storage.Tx, i model.Interface, keys map[string][]byte) error {
+	v, err := c.encode(i)
+
+	if err != nil {
+		return err
+	}
+
+	b, err := tx.CreateBucketIfNotExists([]byte(c.name))
+
+	if err != nil {
+		return err
+	}
+
+	if err := b.Put([]byte(i.Id().String()), v); err != nil {
+		return err
+	}
+
+	return c.putIndexes(b, i.Id(), keys)
+}
+
+// snapshot captures the in-memory state of a model, the returned function reverts the collection to it.
+// The collection should be locked while taking the snapshot.
+func (c *Collection) snapshot(id uuid.UUID) func() {
+	i, exists := c.m[id]
+	version, stored := c.versions[id]
+
+	keys := make(map[string][]byte)
+
+	for name, x := range c.indexes {
+		if key, ok := x.keys[id]; ok {
+			keys[name] = key
+		}
+	}
+
+	uniqueKeys := make(map[*unique]string)
+
+	for _, u := range c.uniques {
+		if key, ok := u.keys[id]; ok {
+			uniqueKeys[u] = key
+		}
+	}
+
+	return func() {
+		c.Lock()
+		defer c.Unlock()
+
+		delete(c.m, id)
+		delete(c.versions, id)
+		c.unindex(id)
+		c.unconstrain(id)
+
+		if stored {
+			c.versions[id] = version
+		}
+
+		if !exists {
+			return
+		}
+
+		c.m[id] = i
+
+		for name, key := range keys {
+			c.indexes[name].put(id, key)
+		}
+
+		for u, key := range uniqueKeys {
+			u.put(id, key)
+		}
+	}
+}
@@ -1,11 +1,19 @@
 package collection
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	bolt "go.etcd.io/bbolt"
+	"os"
+	"peterdekok.nl/gotools/borm/codec"
+	"peterdekok.nl/gotools/borm/compress"
+	"peterdekok.nl/gotools/borm/encrypt"
 	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
 	. "peterdekok.nl/gotools/test"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,6 +34,36 @@ func init() {
 	DefaultOptions.file = "testdata/models.db"
 }
 
+// boltDB returns the database of collections stored in the default storage.
+func boltDB(cs *Collections) *bolt.DB {
+	return cs.store.(*storage.Bolt).DB()
+}
+
+// testCollections returns in-memory collections with the models registered, so tests do not share a database file.
+func testCollections(t *testing.T, ms ...model.Interface) (*Collections, []model.CollectionInterface) {
+	opt, err := NewOptions(WithInMemory())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := Open(opt)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cis := make([]model.CollectionInterface, len(ms))
+
+	for x, m := range ms {
+		if cis[x], err = cs.Register(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return cs, cis
+}
+
 func (m *TestCollectionStaticIdA) Id() uuid.UUID {
 	u, _ := uuid.Parse("aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa")
 
@@ -48,11 +86,15 @@ func (m *TestCollectionPtrToInt) Id() uuid.UUID                         { return
 func (m *TestCollectionPtrToInt) CreatedAt() time.Time                  { return time.Time{} }
 func (m *TestCollectionPtrToInt) UpdatedAt() time.Time                  { return time.Time{} }
 func (m *TestCollectionPtrToInt) DeletedAt() time.Time                  { return time.Time{} }
+func (m *TestCollectionPtrToInt) Version() uint64                       { return 0 }
 func (m *TestCollectionPtrToInt) Exists() bool                          { return true }
+func (m *TestCollectionPtrToInt) Deleted() bool                         { return false }
 func (m *TestCollectionPtrToInt) Collection() model.CollectionInterface { return nil }
 func (m *TestCollectionPtrToInt) Marshal() ([]byte, error)              { return nil, nil }
 func (m *TestCollectionPtrToInt) Unmarshal(_ []byte) error              { return nil }
 func (m *TestCollectionPtrToInt) Save() error                           { return errors.New("error") }
+func (m *TestCollectionPtrToInt) Delete() error                         { return errors.New("error") }
+func (m *TestCollectionPtrToInt) Restore() error                        { return errors.New("error") }
 func (m *TestCollectionPtrToInt) Lock()                                 {}
 func (m *TestCollectionPtrToInt) Unlock()                               {}
 
@@ -68,48 +110,11 @@ func (ue *TestCollectionUnmarshalError) Marshal() ([]byte, error) {
 
 type TestCollectionStructNoBucket struct{ model.Model }
 
-func TestOptions_complete(t *testing.T) {
-	optA := &Options{}
-	optA.complete()
-
-	ExpectedEqual(t, optA.file, "testdata/models.db")
-	ExpectedEqual(t, optA.dbTimeout, 50*time.Millisecond)
-
-	optB := &Options{
-		file: "testdata/test.db",
-	}
-	optB.complete()
-
-	ExpectedEqual(t, optB.file, "testdata/test.db")
-	ExpectedEqual(t, optB.dbTimeout, 50*time.Millisecond)
-
-	optC := &Options{
-		file:      "testdata/test.db",
-		dbTimeout: 200 * time.Millisecond,
-	}
-	optC.complete()
-
-	ExpectedEqual(t, optC.file, "testdata/test.db")
-	ExpectedEqual(t, optC.dbTimeout, 250*time.Millisecond)
-}
-
-func TestOptions_String(t *testing.T) {
-	optA := &Options{
-		file: "testdata/test.db",
-	}
-
-	ExpectedEqual(t, optA.String(), " file-path: testdata/test.db, db-timeout: 0s")
-
-	optA.complete()
-
-	ExpectedEqual(t, optA.String(), " file-path: testdata/test.db, db-timeout: 50ms")
-}
-
 func TestInit(t *testing.T) {
 	csA := Init(nil)
 
 	defer func() {
-		if err := csA.db.Close(); err != nil {
+		if err := boltDB(csA).Close(); err != nil {
 			t.Error("Failed to close db")
 
 			t.Fail()
@@ -117,9 +122,9 @@ func TestInit(t *testing.T) {
 	}()
 
 	ExpectedEqual(t, csA.name, "models")
-	ExpectedEqual(t, csA.db.Path(), "testdata/models.db")
+	ExpectedEqual(t, boltDB(csA).Path(), "testdata/models.db")
 
-	err := csA.db.Update(func(tx *bolt.Tx) error {
+	err := boltDB(csA).Update(func(tx *bolt.Tx) error {
 		if !tx.Writable() {
 			t.Error("database should be writable")
 
@@ -162,14 +167,14 @@ func TestCollections_Register(t *testing.T) {
 	csA := Init(nil)
 
 	defer func() {
-		if err := csA.db.Close(); err != nil {
+		if err := boltDB(csA).Close(); err != nil {
 			t.Error("Failed to close db")
 
 			t.Fail()
 		}
 	}()
 
-	err = csA.db.Update(func(tx *bolt.Tx) error {
+	err = boltDB(csA).Update(func(tx *bolt.Tx) error {
 		c := tx.Cursor()
 		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
 			if err := tx.DeleteBucket(k); err != nil {
@@ -193,7 +198,7 @@ func TestCollections_Register(t *testing.T) {
 
 	ExpectedError(t, err, "failed to register model: duplicate name")
 
-	err = csA.db.Update(func(tx *bolt.Tx) error {
+	err = boltDB(csA).Update(func(tx *bolt.Tx) error {
 		b, _ := tx.CreateBucketIfNotExists([]byte("TestCollectionUnmarshalError"))
 
 		return b.Put([]byte("some-test-key"), []byte("{}"))
@@ -209,7 +214,7 @@ func TestCollections_Register(t *testing.T) {
 
 	ExpectedNoError(t, err)
 
-	err = csA.db.Update(func(tx *bolt.Tx) error {
+	err = boltDB(csA).Update(func(tx *bolt.Tx) error {
 		b, _ := tx.CreateBucketIfNotExists([]byte("TestCollectionStructB"))
 
 		_, err := b.CreateBucketIfNotExists([]byte("test"))
@@ -251,7 +256,7 @@ func TestCollections_Get(t *testing.T) {
 	csA := Init(nil)
 
 	defer func() {
-		if err := csA.db.Close(); err != nil {
+		if err := boltDB(csA).Close(); err != nil {
 			t.Error("Failed to close db")
 
 			t.Fail()
@@ -281,14 +286,14 @@ func TestCollection_Load(t *testing.T) {
 	csA := Init(nil)
 
 	defer func() {
-		if err := csA.db.Close(); err != nil {
+		if err := boltDB(csA).Close(); err != nil {
 			t.Error("Failed to close db")
 
 			t.Fail()
 		}
 	}()
 
-	err := csA.db.Update(func(tx *bolt.Tx) error {
+	err := boltDB(csA).Update(func(tx *bolt.Tx) error {
 		c := tx.Cursor()
 		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
 			if err := tx.DeleteBucket(k); err != nil {
@@ -330,7 +335,7 @@ func TestCollection_Create(t *testing.T) {
 	csA := Init(nil)
 
 	defer func() {
-		if err := csA.db.Close(); err != nil {
+		if err := boltDB(csA).Close(); err != nil {
 			t.Error("Failed to close db")
 
 			t.Fail()
@@ -354,14 +359,14 @@ func TestCollection_Save(t *testing.T) {
 	cs := Init(nil)
 
 	defer func() {
-		if err := cs.db.Close(); err != nil {
+		if err := boltDB(cs).Close(); err != nil {
 			t.Error("Failed to close db")
 
 			t.Fail()
 		}
 	}()
 
-	err := cs.db.Update(func(tx *bolt.Tx) error {
+	err := boltDB(cs).Update(func(tx *bolt.Tx) error {
 		c := tx.Cursor()
 		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
 			if err := tx.DeleteBucket(k); err != nil {
@@ -413,7 +418,7 @@ func TestCollection_Save(t *testing.T) {
 
 	ExpectedNoError(t, err)
 
-	err = cs.db.Update(func(tx *bolt.Tx) error {
+	err = boltDB(cs).Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(cC.(*Collection).name))
 
 		ExpectedNoError(t, err)
@@ -442,10 +447,150 @@ func TestCollection_Save(t *testing.T) {
 	ExpectedError(t, err, "failed to save model: incompatible value")
 }
 
+func TestCollection_Save_conflict(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	ExpectedNoError(t, c.Create(mA))
+	ExpectedEqual(t, mA.Version(), uint64(1))
+
+	ExpectedNoError(t, mA.Save())
+	ExpectedEqual(t, mA.Version(), uint64(2))
+
+	// Reloading replaces the model by another instance
+	ExpectedNoError(t, c.Load())
+
+	mB, ok := c.MustFind(mA.Id()).(*TestCollectionStructB)
+
+	ExpectedEqualF(t, ok, true, true, "loaded model should be of the registered type")
+	ExpectedEqualF(t, mB != mA, true, true, "loaded model should be another instance")
+	ExpectedEqual(t, mB.Version(), uint64(2))
+
+	// The first save of either instance wins
+	mA.FieldA = "test-bbb"
+
+	ExpectedNoError(t, mA.Save())
+	ExpectedEqual(t, mA.Version(), uint64(3))
+	ExpectedEqual(t, c.MustFind(mA.Id()), model.Interface(mA))
+
+	updatedAt := mB.UpdatedAt()
+
+	mB.FieldA = "test-ccc"
+
+	err = mB.Save()
+
+	ExpectedError(t, err, fmt.Sprintf("failed to save model: failed to save model: version conflict: model %s has version 2, stored version is 3", mA.Id()))
+	ExpectedEqualF(t, errors.Is(err, ErrConflict), true, false, "expected a conflict error")
+	ExpectedEqual(t, mB.Version(), uint64(2))
+	ExpectedEqualF(t, mB.UpdatedAt().Equal(updatedAt), true, false, "timestamps should be restored on conflict")
+
+	// Reverted versions on rollback
+	err = cs.Transaction(func(tx *Tx) error {
+		if err := tx.Save(mA); err != nil {
+			return err
+		}
+
+		return errors.New("error")
+	})
+
+	ExpectedError(t, err, "failed to commit transaction: error")
+	ExpectedEqual(t, mA.Version(), uint64(3))
+	ExpectedNoError(t, mA.Save())
+}
+
+func TestCollection_FindDetached(t *testing.T) {
+	t.Parallel()
+
+	opt, err := NewOptions(WithInMemory())
+
+	ExpectedNoError(t, err)
+
+	cs, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	ci, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	c := ci.(*Collection)
+
+	m := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	ExpectedNoError(t, c.Create(m))
+
+	// Find shares one instance, its holders do not conflict but overwrite each other
+	ExpectedEqual(t, c.MustFind(m.Id()), model.Interface(m))
+
+	id := uuid.New()
+
+	_, err = c.FindDetached(id)
+
+	ExpectedError(t, err, "model "+id.String()+" not found")
+
+	dA, err := c.FindDetached(m.Id())
+
+	ExpectedNoError(t, err)
+
+	dB, err := c.FindDetached(m.Id())
+
+	ExpectedNoError(t, err)
+
+	mA, ok := dA.(*TestCollectionStructB)
+
+	ExpectedEqualF(t, ok, true, true, "detached model should be of the registered type")
+	ExpectedEqualF(t, dA != model.Interface(m) && dA != dB, true, true, "detached models should be new instances")
+	ExpectedEqual(t, mA.FieldA, "test-aaa")
+	ExpectedEqual(t, mA.Version(), uint64(1))
+
+	mB := dB.(*TestCollectionStructB)
+
+	mA.FieldA = "test-bbb"
+	mB.FieldA = "test-ccc"
+
+	ExpectedNoError(t, mA.Save())
+	ExpectedEqual(t, c.MustFind(m.Id()), model.Interface(mA))
+
+	err = mB.Save()
+
+	ExpectedEqualF(t, errors.Is(err, ErrConflict), true, false, "expected a conflict error")
+	ExpectedEqual(t, mB.Version(), uint64(1))
+
+	dC, err := c.FindDetached(m.Id())
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, dC.(*TestCollectionStructB).FieldA, "test-bbb")
+	ExpectedEqual(t, dC.Version(), uint64(2))
+
+	// Soft deleted models are found when requested by scope only
+	ExpectedNoError(t, dC.Delete())
+
+	_, err = c.FindDetached(m.Id())
+
+	ExpectedError(t, err, "model "+m.Id().String()+" not found")
+
+	_, err = c.FindDetached(m.Id(), model.WithDeleted)
+
+	ExpectedNoError(t, err)
+}
+
 func TestCollections_Close(t *testing.T) {
 	cs := Init(nil)
 
-	err := cs.db.View(func(tx *bolt.Tx) error {
+	err := boltDB(cs).View(func(tx *bolt.Tx) error {
 		return nil
 	})
 
@@ -455,7 +600,1237 @@ func TestCollections_Close(t *testing.T) {
 
 	ExpectedNoError(t, err)
 
-	_, err = cs.db.Begin(false)
+	_, err = boltDB(cs).Begin(false)
 
 	ExpectedError(t, err, "database not open")
 }
+
+func TestCollection_Delete(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	err = c.Create(mA)
+
+	ExpectedNoError(t, err)
+
+	err = c.Delete(mA)
+
+	ExpectedError(t, err, "failed to delete model: model not deleted")
+
+	err = mA.Delete()
+
+	ExpectedNoError(t, err)
+
+	err = c.Delete(new(TestCollectionPtrToInt))
+
+	ExpectedError(t, err, "failed to delete model: model not deleted")
+
+	cB := c.(*Collection)
+
+	ExpectedEqual(t, cB.m[mA.Id()], model.Interface(mA))
+
+	cB.m = make(map[uuid.UUID]model.Interface)
+
+	err = c.Load()
+
+	ExpectedNoError(t, err)
+
+	mB, ok := cB.m[mA.Id()].(*TestCollectionStructB)
+
+	ExpectedEqualF(t, ok, true, true, "loaded model should be of the registered type")
+
+	ExpectedEqual(t, mB.FieldA, "test-aaa")
+	ExpectedEqualF(t, mB.DeletedAt().Equal(mA.DeletedAt()), true, false, "Deleted at should be persisted")
+}
+
+func TestCollection_Restore(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	err = c.Create(mA)
+
+	ExpectedNoError(t, err)
+
+	err = mA.Delete()
+
+	ExpectedNoError(t, err)
+
+	err = c.Restore(mA)
+
+	ExpectedError(t, err, "failed to restore model: model still deleted")
+
+	cB := c.(*Collection)
+	cB.m = make(map[uuid.UUID]model.Interface)
+
+	err = c.Load()
+
+	ExpectedNoError(t, err)
+
+	mB := cB.m[mA.Id()]
+
+	err = mB.Restore()
+
+	ExpectedNoError(t, err)
+
+	cB.m = make(map[uuid.UUID]model.Interface)
+
+	err = c.Load()
+
+	ExpectedNoError(t, err)
+
+	ExpectedZeroValue(t, cB.m[mA.Id()].DeletedAt())
+}
+
+func TestCollection_Purge(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	cA, err := cs.Register(&TestCollectionStructA{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	err = c.Create(mA)
+
+	ExpectedNoError(t, err)
+
+	err = cA.Purge(mA)
+
+	ExpectedError(t, err, "failed to purge model: purge called with model of other collection")
+
+	err = c.Purge(mA)
+
+	ExpectedError(t, err, "failed to purge model: model not deleted")
+
+	err = mA.Delete()
+
+	ExpectedNoError(t, err)
+
+	mB := &TestCollectionStructB{}
+
+	_, err = model.Embed(mB, c)
+
+	ExpectedNoError(t, err)
+
+	b, err := mA.Marshal()
+
+	ExpectedNoError(t, err)
+
+	err = mB.Unmarshal(b)
+
+	ExpectedNoError(t, err)
+
+	err = c.Purge(mB)
+
+	ExpectedError(t, err, "failed to purge model: unknown model")
+
+	err = c.Purge(mA)
+
+	ExpectedNoError(t, err)
+
+	cB := c.(*Collection)
+
+	_, exists := cB.m[mA.Id()]
+
+	ExpectedEqualF(t, exists, false, false, "purged model should be removed from the collection")
+
+	err = c.Load()
+
+	ExpectedNoError(t, err)
+
+	_, exists = cB.m[mA.Id()]
+
+	ExpectedEqualF(t, exists, false, false, "purged model should be removed from the database")
+}
+
+func TestCollection_PurgeDeletedBefore(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	err := boltDB(cs).Update(func(tx *bolt.Tx) error {
+		c := tx.Cursor()
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			if err := tx.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	n, err := c.PurgeDeletedBefore(time.Now())
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, n, 0)
+
+	ms := make([]*TestCollectionStructB, 3)
+
+	for k := range ms {
+		ms[k] = &TestCollectionStructB{FieldB: k}
+
+		err = c.Create(ms[k])
+
+		ExpectedNoError(t, err)
+	}
+
+	err = ms[0].Delete()
+
+	ExpectedNoError(t, err)
+
+	cutoff := time.Now()
+
+	err = ms[1].Delete()
+
+	ExpectedNoError(t, err)
+
+	n, err = c.PurgeDeletedBefore(cutoff)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, n, 1)
+
+	cB := c.(*Collection)
+	cB.m = make(map[uuid.UUID]model.Interface)
+
+	err = c.Load()
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, len(cB.m), 2)
+
+	_, exists := cB.m[ms[0].Id()]
+
+	ExpectedEqualF(t, exists, false, false, "model deleted before cutoff should be purged")
+
+	n, err = c.PurgeDeletedBefore(time.Now())
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, n, 1)
+
+	ExpectedEqual(t, len(cB.m), 1)
+}
+
+func TestCollection_Find(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	id := uuid.New()
+
+	_, err = c.Find(id)
+
+	ExpectedError(t, err, "model "+id.String()+" not found")
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	err = c.Create(mA)
+
+	ExpectedNoError(t, err)
+
+	i, err := c.Find(mA.Id())
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, i, model.Interface(mA))
+
+	err = mA.Delete()
+
+	ExpectedNoError(t, err)
+
+	_, err = c.Find(mA.Id())
+
+	ExpectedError(t, err, "model "+mA.Id().String()+" not found")
+
+	i, err = c.Find(mA.Id(), model.WithDeleted)
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, i, model.Interface(mA))
+
+	i, err = c.Find(mA.Id(), model.OnlyDeleted)
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, i, model.Interface(mA))
+}
+
+func TestCollection_MustFind(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	err = c.Create(mA)
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, c.MustFind(mA.Id()), model.Interface(mA))
+
+	id := uuid.New()
+
+	defer func() {
+		err, ok := recover().(error)
+
+		if !ok || err == nil {
+			t.Error("expected MustFind to panic")
+
+			t.Fail()
+
+			return
+		}
+
+		ExpectedEqual(t, err.Error(), "model "+id.String()+" not found")
+	}()
+
+	c.MustFind(id)
+}
+
+func TestCollection_All(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	err := boltDB(cs).Update(func(tx *bolt.Tx) error {
+		c := tx.Cursor()
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			if err := tx.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, len(c.All()), 0)
+
+	ms := make([]model.Interface, 3)
+
+	for k := range ms {
+		ms[k] = &TestCollectionStructB{FieldB: k}
+
+		err = c.Create(ms[k])
+
+		ExpectedNoError(t, err)
+	}
+
+	ExpectedEqual(t, c.All(), ms)
+
+	err = ms[1].Delete()
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, c.All(), []model.Interface{ms[0], ms[2]})
+	ExpectedEqual(t, c.All(model.WithDeleted), ms)
+	ExpectedEqual(t, c.All(model.OnlyDeleted), []model.Interface{ms[1]})
+}
+
+func TestCollection_Count(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	err := boltDB(cs).Update(func(tx *bolt.Tx) error {
+		c := tx.Cursor()
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			if err := tx.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, c.Count(), 0)
+
+	mA := &TestCollectionStructB{}
+	mB := &TestCollectionStructB{}
+
+	ExpectedNoError(t, c.Create(mA))
+	ExpectedNoError(t, c.Create(mB))
+
+	ExpectedEqual(t, c.Count(), 2)
+
+	ExpectedNoError(t, mB.Delete())
+
+	ExpectedEqual(t, c.Count(), 1)
+	ExpectedEqual(t, c.Count(model.WithDeleted), 2)
+	ExpectedEqual(t, c.Count(model.OnlyDeleted), 1)
+}
+
+func TestCollection_Each(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	err := boltDB(cs).Update(func(tx *bolt.Tx) error {
+		c := tx.Cursor()
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			if err := tx.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	ms := make([]model.Interface, 3)
+
+	for k := range ms {
+		ms[k] = &TestCollectionStructB{FieldB: k}
+
+		err = c.Create(ms[k])
+
+		ExpectedNoError(t, err)
+	}
+
+	ExpectedNoError(t, ms[2].Delete())
+
+	visited := make([]model.Interface, 0)
+
+	c.Each(func(i model.Interface) bool {
+		visited = append(visited, i)
+
+		// Saving from within the iterator should not deadlock
+		return i.Save() == nil
+	})
+
+	ExpectedEqual(t, visited, ms[:2])
+
+	visited = visited[:0]
+
+	c.Each(func(i model.Interface) bool {
+		visited = append(visited, i)
+
+		return false
+	}, model.WithDeleted)
+
+	ExpectedEqual(t, visited, ms[:1])
+}
+
+func TestCollections_ReadOnly(t *testing.T) {
+	defer os.Remove("testdata/readonly.db")
+
+	csA, err := Open(&Options{file: "testdata/readonly.db"})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, csA.ReadOnly(), false)
+
+	cA, err := csA.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	ExpectedNoError(t, cA.Create(mA))
+	ExpectedNoError(t, csA.Close())
+
+	opt, err := NewOptions(WithFile("testdata/readonly.db"), WithReadOnly(true))
+
+	ExpectedNoError(t, err)
+
+	csB, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		if err := boltDB(csB).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	ExpectedEqual(t, csB.ReadOnly(), true)
+
+	cB, err := csB.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, cB.Count(), 1)
+
+	mB := cB.MustFind(mA.Id()).(*TestCollectionStructB)
+
+	ExpectedEqual(t, mB.FieldA, "test-aaa")
+
+	updatedAt := mB.UpdatedAt()
+
+	err = mB.Save()
+
+	ExpectedError(t, err, "failed to save model: failed to save model: collections are read-only")
+	ExpectedEqualF(t, errors.Is(err, ErrReadOnly), true, false, "expected a read-only error")
+	ExpectedEqualF(t, mB.UpdatedAt().Equal(updatedAt), true, false, "timestamps should be restored")
+
+	mC := &TestCollectionStructB{}
+
+	err = cB.Create(mC)
+
+	ExpectedEqualF(t, errors.Is(err, ErrReadOnly), true, false, "expected a read-only error")
+	ExpectedEqual(t, mC.Exists(), false)
+
+	err = mB.Delete()
+
+	ExpectedEqualF(t, errors.Is(err, ErrReadOnly), true, false, "expected a read-only error")
+	ExpectedEqual(t, mB.Deleted(), false)
+
+	err = csB.Transaction(func(tx *Tx) error { return nil })
+
+	ExpectedError(t, err, "failed to commit transaction: collections are read-only")
+
+	_, err = cB.PurgeDeletedBefore(time.Now())
+
+	ExpectedError(t, err, "failed to purge models: collections are read-only")
+
+	ExpectedNoError(t, csB.Refresh())
+	ExpectedEqual(t, cB.Count(), 1)
+}
+
+func TestCollections_ReadOnly_snapshot(t *testing.T) {
+	defer os.Remove("testdata/live.db")
+	defer os.Remove("testdata/snapshot.db")
+
+	// The writer holds the database file for the whole session
+	csA, err := Open(&Options{file: "testdata/live.db"})
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, csA.Close())
+	}()
+
+	cA, err := csA.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	ExpectedNoError(t, cA.Create(mA))
+
+	opt, err := NewOptions(WithFile("testdata/live.db"), WithReadOnly(true), WithTimeout(50*time.Millisecond))
+
+	ExpectedNoError(t, err)
+
+	_, err = Open(opt)
+
+	ExpectedEqualF(t, errors.Is(err, ErrLocked), true, false, "expected a locked error")
+
+	// Snapshots of the writer are read instead
+	ExpectedNoError(t, csA.BackupToFile("testdata/snapshot.db"))
+
+	opt, err = NewOptions(WithFile("testdata/snapshot.db"), WithReadOnly(true))
+
+	ExpectedNoError(t, err)
+
+	csB, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, csB.Close())
+	}()
+
+	cB, err := csB.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, cB.Count(), 1)
+
+	mB := &TestCollectionStructB{FieldA: "test-bbb"}
+
+	ExpectedNoError(t, cA.Create(mB))
+
+	mA.FieldA = "test-ccc"
+
+	ExpectedNoError(t, mA.Save())
+
+	// Refreshing without a new snapshot reads the same snapshot
+	ExpectedNoError(t, csB.Refresh())
+	ExpectedEqual(t, cB.Count(), 1)
+
+	ExpectedNoError(t, csA.BackupToFile("testdata/snapshot.db"))
+	ExpectedNoError(t, csB.Refresh())
+	ExpectedEqual(t, cB.Count(), 2)
+	ExpectedEqual(t, cB.MustFind(mA.Id()).(*TestCollectionStructB).FieldA, "test-ccc")
+	ExpectedEqual(t, cB.MustFind(mB.Id()).(*TestCollectionStructB).FieldA, "test-bbb")
+	ExpectedEqual(t, csB.ReadOnly(), true)
+
+	// The snapshot is kept when the file can not be opened again
+	ExpectedNoError(t, os.Remove("testdata/snapshot.db"))
+
+	err = csB.Refresh()
+
+	ExpectedEqualF(t, err != nil, true, false, "expected a reopen error")
+	ExpectedEqual(t, cB.Count(), 2)
+}
+
+func TestCollections_Refresh(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	err := boltDB(cs).Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("TestCollectionStructA"))
+	})
+
+	if err != nil && err != bolt.ErrBucketNotFound {
+		t.Fatal(err)
+	}
+
+	c, err := cs.Register(&TestCollectionStructA{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionStructA{}
+	mB := &TestCollectionStructA{}
+
+	ExpectedNoError(t, c.Create(mA))
+	ExpectedNoError(t, c.Create(mB))
+
+	// Changed on disk only
+	err = boltDB(cs).Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("TestCollectionStructA")).Delete([]byte(mB.Id().String()))
+	})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, c.Count(), 2)
+
+	ExpectedNoError(t, cs.Refresh())
+
+	ExpectedEqual(t, c.Count(), 1)
+
+	_, err = c.Find(mB.Id())
+
+	ExpectedError(t, err, fmt.Sprintf("model %s not found", mB.Id()))
+
+	mC := c.MustFind(mA.Id())
+
+	ExpectedEqualF(t, mC != model.Interface(mA), true, false, "model should be loaded again")
+	ExpectedEqual(t, mC.Version(), mA.Version())
+}
+
+func TestCollections_InMemory(t *testing.T) {
+	t.Parallel()
+
+	opt, err := NewOptions(WithInMemory())
+
+	ExpectedNoError(t, err)
+
+	cs, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, cs.InMemory(), true)
+	ExpectedEqual(t, cs.ReadOnly(), false)
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, c.Count(), 0)
+
+	ci, err := cs.Get("TestCollectionStructB")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, ci, c)
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+
+	ExpectedNoError(t, c.Create(mA))
+	ExpectedEqual(t, mA.Version(), uint64(1))
+
+	mA.FieldB = 1
+
+	ExpectedNoError(t, mA.Save())
+	ExpectedEqual(t, c.MustFind(mA.Id()), model.Interface(mA))
+
+	ExpectedNoError(t, mA.Delete())
+	ExpectedEqual(t, c.Count(), 0)
+	ExpectedNoError(t, c.Purge(mA))
+	ExpectedEqual(t, c.Count(model.WithDeleted), 0)
+
+	// Transactions roll back the in-memory state
+	mB := &TestCollectionStructB{}
+
+	err = cs.Transaction(func(tx *Tx) error {
+		if err := tx.Create(c, mB); err != nil {
+			return err
+		}
+
+		return errors.New("error")
+	})
+
+	ExpectedError(t, err, "failed to commit transaction: error")
+	ExpectedEqual(t, mB.Exists(), false)
+	ExpectedEqual(t, c.Count(), 0)
+
+	// The model remains embedded in the collection
+	ExpectedNoError(t, mB.Save())
+	ExpectedNoError(t, cs.Refresh())
+	ExpectedNoError(t, c.Load())
+	ExpectedEqual(t, c.Count(), 1)
+
+	ExpectedNoError(t, cs.Close())
+
+	_, err = os.Stat("testdata/memory.db")
+
+	ExpectedEqualF(t, os.IsNotExist(err), true, false, "database file should not be created")
+}
+
+func TestCollections_codec(t *testing.T) {
+	t.Parallel()
+
+	store := storage.NewMemory()
+
+	// recordCodec returns the codec of the stored record of the model
+	recordCodec := func(i model.Interface) codec.Codec {
+		var cd codec.Codec
+
+		err := store.View(func(tx storage.Tx) error {
+			var err error
+
+			cd, err = codec.Of(tx.Bucket([]byte("TestCollectionStructB")).Get([]byte(i.Id().String())))
+
+			return err
+		})
+
+		ExpectedNoError(t, err)
+
+		return cd
+	}
+
+	optA, err := NewOptions(WithStorage(store))
+
+	ExpectedNoError(t, err)
+
+	csA, err := Open(optA)
+
+	ExpectedNoError(t, err)
+
+	cA, err := csA.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, cA.(*Collection).Codec(), codec.JSON)
+
+	mA := &TestCollectionStructB{FieldA: "test-aaa"}
+	mB := &TestCollectionStructB{FieldA: "test-bbb"}
+
+	ExpectedNoError(t, cA.Create(mA))
+	ExpectedNoError(t, cA.Create(mB))
+
+	ExpectedEqual(t, recordCodec(mA), codec.JSON)
+
+	// Changing the codec converts the records as they are saved
+	optB, err := NewOptions(WithStorage(store), WithCodec(codec.MessagePack))
+
+	ExpectedNoError(t, err)
+
+	csB, err := Open(optB)
+
+	ExpectedNoError(t, err)
+
+	cB, err := csB.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, cB.(*Collection).Codec(), codec.MessagePack)
+	ExpectedEqual(t, cB.Count(), 2)
+
+	mBA := cB.MustFind(mA.Id()).(*TestCollectionStructB)
+	mBA.FieldB = 1
+
+	ExpectedNoError(t, mBA.Save())
+
+	ExpectedEqual(t, recordCodec(mA), codec.MessagePack)
+	ExpectedEqual(t, recordCodec(mB), codec.JSON)
+
+	// The codec of a collection overrides the codec of the collections
+	csC, err := Open(optB)
+
+	ExpectedNoError(t, err)
+
+	cC, err := csC.Register(&TestCollectionStructB{}, WithCollectionCodec(codec.CBOR))
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, cC.(*Collection).Codec(), codec.CBOR)
+
+	mCA := cC.MustFind(mA.Id()).(*TestCollectionStructB)
+	mCB := cC.MustFind(mB.Id()).(*TestCollectionStructB)
+
+	ExpectedEqual(t, mCA.FieldA, "test-aaa")
+	ExpectedEqual(t, mCA.FieldB, 1)
+	ExpectedEqual(t, mCA.Version(), uint64(2))
+	ExpectedEqual(t, mCB.FieldA, "test-bbb")
+
+	ExpectedNoError(t, mCB.Save())
+
+	ExpectedEqual(t, recordCodec(mB), codec.CBOR)
+
+	ExpectedNoError(t, csC.Close())
+}
+
+func TestCollections_compression(t *testing.T) {
+	t.Parallel()
+
+	store := storage.NewMemory()
+
+	// record returns the stored record of the model
+	record := func(i model.Interface) []byte {
+		var v []byte
+
+		err := store.View(func(tx storage.Tx) error {
+			v = append(v, tx.Bucket([]byte("TestCollectionStructB")).Get([]byte(i.Id().String()))...)
+
+			return nil
+		})
+
+		ExpectedNoError(t, err)
+
+		return v
+	}
+
+	optA, err := NewOptions(WithStorage(store), WithCompression(compress.Gzip, 0))
+
+	ExpectedNoError(t, err)
+
+	csA, err := Open(optA)
+
+	ExpectedNoError(t, err)
+
+	_, err = csA.Register(&TestCollectionStructB{}, WithCollectionCompression(compress.Snappy, -1))
+
+	ExpectedError(t, err, "failed to register model: invalid compression threshold -1")
+
+	cA, err := csA.Register(&TestCollectionStructB{}, WithCollectionCompression(compress.Snappy, 0))
+
+	ExpectedNoError(t, err)
+
+	text := strings.Repeat("large text field ", 100)
+
+	mA := &TestCollectionStructB{FieldA: text}
+	mB := &TestCollectionStructB{FieldA: "small"}
+
+	ExpectedNoError(t, cA.Create(mA))
+	ExpectedNoError(t, cA.Create(mB))
+
+	vA := record(mA)
+	vB := record(mB)
+
+	ExpectedEqual(t, vA[0], compress.Snappy.ID())
+	ExpectedEqualF(t, len(vA) < len(text), true, false, "expected the record to be compressed")
+
+	// Small records are stored raw
+	ExpectedEqual(t, compress.Compressed(vB), false)
+
+	// Compressed records are read regardless of the compression of the collection
+	optB, err := NewOptions(WithStorage(store))
+
+	ExpectedNoError(t, err)
+
+	csB, err := Open(optB)
+
+	ExpectedNoError(t, err)
+
+	cB, err := csB.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	mBA := cB.MustFind(mA.Id()).(*TestCollectionStructB)
+
+	ExpectedEqual(t, mBA.FieldA, text)
+	ExpectedEqual(t, cB.MustFind(mB.Id()).(*TestCollectionStructB).FieldA, "small")
+
+	ExpectedNoError(t, mBA.Save())
+	ExpectedEqual(t, compress.Compressed(record(mA)), false)
+
+	// The compression of the collections is used, unless overridden by the collection
+	csC, err := Open(optA)
+
+	ExpectedNoError(t, err)
+
+	cC, err := csC.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	ExpectedNoError(t, cC.MustFind(mA.Id()).Save())
+	ExpectedEqual(t, record(mA)[0], compress.Gzip.ID())
+
+	ExpectedNoError(t, csC.Close())
+}
+
+func TestCollections_RotateKey(t *testing.T) {
+	store := storage.NewMemory()
+
+	// records returns the stored records of the collection
+	records := func() map[string][]byte {
+		vs := make(map[string][]byte)
+
+		err := store.View(func(tx storage.Tx) error {
+			return tx.Bucket([]byte("TestCollectionStructB")).ForEach(func(k, v []byte) error {
+				if v != nil {
+					vs[string(k)] = append([]byte{}, v...)
+				}
+
+				return nil
+			})
+		})
+
+		ExpectedNoError(t, err)
+
+		return vs
+	}
+
+	keyring := encrypt.NewKeyring()
+
+	ExpectedNoError(t, keyring.Add(1, encrypt.AESGCM, []byte("0123456789abcdef0123456789abcdef")))
+
+	// Unencrypted records are encrypted once rotated
+	csA, err := Open(&Options{storage: store})
+
+	ExpectedNoError(t, err)
+
+	cA, err := csA.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	ExpectedNoError(t, cA.Create(&TestCollectionStructB{FieldA: "plain"}))
+
+	err = csA.RotateKey(1)
+
+	ExpectedError(t, err, "failed to rotate key: encryption not enabled")
+
+	optB, err := NewOptions(WithStorage(store), WithEncryption(keyring), WithCompression(compress.Gzip, 1))
+
+	ExpectedNoError(t, err)
+
+	csB, err := Open(optB)
+
+	ExpectedNoError(t, err)
+
+	cB, err := csB.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, cB.Count(), 1)
+
+	for x := 0; x < 4; x++ {
+		ExpectedNoError(t, cB.Create(&TestCollectionStructB{FieldA: fmt.Sprintf("secret-%d", x), FieldB: x}))
+	}
+
+	for _, v := range records() {
+		ExpectedEqualF(t, bytes.Contains(v, []byte("secret")), false, false, "expected the record to be encrypted")
+	}
+
+	// Encrypted records can not be read without the keyring
+	csC, err := Open(&Options{storage: store})
+
+	ExpectedNoError(t, err)
+
+	_, err = csC.Register(&TestCollectionStructB{})
+
+	ExpectedError(t, err, "failed to register model: encrypted record, encryption not enabled")
+
+	ExpectedNoError(t, keyring.Add(2, encrypt.XChaCha20Poly1305, []byte("abcdef0123456789abcdef0123456789")))
+
+	ExpectedError(t, csB.RotateKey(3), "failed to rotate key: unknown key 3")
+
+	rotateBatchSize = 2
+
+	defer func() {
+		rotateBatchSize = 500
+	}()
+
+	ExpectedNoError(t, csB.RotateKey(2))
+
+	for k, v := range records() {
+		id, err := encrypt.KeyID(v)
+
+		ExpectedNoError(t, err)
+		ExpectedEqualF(t, id, uint32(2), false, fmt.Sprintf("expected record %s to be encrypted with key 2", k))
+	}
+
+	ExpectedNoError(t, keyring.Remove(1))
+
+	// The models are unchanged
+	csD, err := Open(optB)
+
+	ExpectedNoError(t, err)
+
+	cD, err := csD.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, cD.Count(), 5)
+
+	ms := cD.Where(func(i model.Interface) bool {
+		return i.(*TestCollectionStructB).FieldA == "secret-2"
+	})
+
+	ExpectedEqual(t, len(ms), 1)
+	ExpectedEqual(t, ms[0].(*TestCollectionStructB).FieldB, 2)
+	ExpectedEqual(t, ms[0].Version(), uint64(1))
+
+	ExpectedNoError(t, csD.Close())
+}
+
+type TestCollectionEncrypted struct {
+	model.Model
+
+	Name  string `borm:"index"`
+	Token string `borm:"encrypt,index,unique"`
+}
+
+func TestCollection_encryptedFields(t *testing.T) {
+	t.Parallel()
+
+	store := storage.NewMemory()
+
+	keyring := encrypt.NewKeyring()
+
+	ExpectedNoError(t, keyring.Add(1, encrypt.XChaCha20Poly1305, []byte("0123456789abcdef0123456789abcdef")))
+
+	// Encrypted fields require a key provider
+	csA, err := Open(&Options{storage: store})
+
+	ExpectedNoError(t, err)
+
+	cA, err := csA.Register(&TestCollectionEncrypted{})
+
+	ExpectedNoError(t, err)
+
+	err = cA.Create(&TestCollectionEncrypted{Token: "secret-token"})
+
+	ExpectedError(t, err, "failed to save model: failed to save model: failed to encrypt field Token: no key provider")
+
+	opt, err := NewOptions(WithStorage(store), WithKeyProvider(keyring))
+
+	ExpectedNoError(t, err)
+
+	csB, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	cB, err := csB.Register(&TestCollectionEncrypted{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionEncrypted{Name: "name", Token: "secret-token"}
+
+	ExpectedNoError(t, cB.Create(mA))
+
+	// Encrypted fields are not indexed, but remain unique
+	_, err = cB.FindBy("Token", "secret-token")
+
+	ExpectedError(t, err, "field TestCollectionEncrypted.Token is not indexed")
+
+	err = cB.Create(&TestCollectionEncrypted{Token: "secret-token"})
+
+	ExpectedError(t, err, "failed to save model: failed to save model: duplicate value for TestCollectionEncrypted.Token")
+
+	ms, err := cB.FindBy("Name", "name")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(ms), 1)
+
+	err = store.View(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte("TestCollectionEncrypted"))
+
+		v := b.Get([]byte(mA.Id().String()))
+
+		ExpectedEqualF(t, bytes.Contains(v, []byte("name")), true, false, "expected other fields to remain readable")
+		ExpectedEqualF(t, bytes.Contains(v, []byte("secret")), false, false, "expected the field to be encrypted")
+
+		ExpectedEqual(t, b.Bucket([]byte(indexBucket)).Bucket([]byte("Token")), nil)
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	csC, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	cC, err := csC.Register(&TestCollectionEncrypted{})
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, cC.MustFind(mA.Id()).(*TestCollectionEncrypted).Token, "secret-token")
+
+	ExpectedNoError(t, csC.Close())
+}
+
+// TestCollectionPlainToken is TestCollectionEncrypted before its Token was encrypted
+type TestCollectionPlainToken struct {
+	model.Model
+
+	Name  string
+	Token string
+}
+
+func TestCollection_encryptedFields_plain(t *testing.T) {
+	t.Parallel()
+
+	keyring := encrypt.NewKeyring()
+
+	ExpectedNoError(t, keyring.Add(1, encrypt.XChaCha20Poly1305, []byte("0123456789abcdef0123456789abcdef")))
+
+	for _, cd := range []codec.Codec{codec.JSON, codec.MessagePack, codec.CBOR} {
+		store := storage.NewMemory()
+
+		csA, err := Open(&Options{storage: store, codec: cd})
+
+		ExpectedNoError(t, err)
+
+		cA, err := csA.Register(&TestCollectionPlainToken{})
+
+		ExpectedNoError(t, err)
+
+		mA := &TestCollectionPlainToken{Name: "name", Token: "secret-token"}
+
+		ExpectedNoError(t, cA.Create(mA))
+
+		copyBucket(t, store, "TestCollectionPlainToken", "TestCollectionEncrypted")
+
+		// Values stored before the field was encrypted are read as plain values
+		opt, err := NewOptions(WithStorage(store), WithCodec(cd), WithKeyProvider(keyring))
+
+		ExpectedNoError(t, err)
+
+		csB, err := Open(opt)
+
+		ExpectedNoError(t, err)
+
+		cB, err := csB.Register(&TestCollectionEncrypted{})
+
+		ExpectedNoError(t, err)
+
+		mB := cB.MustFind(mA.Id()).(*TestCollectionEncrypted)
+
+		ExpectedEqual(t, mB.Token, "secret-token")
+		ExpectedEqual(t, mB.Name, "name")
+
+		// The value is encrypted once saved
+		ExpectedNoError(t, mB.Save())
+
+		err = store.View(func(tx storage.Tx) error {
+			v := tx.Bucket([]byte("TestCollectionEncrypted")).Get([]byte(mA.Id().String()))
+
+			ExpectedEqualF(t, bytes.Contains(v, []byte("secret-token")), false, false, "expected the field to be encrypted")
+
+			return nil
+		})
+
+		ExpectedNoError(t, err)
+
+		csC, err := Open(opt)
+
+		ExpectedNoError(t, err)
+
+		cC, err := csC.Register(&TestCollectionEncrypted{})
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, cC.MustFind(mA.Id()).(*TestCollectionEncrypted).Token, "secret-token")
+	}
+}
@@ -0,0 +1,58 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCompactUnsupported is returned when compacting collections which are not stored in a database file.
+var ErrCompactUnsupported = errors.New("compaction is not supported by the storage")
+
+// CompactStats reports the sizes in bytes of the database file before and after compaction.
+type CompactStats struct {
+	Before int64
+	After  int64
+}
+
+// compacter is implemented by storages which can compact their database file, see storage.Bolt.
+type compacter interface {
+	Compact(dst string, swap bool) (int64, int64, error)
+}
+
+// Compact copies the database into a new file at dst, which should not exist, leaving out the space of deleted models.
+// The database file never shrinks by itself, the new file holds the same models in as little space as possible.
+// When swap is set, the new file replaces the database file, while holding the write lock of the collections.
+// Models can be read meanwhile, changes wait until the new file is in use.
+// When neither the new file nor the database file can be opened after the swap, the error matches storage.ErrClosed
+// and the collections can no longer be used.
+func (cs *Collections) Compact(dst string, swap bool) (CompactStats, error) {
+	c, ok := cs.store.(compacter)
+
+	if !ok {
+		return CompactStats{}, ErrCompactUnsupported
+	}
+
+	if swap {
+		if cs.store.ReadOnly() {
+			return CompactStats{}, ErrReadOnly
+		}
+
+		cs.Lock()
+		defer cs.Unlock()
+	}
+
+	before, after, err := c.Compact(dst, swap)
+
+	if err != nil {
+		cs.log.WithError(err).WithField("dst", dst).Error("Failed to compact database")
+
+		return CompactStats{}, fmt.Errorf("failed to compact database: %w", err)
+	}
+
+	cs.log.WithField("before", before).WithField("after", after).WithField("swapped", swap).Debug("Compacted database")
+
+	return CompactStats{
+		Before: before,
+		After:  after,
+	}, nil
+}
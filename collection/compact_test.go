@@ -0,0 +1,146 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"peterdekok.nl/gotools/borm/storage"
+	. "peterdekok.nl/gotools/test"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCollections_Compact(t *testing.T) {
+	defer os.Remove("testdata/compact.db")
+	defer os.Remove("testdata/compact-copy.db")
+
+	cs, err := Open(&Options{file: "testdata/compact.db"})
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	ms := make([]*TestCollectionStructB, 0, 200)
+
+	for x := 0; x < 200; x++ {
+		m := &TestCollectionStructB{FieldA: strings.Repeat("a", 1024), FieldB: x}
+
+		ExpectedNoError(t, c.Create(m))
+
+		ms = append(ms, m)
+	}
+
+	for _, m := range ms[10:] {
+		ExpectedNoError(t, m.Delete())
+		ExpectedNoError(t, c.Purge(m))
+	}
+
+	stats, err := cs.Compact("testdata/compact-copy.db", false)
+
+	ExpectedNoError(t, err)
+	ExpectedEqualF(t, stats.After < stats.Before, true, false, fmt.Sprintf("expected the file to shrink: %+v", stats))
+
+	_, err = cs.Compact("testdata/compact-copy.db", false)
+
+	ExpectedError(t, err, "failed to compact database: file testdata/compact-copy.db already exists")
+
+	ExpectedNoError(t, os.Remove("testdata/compact-copy.db"))
+
+	// Models can be saved while the database is swapped
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for _, m := range ms[:10] {
+			m.FieldB++
+
+			ExpectedNoError(t, m.Save())
+		}
+	}()
+
+	stats, err = cs.Compact("testdata/compact-copy.db", true)
+
+	wg.Wait()
+
+	ExpectedNoError(t, err)
+	ExpectedEqualF(t, stats.After < stats.Before, true, false, fmt.Sprintf("expected the file to shrink: %+v", stats))
+
+	_, err = os.Stat("testdata/compact-copy.db")
+
+	ExpectedEqualF(t, os.IsNotExist(err), true, false, "expected the compacted file to be moved")
+
+	ExpectedNoError(t, c.Load())
+	ExpectedEqual(t, c.Count(), 10)
+
+	for x, m := range ms[:10] {
+		ExpectedEqual(t, c.MustFind(m.Id()).(*TestCollectionStructB).FieldB, x+1)
+	}
+
+	csB, err := Open(&Options{memory: true})
+
+	ExpectedNoError(t, err)
+
+	_, err = csB.Compact("testdata/compact-memory.db", false)
+
+	ExpectedEqual(t, err, ErrCompactUnsupported)
+}
+
+func TestCollections_Compact_failed(t *testing.T) {
+	defer os.Remove("testdata/compact-failed.db")
+	defer os.Remove("testdata/compact-failed-copy.db")
+
+	store, err := storage.OpenBolt("testdata/compact-failed.db", 0600, nil)
+
+	ExpectedNoError(t, err)
+
+	f := storage.NewFaulty(store)
+
+	cs, err := Open(&Options{storage: f})
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	c, err := cs.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	m := &TestCollectionStructB{FieldB: 1}
+
+	ExpectedNoError(t, c.Create(m))
+
+	f.Fail(storage.OpCompact, errors.New("failed"))
+
+	_, err = cs.Compact("testdata/compact-failed-copy.db", true)
+
+	ExpectedError(t, err, "failed to compact database: failed")
+
+	// The collections remain usable
+	f.Reset()
+
+	m.FieldB++
+
+	ExpectedNoError(t, m.Save())
+
+	_, err = cs.Compact("testdata/compact-failed-copy.db", true)
+
+	ExpectedNoError(t, err)
+
+	m.FieldB++
+
+	ExpectedNoError(t, m.Save())
+	ExpectedNoError(t, c.Load())
+	ExpectedEqual(t, c.MustFind(m.Id()).(*TestCollectionStructB).FieldB, 3)
+}
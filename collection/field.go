@@ -0,0 +1,338 @@
+package collection
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/uuid"
+	"math"
+	"peterdekok.nl/gotools/borm/model"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type field struct {
+	name  string
+	typ   reflect.Type
+	index []int
+	tags  map[string]string
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	uuidType = reflect.TypeOf(uuid.UUID{})
+
+	// Fields of the embedded model, which are not reachable as struct fields
+	modelFields = map[string]reflect.Type{
+		"Id":        uuidType,
+		"CreatedAt": timeType,
+		"UpdatedAt": timeType,
+		"DeletedAt": timeType,
+		"Version":   reflect.TypeOf(uint64(0)),
+	}
+)
+
+// field resolves an exported field of the model type by name.
+// The Id, timestamps and version of the embedded model are resolved as well.
+func (c *Collection) field(name string) (*field, error) {
+	if typ, ok := modelFields[name]; ok {
+		return &field{
+			name: name,
+			typ:  typ,
+		}, nil
+	}
+
+	sf, ok := c.mt.FieldByName(name)
+
+	if !ok || sf.PkgPath != "" || c.isModelField(sf) {
+		return nil, fmt.Errorf("unknown field %s.%s", c.name, name)
+	}
+
+	return &field{
+		name:  name,
+		typ:   sf.Type,
+		index: sf.Index,
+		tags:  parseTag(sf.Tag.Get("borm")),
+	}, nil
+}
+
+// fields returns the exported fields of the model type, including those promoted from embedded structs.
+// The embedded model is left out.
+func (c *Collection) fields() []*field {
+	names := make([]string, 0)
+
+	var walk func(typ reflect.Type, root bool)
+
+	walk = func(typ reflect.Type, root bool) {
+		for x := 0; x < typ.NumField(); x++ {
+			sf := typ.Field(x)
+
+			if root && c.isModelField(sf) {
+				continue
+			}
+
+			if sf.Anonymous {
+				ft := sf.Type
+
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+
+				if ft.Kind() == reflect.Struct {
+					walk(ft, false)
+
+					continue
+				}
+			}
+
+			if sf.PkgPath == "" {
+				names = append(names, sf.Name)
+			}
+		}
+	}
+
+	walk(c.mt, true)
+
+	fs := make([]*field, 0, len(names))
+
+	for _, name := range names {
+		// Shadowed and ambiguous fields do not resolve
+		if f, err := c.field(name); err == nil && f.index != nil {
+			fs = append(fs, f)
+		}
+	}
+
+	return fs
+}
+
+// parseTag parses a borm struct tag, e.g. `borm:"index=ordered,unique"`, into its options.
+// The value of a regex option holds the remainder of the tag, as an expression may contain commas.
+func parseTag(tag string) map[string]string {
+	opts := make(map[string]string)
+
+	split := strings.Split(tag, ",")
+
+	for x, opt := range split {
+		if strings.HasPrefix(strings.TrimSpace(opt), "regex=") {
+			opts["regex"] = strings.TrimPrefix(strings.TrimSpace(strings.Join(split[x:], ",")), "regex=")
+
+			break
+		}
+
+		opt = strings.TrimSpace(opt)
+
+		if opt == "" {
+			continue
+		}
+
+		kv := strings.SplitN(opt, "=", 2)
+
+		if len(kv) == 2 {
+			opts[kv[0]] = kv[1]
+		} else {
+			opts[kv[0]] = ""
+		}
+	}
+
+	return opts
+}
+
+func (c *Collection) isModelField(sf reflect.StructField) bool {
+	mf, ok := c.mt.FieldByName(reflect.TypeOf(model.Model{}).Name())
+
+	return ok && sf.Index[0] == mf.Index[0]
+}
+
+// get returns the value of the field for the given model.
+// A nil embedded pointer on the path results in the zero value of the field.
+func (f *field) get(i model.Interface) reflect.Value {
+	switch f.name {
+	case "Id":
+		return reflect.ValueOf(i.Id())
+	case "CreatedAt":
+		return reflect.ValueOf(i.CreatedAt())
+	case "UpdatedAt":
+		return reflect.ValueOf(i.UpdatedAt())
+	case "DeletedAt":
+		return reflect.ValueOf(i.DeletedAt())
+	case "Version":
+		return reflect.ValueOf(i.Version())
+	}
+
+	v := reflect.ValueOf(i)
+
+	for _, x := range f.index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Zero(f.typ)
+			}
+
+			v = v.Elem()
+		}
+
+		v = v.Field(x)
+	}
+
+	return v
+}
+
+// value converts a value to the type of the field.
+// Numeric values are converted between numeric kinds when the value is kept exactly,
+// other values should be assignable or of the same kind, like a string for a named string type.
+func (f *field) value(v interface{}) (reflect.Value, error) {
+	return convert(v, f.typ, f.name)
+}
+
+func convert(v interface{}, typ reflect.Type, name string) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+
+	if !rv.IsValid() {
+		switch typ.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			return reflect.Zero(typ), nil
+		}
+	} else if rv.Type().AssignableTo(typ) {
+		return rv, nil
+	} else if isNumeric(rv.Kind()) && isNumeric(typ.Kind()) {
+		if cv := rv.Convert(typ); exact(rv, cv) {
+			return cv, nil
+		}
+	} else if rv.Kind() == typ.Kind() && rv.Type().ConvertibleTo(typ) {
+		return rv.Convert(typ), nil
+	}
+
+	return reflect.Value{}, fmt.Errorf("invalid value %v for field %s (%s)", v, name, typ)
+}
+
+// exact reports whether the numeric conversion cv of rv kept its value, it fails for fractions converted
+// to integers, values out of range of the type and negative values converted to unsigned integers.
+// Floats converted to a smaller float type are rounded, only overflowing the type fails.
+func exact(rv, cv reflect.Value) bool {
+	if isFloat(rv.Kind()) && isFloat(cv.Kind()) {
+		return math.IsInf(cv.Float(), 0) == math.IsInf(rv.Float(), 0)
+	}
+
+	if isFloat(rv.Kind()) && (math.IsNaN(rv.Float()) || math.IsInf(rv.Float(), 0)) {
+		return false
+	}
+
+	if negative(rv) != negative(cv) {
+		return false
+	}
+
+	back := cv.Convert(rv.Type())
+
+	switch {
+	case isFloat(rv.Kind()):
+		return back.Float() == rv.Float()
+	case negative(rv):
+		return back.Int() == rv.Int()
+	}
+
+	return unsigned(back) == unsigned(rv)
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+func negative(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() < 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() < 0
+	}
+
+	return false
+}
+
+// unsigned returns the value of a non-negative integer.
+func unsigned(rv reflect.Value) uint64 {
+	switch rv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint()
+	}
+
+	return uint64(rv.Int())
+}
+
+func isNumeric(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+
+	return false
+}
+
+func isOrdered(typ reflect.Type) bool {
+	if typ == timeType || typ == uuidType {
+		return true
+	}
+
+	switch typ.Kind() {
+	case reflect.String, reflect.Bool:
+		return true
+	}
+
+	return isNumeric(typ.Kind())
+}
+
+// compare returns -1, 0 or 1 when a is respectively less than, equal to or greater than b.
+// Both values should be of the same, ordered, type.
+func compare(a, b reflect.Value) int {
+	switch a.Type() {
+	case timeType:
+		ta, tb := a.Interface().(time.Time), b.Interface().(time.Time)
+
+		if ta.Before(tb) {
+			return -1
+		} else if ta.After(tb) {
+			return 1
+		}
+
+		return 0
+	case uuidType:
+		ua, ub := a.Interface().(uuid.UUID), b.Interface().(uuid.UUID)
+
+		return bytes.Compare(ua[:], ub[:])
+	}
+
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareOrdered(a.Int() < b.Int(), a.Int() > b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return compareOrdered(a.Uint() < b.Uint(), a.Uint() > b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return compareOrdered(a.Float() < b.Float(), a.Float() > b.Float())
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Bool:
+		return compareOrdered(!a.Bool() && b.Bool(), a.Bool() && !b.Bool())
+	}
+
+	panic(fmt.Sprintf("type %s is not ordered", a.Type()))
+}
+
+func compareOrdered(less, greater bool) int {
+	if less {
+		return -1
+	} else if greater {
+		return 1
+	}
+
+	return 0
+}
+
+// equal reports whether both values are equal.
+// Ordered values are compared by order, so equal times in other locations are equal.
+func equal(a, b reflect.Value) bool {
+	if isOrdered(a.Type()) {
+		return compare(a, b) == 0
+	}
+
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
@@ -0,0 +1,206 @@
+package collection
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"math"
+	"peterdekok.nl/gotools/borm/model"
+	. "peterdekok.nl/gotools/test"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type TestCollectionFieldsEmbedded struct {
+	FieldE string
+}
+
+type TestCollectionFields struct {
+	model.Model
+	*TestCollectionFieldsEmbedded
+	FieldA string
+	FieldB int
+	FieldC []string
+	FieldD map[string]int
+	FieldT time.Time
+	fieldU string
+}
+
+func TestCollection_field(t *testing.T) {
+	c := &Collection{
+		name: "TestCollectionFields",
+		mt:   reflect.TypeOf(TestCollectionFields{}),
+	}
+
+	for _, name := range []string{"Id", "CreatedAt", "UpdatedAt", "DeletedAt", "FieldA", "FieldB", "FieldE"} {
+		f, err := c.field(name)
+
+		ExpectedNoError(t, err)
+
+		ExpectedEqual(t, f.name, name)
+	}
+
+	for _, name := range []string{"FieldX", "fieldU", "Model", "Mutex", ""} {
+		_, err := c.field(name)
+
+		ExpectedError(t, err, "unknown field TestCollectionFields."+name)
+	}
+}
+
+func TestField_get(t *testing.T) {
+	c := &Collection{
+		name: "TestCollectionFields",
+		mt:   reflect.TypeOf(TestCollectionFields{}),
+	}
+
+	m := &TestCollectionFields{FieldA: "test-aaa", FieldB: 42}
+
+	_, err := model.Embed(m, &Collection{})
+
+	ExpectedNoError(t, err)
+
+	f, _ := c.field("FieldA")
+
+	ExpectedEqual(t, f.get(m).Interface(), "test-aaa")
+
+	f, _ = c.field("FieldB")
+
+	ExpectedEqual(t, f.get(m).Interface(), 42)
+
+	f, _ = c.field("Id")
+
+	ExpectedEqual(t, f.get(m).Interface(), m.Id())
+
+	f, _ = c.field("FieldE")
+
+	ExpectedEqual(t, f.get(m).Interface(), "")
+
+	m.TestCollectionFieldsEmbedded = &TestCollectionFieldsEmbedded{FieldE: "test-eee"}
+
+	ExpectedEqual(t, f.get(m).Interface(), "test-eee")
+}
+
+func TestField_value(t *testing.T) {
+	c := &Collection{
+		name: "TestCollectionFields",
+		mt:   reflect.TypeOf(TestCollectionFields{}),
+	}
+
+	f, _ := c.field("FieldB")
+
+	v, err := f.value(int64(42))
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, v.Interface(), 42)
+
+	_, err = f.value("42")
+
+	ExpectedError(t, err, "invalid value 42 for field FieldB (int)")
+
+	f, _ = c.field("FieldA")
+
+	_, err = f.value(42)
+
+	ExpectedError(t, err, "invalid value 42 for field FieldA (string)")
+
+	_, err = f.value(nil)
+
+	ExpectedError(t, err, "invalid value <nil> for field FieldA (string)")
+
+	f, _ = c.field("FieldC")
+
+	v, err = f.value(nil)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, v.Interface(), []string(nil))
+}
+
+type TestConvertStatus string
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		v   interface{}
+		typ interface{}
+		exp interface{}
+	}{
+		{42, int64(0), int64(42)},
+		{int64(-42), int8(0), int8(-42)},
+		{1.0, 0, 1},
+		{-2.0, 0, -2},
+		{42, uint(0), uint(42)},
+		{uint64(42), 0, 42},
+		{42, 0.0, 42.0},
+		{1.5, float32(0), float32(1.5)},
+		{0.1, float32(0), float32(0.1)},
+		{"active", TestConvertStatus(""), TestConvertStatus("active")},
+		{TestConvertStatus("active"), "", "active"},
+		// Conversions which do not keep the value
+		{1.5, 0, nil},
+		{-0.5, 0, nil},
+		{-1, uint(0), nil},
+		{-1.0, uint(0), nil},
+		{uint64(math.MaxUint64), int64(0), nil},
+		{300, int8(0), nil},
+		{-300, int8(0), nil},
+		{int64(1<<53 + 1), 0.0, nil},
+		{math.NaN(), 0, nil},
+		{math.Inf(1), int64(0), nil},
+		{math.MaxFloat64, float32(0), nil},
+		// Conversions between kinds
+		{42, "", nil},
+		{"42", 0, nil},
+		{true, 0, nil},
+	}
+
+	for _, test := range tests {
+		typ := reflect.TypeOf(test.typ)
+
+		v, err := convert(test.v, typ, "Field")
+
+		if test.exp == nil {
+			ExpectedError(t, err, fmt.Sprintf("invalid value %v for field Field (%s)", test.v, typ))
+
+			continue
+		}
+
+		ExpectedEqualF(t, err == nil, true, false, fmt.Sprintf("expected %v (%T) to convert to %s", test.v, test.v, typ))
+
+		if err == nil {
+			ExpectedEqual(t, v.Interface(), test.exp)
+		}
+	}
+
+	// Infinity is kept between floats
+	v, err := convert(math.Inf(-1), reflect.TypeOf(float32(0)), "Field")
+
+	ExpectedNoError(t, err)
+	ExpectedEqualF(t, math.IsInf(v.Float(), -1), true, false, "expected negative infinity")
+}
+
+func TestCompare(t *testing.T) {
+	now := time.Now()
+	idA, _ := uuid.Parse("aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa")
+	idB, _ := uuid.Parse("bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb")
+
+	pairs := [][2]interface{}{
+		{1, 2},
+		{uint8(1), uint8(2)},
+		{1.5, 2.5},
+		{"a", "b"},
+		{false, true},
+		{now, now.Add(time.Second)},
+		{idA, idB},
+	}
+
+	for _, p := range pairs {
+		a, b := reflect.ValueOf(p[0]), reflect.ValueOf(p[1])
+
+		ExpectedEqual(t, compare(a, b), -1)
+		ExpectedEqual(t, compare(b, a), 1)
+		ExpectedEqual(t, compare(a, a), 0)
+	}
+
+	ExpectedEqual(t, equal(reflect.ValueOf(now), reflect.ValueOf(now.UTC())), true)
+	ExpectedEqual(t, equal(reflect.ValueOf([]int{1}), reflect.ValueOf([]int{1})), true)
+	ExpectedEqual(t, equal(reflect.ValueOf([]int{1}), reflect.ValueOf([]int{2})), false)
+}
@@ -0,0 +1,422 @@
+package collection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"peterdekok.nl/gotools/borm/encrypt"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Sub bucket of a collection bucket holding the previous versions of its models, in a bucket per model.
+// Model keys are uuids, so it can not collide with a model.
+const historyBucket = "_history"
+
+// WithHistory keeps every previous version of the models of the collection, see Collection.History.
+// Versions are stored as their records, they are re-encrypted by RotateKey and migrated along with the records.
+// The history of a model is removed when the model is purged.
+func WithHistory() RegisterOption {
+	return func(c *Collection) {
+		c.history = true
+	}
+}
+
+// History returns every version of the model as stored, oldest first, the last one is the current version.
+// Versions are new instances, so they can be inspected without affecting the model.
+func (c *Collection) History(id uuid.UUID) ([]model.Interface, error) {
+	var versions []model.Interface
+
+	err := c.root.store.View(func(tx storage.Tx) error {
+		var err error
+
+		versions, err = c.storedVersions(tx, id)
+
+		return err
+	})
+
+	if err != nil {
+		c.log.WithError(err).Error("Failed to read history")
+
+		return nil, fmt.Errorf("failed to read history: %s", err)
+	}
+
+	return versions, nil
+}
+
+// AsOf returns the version of the model as stored at the given time, the version saved last before or at it.
+// Models which were soft deleted at the time are returned as well.
+func (c *Collection) AsOf(id uuid.UUID, at time.Time) (model.Interface, error) {
+	versions, err := c.History(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var found model.Interface
+
+	for _, v := range versions {
+		if v.UpdatedAt().After(at) {
+			break
+		}
+
+		found = v
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("model %s not found at %s", id, at.Format(time.RFC3339Nano))
+	}
+
+	return found, nil
+}
+
+// Revert saves the given previous version of the model as its newest version.
+// The exported fields of the model are replaced by those of the version while the model is locked,
+// its timestamps are kept and it is saved like by its Save method, the BeforeSave hook is called before
+// the fields are replaced. Reverting does not restore or delete the model.
+func (c *Collection) Revert(id uuid.UUID, version uint64) error {
+	if err := c.revert(id, version); err != nil {
+		c.log.WithError(err).Error("Failed to revert model")
+
+		return fmt.Errorf("failed to revert model: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Collection) revert(id uuid.UUID, version uint64) error {
+	i, err := c.Find(id, model.WithDeleted)
+
+	if err != nil {
+		return err
+	}
+
+	versions, err := c.History(id)
+
+	if err != nil {
+		return err
+	}
+
+	var v model.Interface
+
+	for _, h := range versions {
+		if h.Version() == version {
+			v = h
+		}
+	}
+
+	if v == nil {
+		return fmt.Errorf("unknown version %d of model %s", version, id)
+	}
+
+	iv := reflect.ValueOf(i).Elem()
+
+	// The fields are replaced while the model is locked, within the transaction persisting it
+	err = c.Transact(func(tc model.CollectionInterface) error {
+		return model.SaveWith(i, func(i model.Interface) error {
+			backup := reflect.New(c.mt).Elem()
+
+			c.copyFields(backup, iv)
+			c.copyFields(iv, reflect.ValueOf(v).Elem())
+
+			if err := tc.Save(i); err != nil {
+				c.copyFields(iv, backup)
+
+				return err
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if h, ok := i.(model.AfterSaver); ok {
+		h.AfterSave()
+	}
+
+	return nil
+}
+
+// copyFields copies the exported fields of the model type from src to dst, except for the embedded model.
+func (c *Collection) copyFields(dst, src reflect.Value) {
+	for x := 0; x < c.mt.NumField(); x++ {
+		if sf := c.mt.Field(x); sf.PkgPath != "" || c.isModelField(sf) {
+			continue
+		}
+
+		dst.Field(x).Set(src.Field(x))
+	}
+}
+
+// storedVersions returns the previous versions and the current version of a model as stored.
+func (c *Collection) storedVersions(tx storage.Tx, id uuid.UUID) ([]model.Interface, error) {
+	if !c.history {
+		return nil, errors.New("history not enabled")
+	}
+
+	b := tx.Bucket([]byte(c.name))
+
+	if b == nil {
+		return nil, fmt.Errorf("model %s not found", id)
+	}
+
+	k := []byte(id.String())
+	versions := make([]model.Interface, 0)
+
+	if h := b.Bucket([]byte(historyBucket)); h != nil {
+		if hb := h.Bucket(k); hb != nil {
+			err := hb.ForEach(func(_, v []byte) error {
+				i, err := c.unseal(k, v)
+
+				if err != nil {
+					return err
+				}
+
+				versions = append(versions, i)
+
+				return nil
+			})
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Sorted by time, as versions archived with the former keys of nanoseconds since 1970 do not sort by key
+	sort.SliceStable(versions, func(x, y int) bool {
+		if ux, uy := versions[x].UpdatedAt(), versions[y].UpdatedAt(); !ux.Equal(uy) {
+			return ux.Before(uy)
+		}
+
+		return versions[x].Version() < versions[y].Version()
+	})
+
+	current, err := c.stored(tx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if current == nil {
+		return nil, fmt.Errorf("model %s not found", id)
+	}
+
+	return append(versions, current), nil
+}
+
+// archive moves the stored version of a model to its history, before it is overwritten.
+// Versions are keyed by their UpdatedAt, encoded like ordered index keys, and version, so they are ordered by time.
+func (c *Collection) archive(tx storage.Tx, id uuid.UUID) error {
+	b := tx.Bucket([]byte(c.name))
+
+	if b == nil {
+		return nil
+	}
+
+	k := []byte(id.String())
+	v := b.Get(k)
+
+	if v == nil {
+		return nil
+	}
+
+	i, err := c.unseal(k, v)
+
+	if err != nil {
+		return err
+	}
+
+	h, err := b.CreateBucketIfNotExists([]byte(historyBucket))
+
+	if err != nil {
+		return err
+	}
+
+	hb, err := h.CreateBucketIfNotExists(k)
+
+	if err != nil {
+		return err
+	}
+
+	hk := make([]byte, 20)
+
+	copy(hk, encodeTimeKey(i.UpdatedAt()))
+	binary.BigEndian.PutUint64(hk[12:], i.Version())
+
+	return hb.Put(hk, append([]byte(nil), v...))
+}
+
+// deleteHistory removes the previous versions of a purged model.
+func (c *Collection) deleteHistory(b storage.Bucket, id uuid.UUID) error {
+	h := b.Bucket([]byte(historyBucket))
+
+	if h == nil {
+		return nil
+	}
+
+	if err := h.DeleteBucket([]byte(id.String())); err != nil && err != storage.ErrBucketNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// rotateHistory re-encrypts the previous versions of the models which are not encrypted with the key,
+// returning their number. Versions are re-encrypted in batches like the records.
+func (c *Collection) rotateHistory(id uint32) (int, error) {
+	type version struct {
+		id, k, v []byte
+	}
+
+	var afterID, afterKey []byte
+
+	total := 0
+
+	for done := false; !done; {
+		err := c.root.store.Update(func(tx storage.Tx) error {
+			var h storage.Bucket
+
+			if b := tx.Bucket([]byte(c.name)); b != nil {
+				h = b.Bucket([]byte(historyBucket))
+			}
+
+			if h == nil {
+				done = true
+
+				return nil
+			}
+
+			// Position of the previous batch, as the position is advanced while iterating
+			fromID, fromKey := append([]byte{}, afterID...), append([]byte{}, afterKey...)
+
+			var versions []version
+
+			err := h.ForEach(func(mk, _ []byte) error {
+				hb := h.Bucket(mk)
+
+				if hb == nil || bytes.Compare(mk, fromID) < 0 {
+					return nil
+				}
+
+				return hb.ForEach(func(k, v []byte) error {
+					if bytes.Equal(mk, fromID) && bytes.Compare(k, fromKey) <= 0 {
+						return nil
+					}
+
+					if len(versions) == rotateBatchSize {
+						return errBatchFull
+					}
+
+					if kid, err := encrypt.KeyID(v); err != nil || kid != id {
+						versions = append(versions, version{
+							id: append([]byte{}, mk...),
+							k:  append([]byte{}, k...),
+							v:  append([]byte{}, v...),
+						})
+					}
+
+					afterID = append(afterID[:0], mk...)
+					afterKey = append(afterKey[:0], k...)
+
+					return nil
+				})
+			})
+
+			if err != nil && err != errBatchFull {
+				return err
+			}
+
+			done = err == nil
+
+			for _, v := range versions {
+				rv, err := c.reseal(v.id, v.v)
+
+				if err != nil {
+					return fmt.Errorf("failed to re-encrypt version of record %s: %s", v.id, err)
+				}
+
+				if err := h.Bucket(v.id).Put(v.k, rv); err != nil {
+					return err
+				}
+			}
+
+			total += len(versions)
+
+			return nil
+		})
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// migrateHistory runs the migrations on the previous versions of the models of the collection bucket.
+// The migrated versions are only stored when write is set.
+func (c *Collection) migrateHistory(b storage.Bucket, ms []Migration, write bool) error {
+	h := b.Bucket([]byte(historyBucket))
+
+	if h == nil {
+		return nil
+	}
+
+	var ids [][]byte
+
+	err := h.ForEach(func(mk, v []byte) error {
+		if v == nil {
+			ids = append(ids, append([]byte{}, mk...))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, mk := range ids {
+		hb := h.Bucket(mk)
+
+		var keys, values [][]byte
+
+		err := hb.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			values = append(values, append([]byte{}, v...))
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for x, k := range keys {
+			v, err := c.migrateRecord(mk, values[x], ms)
+
+			if err != nil {
+				return fmt.Errorf("failed to migrate version of record %s: %s", mk, err)
+			}
+
+			if !write {
+				continue
+			}
+
+			if err := hb.Put(k, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
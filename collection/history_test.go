@@ -0,0 +1,449 @@
+package collection
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"peterdekok.nl/gotools/borm/encrypt"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+	"time"
+)
+
+type TestHistoryDocument struct {
+	model.Model
+	Title string `borm:"required"`
+}
+
+func TestCollection_History(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	opt, err := NewOptions(WithInMemory(), WithClock(func() time.Time { return now }))
+
+	ExpectedNoError(t, err)
+
+	cs, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	ci, err := cs.Register(&TestHistoryDocument{}, WithHistory())
+
+	ExpectedNoError(t, err)
+
+	c := ci.(*Collection)
+
+	d := &TestHistoryDocument{Title: "draft"}
+
+	ExpectedNoError(t, c.Create(d))
+
+	created := now
+
+	for _, title := range []string{"review", "final"} {
+		now = now.Add(time.Hour)
+		d.Title = title
+
+		ExpectedNoError(t, d.Save())
+	}
+
+	versions, err := c.History(d.Id())
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(versions), 3)
+
+	for x, title := range []string{"draft", "review", "final"} {
+		v := versions[x].(*TestHistoryDocument)
+
+		ExpectedEqual(t, v.Title, title)
+		ExpectedEqual(t, v.Version(), uint64(x+1))
+		ExpectedEqualF(t, v.UpdatedAt().Equal(created.Add(time.Duration(x)*time.Hour)), true, false, "expected the time of the version")
+		ExpectedEqualF(t, v != d, true, false, "expected a copy of the model")
+	}
+
+	// Reading the model as stored at a time
+	v, err := c.AsOf(d.Id(), created.Add(90*time.Minute))
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, v.(*TestHistoryDocument).Title, "review")
+
+	v, err = c.AsOf(d.Id(), created)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, v.(*TestHistoryDocument).Title, "draft")
+
+	v, err = c.AsOf(d.Id(), now.Add(time.Hour))
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, v.(*TestHistoryDocument).Title, "final")
+
+	_, err = c.AsOf(d.Id(), created.Add(-time.Second))
+
+	ExpectedError(t, err, "model "+d.Id().String()+" not found at 2020-01-02T03:04:04Z")
+
+	// Reverting saves a previous version as the newest
+	now = now.Add(time.Hour)
+
+	ExpectedNoError(t, c.Revert(d.Id(), 1))
+
+	ExpectedEqual(t, d.Title, "draft")
+	ExpectedEqual(t, d.Version(), uint64(4))
+	ExpectedEqualF(t, d.UpdatedAt().Equal(now), true, false, "expected the model to be saved")
+	ExpectedEqualF(t, d.CreatedAt().Equal(created), true, false, "expected the creation time to be kept")
+
+	versions, err = c.History(d.Id())
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(versions), 4)
+	ExpectedEqual(t, versions[3].(*TestHistoryDocument).Title, "draft")
+
+	err = c.Revert(d.Id(), 9)
+
+	ExpectedError(t, err, "failed to revert model: unknown version 9 of model "+d.Id().String())
+
+	// Failing saves leave the fields unchanged
+	d.Title = "changed"
+
+	model.SetVersion(d, 1)
+
+	err = c.Revert(d.Id(), 2)
+
+	ExpectedEqualF(t, errors.Is(err, ErrConflict), true, false, "expected a version conflict")
+	ExpectedEqual(t, d.Title, "changed")
+
+	model.SetVersion(d, 4)
+
+	// Purging removes the history
+	ExpectedNoError(t, d.Delete())
+	ExpectedNoError(t, c.Purge(d))
+
+	_, err = c.History(d.Id())
+
+	ExpectedError(t, err, "failed to read history: model "+d.Id().String()+" not found")
+
+	err = cs.store.View(func(tx storage.Tx) error {
+		ExpectedZeroValue(t, tx.Bucket([]byte("TestHistoryDocument")).Bucket([]byte(historyBucket)).Bucket([]byte(d.Id().String())))
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	// Collections without history
+	delete(cs.c, "TestHistoryDocument")
+
+	ci, err = cs.Register(&TestHistoryDocument{})
+
+	ExpectedNoError(t, err)
+
+	_, err = ci.(*Collection).History(d.Id())
+
+	ExpectedError(t, err, "failed to read history: history not enabled")
+}
+
+func TestCollection_History_times(t *testing.T) {
+	times := []time.Time{
+		time.Date(1901, 2, 3, 4, 5, 6, 0, time.UTC),
+		time.Date(1969, 12, 31, 23, 59, 59, 500000000, time.UTC),
+		time.Date(1970, 1, 1, 0, 0, 0, 500000000, time.UTC),
+		time.Date(2300, 1, 2, 3, 4, 5, 0, time.UTC),
+		time.Date(2301, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	now := times[0]
+
+	opt, err := NewOptions(WithInMemory(), WithClock(func() time.Time { return now }))
+
+	ExpectedNoError(t, err)
+
+	cs, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	ci, err := cs.Register(&TestHistoryDocument{}, WithHistory())
+
+	ExpectedNoError(t, err)
+
+	c := ci.(*Collection)
+
+	d := &TestHistoryDocument{Title: "v1"}
+
+	ExpectedNoError(t, c.Create(d))
+
+	for x := 1; x < 4; x++ {
+		now = times[x]
+		d.Title = fmt.Sprintf("v%d", x+1)
+
+		ExpectedNoError(t, d.Save())
+	}
+
+	expectVersions := func(n int) {
+		versions, err := c.History(d.Id())
+
+		ExpectedNoError(t, err)
+		ExpectedEqualF(t, len(versions), n, true, "expected every version")
+
+		for x, v := range versions {
+			ExpectedEqual(t, v.(*TestHistoryDocument).Title, fmt.Sprintf("v%d", x+1))
+			ExpectedEqualF(t, v.UpdatedAt().Equal(times[x]), true, false, "expected the time of the version")
+		}
+	}
+
+	// Times before 1970 and after 2262 are ordered
+	expectVersions(4)
+
+	v, err := c.AsOf(d.Id(), times[1].Add(time.Millisecond))
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, v.(*TestHistoryDocument).Title, "v2")
+
+	v, err = c.AsOf(d.Id(), times[3].Add(-time.Millisecond))
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, v.(*TestHistoryDocument).Title, "v3")
+
+	// Versions archived with the former keys of nanoseconds since 1970 are ordered along with the current keys
+	err = cs.store.Update(func(tx storage.Tx) error {
+		hb := tx.Bucket([]byte("TestHistoryDocument")).Bucket([]byte(historyBucket)).Bucket([]byte(d.Id().String()))
+
+		var keys, values [][]byte
+
+		err := hb.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			values = append(values, append([]byte{}, v...))
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for x, k := range keys {
+			if err := hb.Delete(k); err != nil {
+				return err
+			}
+
+			lk := make([]byte, 16)
+
+			binary.BigEndian.PutUint64(lk, uint64(times[x].UnixNano()))
+			binary.BigEndian.PutUint64(lk[8:], uint64(x+1))
+
+			if err := hb.Put(lk, values[x]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	now = times[4]
+	d.Title = "v5"
+
+	ExpectedNoError(t, d.Save())
+
+	expectVersions(5)
+}
+
+func TestCollection_History_rotateKey(t *testing.T) {
+	keyring := encrypt.NewKeyring()
+
+	ExpectedNoError(t, keyring.Add(1, encrypt.AESGCM, []byte("0123456789abcdef0123456789abcdef")))
+
+	opt, err := NewOptions(WithInMemory(), WithEncryption(keyring))
+
+	ExpectedNoError(t, err)
+
+	cs, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	rotateBatchSize = 2
+
+	defer func() {
+		rotateBatchSize = 500
+	}()
+
+	c, err := cs.Register(&TestHistoryDocument{}, WithHistory())
+
+	ExpectedNoError(t, err)
+
+	ds := []*TestHistoryDocument{{Title: "a"}, {Title: "b"}}
+
+	for _, d := range ds {
+		ExpectedNoError(t, c.Create(d))
+
+		for _, title := range []string{"review", "final"} {
+			d.Title = title
+
+			ExpectedNoError(t, d.Save())
+		}
+	}
+
+	ExpectedNoError(t, keyring.Add(2, encrypt.XChaCha20Poly1305, []byte("abcdef0123456789abcdef0123456789")))
+	ExpectedNoError(t, cs.RotateKey(2))
+	ExpectedNoError(t, keyring.Remove(1))
+
+	n := 0
+
+	err = cs.store.View(func(tx storage.Tx) error {
+		h := tx.Bucket([]byte("TestHistoryDocument")).Bucket([]byte(historyBucket))
+
+		return h.ForEach(func(k, _ []byte) error {
+			return h.Bucket(k).ForEach(func(_, v []byte) error {
+				id, err := encrypt.KeyID(v)
+
+				ExpectedNoError(t, err)
+				ExpectedEqual(t, id, uint32(2))
+
+				n++
+
+				return nil
+			})
+		})
+	})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, n, 4)
+
+	for _, d := range ds {
+		versions, err := c.(*Collection).History(d.Id())
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, len(versions), 3)
+	}
+}
+
+func TestCollection_History_migrate(t *testing.T) {
+	cs, err := Open(&Options{memory: true})
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	c, err := cs.Register(&TestMigrationUser{}, WithHistory())
+
+	ExpectedNoError(t, err)
+
+	m := &TestMigrationUser{Name: "john doe", Age: "41"}
+
+	ExpectedNoError(t, c.Create(m))
+
+	m.Age = "42"
+
+	ExpectedNoError(t, m.Save())
+
+	// The records and versions are stored as another model type, which should be migrated
+	copyBucket(t, cs.store, "TestMigrationUser", "TestMigrationPerson")
+
+	err = cs.store.Update(func(tx storage.Tx) error {
+		src := tx.Bucket([]byte("TestMigrationUser")).Bucket([]byte(historyBucket)).Bucket([]byte(m.Id().String()))
+
+		h, err := tx.Bucket([]byte("TestMigrationPerson")).CreateBucketIfNotExists([]byte(historyBucket))
+
+		if err != nil {
+			return err
+		}
+
+		dst, err := h.CreateBucket([]byte(m.Id().String()))
+
+		if err != nil {
+			return err
+		}
+
+		return src.ForEach(func(k, v []byte) error {
+			return dst.Put(k, v)
+		})
+	})
+
+	ExpectedNoError(t, err)
+
+	cp, err := cs.Register(&TestMigrationPerson{}, WithHistory(), WithMigrations(migrationsPerson...))
+
+	ExpectedNoError(t, err)
+
+	versions, err := cp.(*Collection).History(m.Id())
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(versions), 2)
+
+	for x, age := range []int{41, 42} {
+		ExpectedEqual(t, versions[x].(*TestMigrationPerson).FullName, "JOHN DOE")
+		ExpectedEqual(t, versions[x].(*TestMigrationPerson).Age, age)
+	}
+}
+
+func TestCollection_Revert_concurrent(t *testing.T) {
+	cs, err := Open(&Options{memory: true})
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	ci, err := cs.Register(&TestHistoryDocument{}, WithHistory())
+
+	ExpectedNoError(t, err)
+
+	c := ci.(*Collection)
+
+	d := &TestHistoryDocument{Title: "draft"}
+
+	ExpectedNoError(t, c.Create(d))
+
+	// Reverting replaces the fields while the model is locked, so saving it at the same time does not race
+	done := make(chan error, 2)
+
+	go func() {
+		for x := 0; x < 20; x++ {
+			if err := c.Revert(d.Id(), 1); err != nil {
+				done <- err
+
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	go func() {
+		for x := 0; x < 20; x++ {
+			if err := d.Save(); err != nil {
+				done <- err
+
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	for x := 0; x < 2; x++ {
+		select {
+		case err := <-done:
+			ExpectedNoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Deadlocked reverting the model")
+		}
+	}
+
+	ExpectedEqual(t, d.Title, "draft")
+	ExpectedEqual(t, d.Version(), uint64(41))
+}
@@ -0,0 +1,557 @@
+package collection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/uuid"
+	"math"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Sub bucket of a collection bucket holding the persisted indexes.
+// Model keys are uuids, so it can not collide with a model.
+// Indexes are not persisted when the records are encrypted, see Collection.indexesPersisted.
+const indexBucket = "_indexes"
+
+// index is a secondary index on a field of the collection, declared by a `borm:"index"` tag.
+// The values are encoded in an order preserving way, which is used for the hash lookup,
+// the ordered entries and the persisted index alike.
+type index struct {
+	f       *field
+	ordered bool
+
+	keys map[uuid.UUID][]byte
+	hash map[string]map[uuid.UUID]struct{}
+
+	// Sorted entries of the encoded value followed by the id, only kept by ordered indexes
+	entries [][]byte
+}
+
+func newIndex(f *field, ordered bool) *index {
+	x := &index{
+		f:       f,
+		ordered: ordered,
+	}
+
+	x.reset()
+
+	return x
+}
+
+// initIndexes creates the indexes declared on the fields of the model type.
+// Tag `borm:"index"` creates a hash index, `borm:"index=ordered"` an index which supports range lookups as well.
+// Fields tagged `borm:"encrypt"` are not indexed.
+func (c *Collection) initIndexes() error {
+	c.indexes = make(map[string]*index)
+
+	for _, f := range c.fields() {
+		kind, ok := f.tags["index"]
+
+		if !ok {
+			continue
+		}
+
+		// Indexes are persisted, which would reveal the values of encrypted fields
+		if _, ok := f.tags["encrypt"]; ok {
+			c.log.WithField("field", f.name).Warn("Encrypted field is not indexed")
+
+			continue
+		}
+
+		if kind != "" && kind != "hash" && kind != "ordered" {
+			return fmt.Errorf("invalid index type %s on field %s.%s", kind, c.name, f.name)
+		}
+
+		if !isOrdered(f.typ) {
+			return fmt.Errorf("field %s.%s (%s) can not be indexed", c.name, f.name, f.typ)
+		}
+
+		c.indexes[f.name] = newIndex(f, kind == "ordered")
+	}
+
+	return nil
+}
+
+// FindBy returns the models with the given value for an indexed field, ordered by creation.
+// Soft deleted models are left out, unless requested by scope.
+func (c *Collection) FindBy(field string, v interface{}, scope ...model.Scope) ([]model.Interface, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	x, ok := c.indexes[field]
+
+	if !ok {
+		return nil, fmt.Errorf("field %s.%s is not indexed", c.name, field)
+	}
+
+	rv, err := x.f.value(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := x.hash[string(encodeIndexKey(rv))]
+
+	s := model.ScopeOf(scope)
+	is := make([]model.Interface, 0, len(ids))
+
+	for id := range ids {
+		if i, ok := c.m[id]; ok && s.Includes(i) {
+			is = append(is, i)
+		}
+	}
+
+	sortByCreation(is)
+
+	return is, nil
+}
+
+// FindRange returns the models of which an indexed field is within [from, to), ordered by that field.
+// A nil bound leaves that side of the range open. The field should have an ordered index.
+// Soft deleted models are left out, unless requested by scope.
+func (c *Collection) FindRange(field string, from, to interface{}, scope ...model.Scope) ([]model.Interface, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	x, ok := c.indexes[field]
+
+	if !ok || !x.ordered {
+		return nil, fmt.Errorf("field %s.%s has no ordered index", c.name, field)
+	}
+
+	lo, hi := 0, len(x.entries)
+
+	if from != nil {
+		rv, err := x.f.value(from)
+
+		if err != nil {
+			return nil, err
+		}
+
+		lo = x.search(encodeIndexKey(rv))
+	}
+
+	if to != nil {
+		rv, err := x.f.value(to)
+
+		if err != nil {
+			return nil, err
+		}
+
+		hi = x.search(encodeIndexKey(rv))
+	}
+
+	if hi < lo {
+		hi = lo
+	}
+
+	s := model.ScopeOf(scope)
+	is := make([]model.Interface, 0, hi-lo)
+
+	for _, e := range x.entries[lo:hi] {
+		id, _ := uuid.FromBytes(e[len(e)-len(uuid.UUID{}):])
+
+		if i, ok := c.m[id]; ok && s.Includes(i) {
+			is = append(is, i)
+		}
+	}
+
+	return is, nil
+}
+
+// indexesPersisted reports whether the indexes are persisted.
+// Index keys are the plain indexed values, so with WithEncryption the indexes are kept in memory only,
+// they are rebuilt from the decrypted models when the collection is loaded.
+func (c *Collection) indexesPersisted() bool {
+	return c.root.keyring == nil
+}
+
+// indexKeys encodes the indexed values of a model.
+func (c *Collection) indexKeys(i model.Interface) map[string][]byte {
+	keys := make(map[string][]byte, len(c.indexes))
+
+	for name, x := range c.indexes {
+		keys[name] = encodeIndexKey(x.f.get(i))
+	}
+
+	return keys
+}
+
+// putIndexes persists the changed index keys of a model.
+func (c *Collection) putIndexes(b storage.Bucket, id uuid.UUID, keys map[string][]byte) error {
+	if len(c.indexes) == 0 || !c.indexesPersisted() {
+		return nil
+	}
+
+	ib, err := b.CreateBucketIfNotExists([]byte(indexBucket))
+
+	if err != nil {
+		return err
+	}
+
+	for name, x := range c.indexes {
+		fb, err := ib.CreateBucketIfNotExists([]byte(name))
+
+		if err != nil {
+			return err
+		}
+
+		key := keys[name]
+
+		if old, ok := x.keys[id]; ok {
+			if bytes.Equal(old, key) {
+				continue
+			}
+
+			if err := fb.Delete(indexEntry(old, id)); err != nil {
+				return err
+			}
+		}
+
+		if err := fb.Put(indexEntry(key, id), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteIndexes removes the persisted index keys of a model.
+func (c *Collection) deleteIndexes(b storage.Bucket, id uuid.UUID) error {
+	ib := b.Bucket([]byte(indexBucket))
+
+	if ib == nil || !c.indexesPersisted() {
+		return nil
+	}
+
+	for name, x := range c.indexes {
+		fb := ib.Bucket([]byte(name))
+		old, ok := x.keys[id]
+
+		if fb == nil || !ok {
+			continue
+		}
+
+		if err := fb.Delete(indexEntry(old, id)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// index updates the in-memory indexes for a model.
+func (c *Collection) index(id uuid.UUID, keys map[string][]byte) {
+	for name, x := range c.indexes {
+		x.put(id, keys[name])
+	}
+}
+
+// unindex removes a model from the in-memory indexes.
+func (c *Collection) unindex(id uuid.UUID) {
+	for _, x := range c.indexes {
+		x.remove(id)
+	}
+}
+
+// loadIndexes reads the persisted indexes, the bucket may be nil.
+// Indexes which are missing or do not cover exactly the loaded models are rebuilt from the models,
+// the names of the rebuilt indexes are returned so they can be persisted.
+// Indexes which are not persisted are always rebuilt, persisted ones are returned to be removed.
+func (c *Collection) loadIndexes(b storage.Bucket) ([]string, error) {
+	var ib storage.Bucket
+
+	if b != nil {
+		ib = b.Bucket([]byte(indexBucket))
+	}
+
+	stale := make([]string, 0)
+
+	if !c.indexesPersisted() {
+		for name, x := range c.indexes {
+			x.reset()
+
+			for id, i := range c.m {
+				x.put(id, encodeIndexKey(x.f.get(i)))
+			}
+
+			if ib != nil {
+				stale = append(stale, name)
+			}
+		}
+
+		return stale, nil
+	}
+
+	for name, x := range c.indexes {
+		x.reset()
+
+		var fb storage.Bucket
+
+		if ib != nil {
+			fb = ib.Bucket([]byte(name))
+		}
+
+		if fb == nil && len(c.m) == 0 {
+			continue
+		}
+
+		if fb != nil {
+			err := fb.ForEach(func(e, _ []byte) error {
+				if len(e) < len(uuid.UUID{}) {
+					return fmt.Errorf("invalid index entry %x", e)
+				}
+
+				id, _ := uuid.FromBytes(e[len(e)-len(uuid.UUID{}):])
+
+				// Bolt memory is only valid during the transaction
+				x.put(id, append([]byte{}, e[:len(e)-len(uuid.UUID{})]...))
+
+				return nil
+			})
+
+			if err != nil {
+				return nil, err
+			}
+
+			if x.covers(c.m) {
+				continue
+			}
+
+			x.reset()
+		}
+
+		for id, i := range c.m {
+			x.put(id, encodeIndexKey(x.f.get(i)))
+		}
+
+		stale = append(stale, name)
+	}
+
+	return stale, nil
+}
+
+// persistIndexes rewrites the named indexes from their in-memory state.
+// Read-only collections keep the rebuilt indexes in memory only.
+// Indexes which are not persisted are removed, as they were persisted before the encryption was enabled.
+func (c *Collection) persistIndexes(names []string) error {
+	if c.root.store.ReadOnly() {
+		return nil
+	}
+
+	return c.root.store.Update(func(tx storage.Tx) error {
+		c.RLock()
+		defer c.RUnlock()
+
+		b, err := tx.CreateBucketIfNotExists([]byte(c.name))
+
+		if err != nil {
+			return err
+		}
+
+		if !c.indexesPersisted() {
+			if err := b.DeleteBucket([]byte(indexBucket)); err != nil && err != storage.ErrBucketNotFound {
+				return err
+			}
+
+			return nil
+		}
+
+		ib, err := b.CreateBucketIfNotExists([]byte(indexBucket))
+
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if ib.Bucket([]byte(name)) != nil {
+				if err := ib.DeleteBucket([]byte(name)); err != nil {
+					return err
+				}
+			}
+
+			fb, err := ib.CreateBucket([]byte(name))
+
+			if err != nil {
+				return err
+			}
+
+			for id, key := range c.indexes[name].keys {
+				if err := fb.Put(indexEntry(key, id), []byte{}); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func (x *index) reset() {
+	x.keys = make(map[uuid.UUID][]byte)
+	x.hash = make(map[string]map[uuid.UUID]struct{})
+	x.entries = nil
+}
+
+// covers reports whether the index holds exactly the given models.
+func (x *index) covers(m map[uuid.UUID]model.Interface) bool {
+	if len(x.keys) != len(m) {
+		return false
+	}
+
+	for id := range x.keys {
+		if _, ok := m[id]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (x *index) put(id uuid.UUID, key []byte) {
+	if old, ok := x.keys[id]; ok {
+		if bytes.Equal(old, key) {
+			return
+		}
+
+		x.remove(id)
+	}
+
+	x.keys[id] = key
+
+	ids, ok := x.hash[string(key)]
+
+	if !ok {
+		ids = make(map[uuid.UUID]struct{})
+		x.hash[string(key)] = ids
+	}
+
+	ids[id] = struct{}{}
+
+	if x.ordered {
+		e := indexEntry(key, id)
+		n := x.search(e)
+
+		x.entries = append(x.entries, nil)
+		copy(x.entries[n+1:], x.entries[n:])
+		x.entries[n] = e
+	}
+}
+
+func (x *index) remove(id uuid.UUID) {
+	key, ok := x.keys[id]
+
+	if !ok {
+		return
+	}
+
+	delete(x.keys, id)
+
+	if ids := x.hash[string(key)]; ids != nil {
+		delete(ids, id)
+
+		if len(ids) == 0 {
+			delete(x.hash, string(key))
+		}
+	}
+
+	if x.ordered {
+		e := indexEntry(key, id)
+		n := x.search(e)
+
+		if n < len(x.entries) && bytes.Equal(x.entries[n], e) {
+			x.entries = append(x.entries[:n], x.entries[n+1:]...)
+		}
+	}
+}
+
+// search returns the position of the first entry not less than e.
+func (x *index) search(e []byte) int {
+	return sort.Search(len(x.entries), func(n int) bool {
+		return bytes.Compare(x.entries[n], e) >= 0
+	})
+}
+
+func indexEntry(key []byte, id uuid.UUID) []byte {
+	e := make([]byte, 0, len(key)+len(id))
+	e = append(e, key...)
+
+	return append(e, id[:]...)
+}
+
+// encodeTimeKey encodes a time as its seconds with the sign flipped followed by its nanoseconds,
+// so the byte order of encoded times equals their order, including times before 1970.
+func encodeTimeKey(t time.Time) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, uint64(t.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+
+	return b
+}
+
+// encodeIndexKey encodes an ordered value, so the byte order of encoded values equals the order of the values.
+func encodeIndexKey(v reflect.Value) []byte {
+	switch v.Type() {
+	case timeType:
+		return encodeTimeKey(v.Interface().(time.Time))
+	case uuidType:
+		id := v.Interface().(uuid.UUID)
+
+		return append([]byte{}, id[:]...)
+	}
+
+	b := make([]byte, 8)
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		binary.BigEndian.PutUint64(b, uint64(v.Int())^(1<<63))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		binary.BigEndian.PutUint64(b, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+
+		if f == 0 {
+			// Normalize negative zero
+			f = 0
+		}
+
+		bits := math.Float64bits(f)
+
+		if bits&(1<<63) == 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+
+		binary.BigEndian.PutUint64(b, bits)
+	case reflect.Bool:
+		if v.Bool() {
+			return []byte{1}
+		}
+
+		return []byte{0}
+	case reflect.String:
+		// Escape zero bytes and terminate, so a value does not sort after its extensions once followed by an id
+		s := v.String()
+		b = make([]byte, 0, len(s)+2)
+
+		for x := 0; x < len(s); x++ {
+			if s[x] == 0 {
+				b = append(b, 0, 0xff)
+			} else {
+				b = append(b, s[x])
+			}
+		}
+
+		return append(b, 0, 1)
+	default:
+		panic(fmt.Sprintf("type %s can not be indexed", v.Type()))
+	}
+
+	return b
+}
@@ -0,0 +1,496 @@
+package collection
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"math"
+	"peterdekok.nl/gotools/borm/encrypt"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	. "peterdekok.nl/gotools/test"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type TestCollectionIndexed struct {
+	model.Model
+	Email string `borm:"index"`
+	Age   int    `borm:"index=ordered"`
+	Score uint   `borm:"index=ordered"`
+	Name  string
+}
+
+type TestCollectionIndexInvalidType struct {
+	model.Model
+	Tags []string `borm:"index"`
+}
+
+type TestCollectionIndexInvalidKind struct {
+	model.Model
+	Name string `borm:"index=tree"`
+}
+
+func TestCollection_initIndexes(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	_, err := cs.Register(&TestCollectionIndexInvalidType{})
+
+	ExpectedError(t, err, "failed to register model: field TestCollectionIndexInvalidType.Tags ([]string) can not be indexed")
+
+	_, err = cs.Register(&TestCollectionIndexInvalidKind{})
+
+	ExpectedError(t, err, "failed to register model: invalid index type tree on field TestCollectionIndexInvalidKind.Name")
+
+	c, err := cs.Register(&TestCollectionIndexed{})
+
+	ExpectedNoError(t, err)
+
+	cA := c.(*Collection)
+
+	ExpectedEqual(t, len(cA.indexes), 3)
+	ExpectedEqual(t, cA.indexes["Email"].ordered, false)
+	ExpectedEqual(t, cA.indexes["Age"].ordered, true)
+	ExpectedEqual(t, cA.indexes["Score"].ordered, true)
+}
+
+func TestCollection_FindBy(t *testing.T) {
+	cs, cis := testCollections(t, &TestCollectionIndexed{})
+
+	c := cis[0]
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	mA := &TestCollectionIndexed{Email: "a@example.com", Age: 42}
+	mB := &TestCollectionIndexed{Email: "b@example.com", Age: 42}
+	mC := &TestCollectionIndexed{Email: "a@example.com", Age: 18}
+
+	ExpectedNoError(t, c.Create(mA))
+	ExpectedNoError(t, c.Create(mB))
+	ExpectedNoError(t, c.Create(mC))
+
+	is, err := c.FindBy("Email", "a@example.com")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{mA, mC})
+
+	is, err = c.FindBy("Age", 42)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{mA, mB})
+
+	// Values of other numeric types are converted when they are kept exactly
+	is, err = c.FindBy("Age", 42.0)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{mA, mB})
+
+	is, err = c.FindBy("Age", int8(-42))
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 0)
+
+	_, err = c.FindBy("Age", 42.5)
+
+	ExpectedError(t, err, "invalid value 42.5 for field Age (int)")
+
+	_, err = c.FindBy("Score", -1)
+
+	ExpectedError(t, err, "invalid value -1 for field Score (uint)")
+
+	mC.Email = "c@example.com"
+
+	ExpectedNoError(t, mC.Save())
+
+	is, err = c.FindBy("Email", "a@example.com")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{mA})
+
+	is, err = c.FindBy("Email", "c@example.com")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{mC})
+
+	ExpectedNoError(t, mA.Delete())
+
+	is, err = c.FindBy("Email", "a@example.com")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 0)
+
+	is, err = c.FindBy("Email", "a@example.com", model.WithDeleted)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{mA})
+
+	ExpectedNoError(t, c.Purge(mA))
+
+	is, err = c.FindBy("Email", "a@example.com", model.WithDeleted)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 0)
+
+	_, err = c.FindBy("Name", "test")
+
+	ExpectedError(t, err, "field TestCollectionIndexed.Name is not indexed")
+
+	_, err = c.FindBy("Email", 42)
+
+	ExpectedError(t, err, "invalid value 42 for field Email (string)")
+}
+
+func TestCollection_FindRange(t *testing.T) {
+	cs, cis := testCollections(t, &TestCollectionIndexed{})
+
+	c := cis[0]
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	ms := make([]model.Interface, 0)
+
+	for _, age := range []int{42, -5, 18, 30, 18} {
+		m := &TestCollectionIndexed{Age: age}
+
+		ExpectedNoError(t, c.Create(m))
+
+		ms = append(ms, m)
+	}
+
+	is, err := c.FindRange("Age", 18, 42)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 3)
+
+	for _, i := range is {
+		age := i.(*TestCollectionIndexed).Age
+
+		ExpectedEqualF(t, age >= 18 && age < 42, true, false, "age should be in range")
+	}
+
+	ExpectedEqual(t, is[2], ms[3])
+
+	is, err = c.FindRange("Age", nil, 18)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[1:2])
+
+	is, err = c.FindRange("Age", 30, nil)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{ms[3], ms[0]})
+
+	is, err = c.FindRange("Age", 42, 18)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 0)
+
+	ExpectedNoError(t, ms[3].Delete())
+
+	is, err = c.FindRange("Age", 30, nil)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[:1])
+
+	_, err = c.FindRange("Email", nil, nil)
+
+	ExpectedError(t, err, "field TestCollectionIndexed.Email has no ordered index")
+
+	_, err = c.FindRange("Age", "a", nil)
+
+	ExpectedError(t, err, "invalid value a for field Age (int)")
+
+	// Values of other numeric types are converted when they are kept exactly
+	is, err = c.FindRange("Age", -5.0, int64(18))
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[1:2])
+
+	_, err = c.FindRange("Age", nil, 17.5)
+
+	ExpectedError(t, err, "invalid value 17.5 for field Age (int)")
+
+	// Negative bounds do not wrap around for unsigned fields
+	_, err = c.FindRange("Score", -1, nil)
+
+	ExpectedError(t, err, "invalid value -1 for field Score (uint)")
+
+	is, err = c.FindRange("Score", uint8(0), nil)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 4)
+}
+
+func TestCollection_loadIndexes(t *testing.T) {
+	cs, cis := testCollections(t, &TestCollectionIndexed{})
+
+	c := cis[0]
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	mA := &TestCollectionIndexed{Email: "a@example.com", Age: 42}
+	mB := &TestCollectionIndexed{Email: "b@example.com", Age: 18}
+
+	ExpectedNoError(t, c.Create(mA))
+	ExpectedNoError(t, c.Create(mB))
+
+	countEntries := func(name string) int {
+		n := 0
+
+		err := cs.store.View(func(tx storage.Tx) error {
+			return tx.Bucket([]byte("TestCollectionIndexed")).Bucket([]byte(indexBucket)).Bucket([]byte(name)).ForEach(func(_, _ []byte) error {
+				n++
+
+				return nil
+			})
+		})
+
+		ExpectedNoError(t, err)
+
+		return n
+	}
+
+	ExpectedEqual(t, countEntries("Email"), 2)
+	ExpectedEqual(t, countEntries("Age"), 2)
+
+	mB.Email = "c@example.com"
+
+	ExpectedNoError(t, mB.Save())
+
+	ExpectedEqual(t, countEntries("Email"), 2)
+
+	// Persisted indexes are used as is on register
+	delete(cs.c, "TestCollectionIndexed")
+
+	c, err := cs.Register(&TestCollectionIndexed{})
+
+	ExpectedNoError(t, err)
+
+	is, err := c.FindBy("Email", "c@example.com")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 1)
+	ExpectedEqual(t, is[0].Id(), mB.Id())
+
+	is, err = c.FindRange("Age", nil, nil)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 2)
+	ExpectedEqual(t, is[0].Id(), mB.Id())
+
+	// Missing indexes are rebuilt and persisted
+	err = cs.store.Update(func(tx storage.Tx) error {
+		return tx.Bucket([]byte("TestCollectionIndexed")).DeleteBucket([]byte(indexBucket))
+	})
+
+	ExpectedNoError(t, err)
+
+	delete(cs.c, "TestCollectionIndexed")
+
+	c, err = cs.Register(&TestCollectionIndexed{})
+
+	ExpectedNoError(t, err)
+
+	is, err = c.FindBy("Email", "a@example.com")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 1)
+	ExpectedEqual(t, is[0].Id(), mA.Id())
+
+	ExpectedEqual(t, countEntries("Email"), 2)
+	ExpectedEqual(t, countEntries("Age"), 2)
+
+	// Incomplete indexes are rebuilt as well
+	err = cs.store.Update(func(tx storage.Tx) error {
+		fb := tx.Bucket([]byte("TestCollectionIndexed")).Bucket([]byte(indexBucket)).Bucket([]byte("Age"))
+
+		var first []byte
+
+		err := fb.ForEach(func(k, _ []byte) error {
+			if first == nil {
+				first = append([]byte{}, k...)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return fb.Delete(first)
+	})
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, countEntries("Age"), 1)
+
+	ExpectedNoError(t, c.Load())
+
+	ExpectedEqual(t, countEntries("Age"), 2)
+
+	is, err = c.FindRange("Age", nil, nil)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 2)
+}
+
+func TestCollection_loadIndexes_encrypted(t *testing.T) {
+	store := storage.NewMemory()
+
+	// scan reports whether any key or value of the bucket or its sub buckets contains s
+	var scan func(b storage.Bucket, s []byte) bool
+
+	scan = func(b storage.Bucket, s []byte) bool {
+		found := false
+
+		_ = b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				found = found || scan(b.Bucket(k), s)
+			}
+
+			found = found || bytes.Contains(k, s) || bytes.Contains(v, s)
+
+			return nil
+		})
+
+		return found
+	}
+
+	contains := func(s string) bool {
+		found := false
+
+		err := store.View(func(tx storage.Tx) error {
+			for _, name := range []string{"TestCollectionIndexed", metaBucket} {
+				if b := tx.Bucket([]byte(name)); b != nil {
+					found = found || scan(b, []byte(s))
+				}
+			}
+
+			return nil
+		})
+
+		ExpectedNoError(t, err)
+
+		return found
+	}
+
+	indexed := func() bool {
+		found := false
+
+		err := store.View(func(tx storage.Tx) error {
+			found = tx.Bucket([]byte("TestCollectionIndexed")).Bucket([]byte(indexBucket)) != nil
+
+			return nil
+		})
+
+		ExpectedNoError(t, err)
+
+		return found
+	}
+
+	csA, err := Open(&Options{storage: store})
+
+	ExpectedNoError(t, err)
+
+	cA, err := csA.Register(&TestCollectionIndexed{})
+
+	ExpectedNoError(t, err)
+
+	mA := &TestCollectionIndexed{Email: "a@secret.example", Age: 42}
+
+	ExpectedNoError(t, cA.Create(mA))
+	ExpectedEqual(t, indexed(), true)
+
+	keyring := encrypt.NewKeyring()
+
+	ExpectedNoError(t, keyring.Add(1, encrypt.AESGCM, []byte("0123456789abcdef0123456789abcdef")))
+
+	opt, err := NewOptions(WithStorage(store), WithEncryption(keyring))
+
+	ExpectedNoError(t, err)
+
+	// Indexes persisted before the encryption was enabled are removed
+	csB, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	cB, err := csB.Register(&TestCollectionIndexed{})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, indexed(), false)
+
+	ExpectedNoError(t, csB.RotateKey(1))
+
+	mB := &TestCollectionIndexed{Email: "b@secret.example", Age: 18}
+
+	ExpectedNoError(t, cB.Create(mB))
+
+	mB.Email = "c@secret.example"
+
+	ExpectedNoError(t, mB.Save())
+	ExpectedNoError(t, cB.MustFind(mA.Id(), model.WithDeleted).Delete())
+
+	ExpectedEqual(t, indexed(), false)
+	ExpectedEqual(t, contains("secret.example"), false)
+
+	// Indexes are rebuilt in memory
+	ExpectedNoError(t, cB.Load())
+
+	is, err := cB.FindBy("Email", "c@secret.example")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 1)
+	ExpectedEqual(t, is[0].Id(), mB.Id())
+
+	is, err = cB.FindRange("Age", nil, nil, model.WithDeleted)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 2)
+	ExpectedEqual(t, is[0].Id(), mB.Id())
+}
+
+func TestEncodeIndexKey(t *testing.T) {
+	now := time.Now()
+	idA, _ := uuid.Parse("aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa")
+	idB, _ := uuid.Parse("bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb")
+
+	ordered := [][]interface{}{
+		{math.MinInt64, -42, -1, 0, 1, 42, math.MaxInt64},
+		{uint(0), uint(1), uint(math.MaxUint32)},
+		{math.Inf(-1), -42.5, -0.5, 0.0, 0.5, 42.5, math.Inf(1)},
+		{"", "\x00", "a", "a\x00", "ab", "b"},
+		{false, true},
+		{time.Time{}, now.Add(-time.Hour), now, now.Add(time.Nanosecond)},
+		{idA, idB},
+	}
+
+	for _, vs := range ordered {
+		for x := 1; x < len(vs); x++ {
+			a := encodeIndexKey(reflect.ValueOf(vs[x-1]))
+			b := encodeIndexKey(reflect.ValueOf(vs[x]))
+
+			ExpectedEqualF(t, bytes.Compare(a, b), -1, false, "encoded keys should be ordered")
+
+			// Entries of a value should sort before entries of a greater value
+			ExpectedEqualF(t, bytes.Compare(indexEntry(a, idB), indexEntry(b, idA)), -1, false, "index entries should be ordered")
+		}
+	}
+
+	ExpectedEqual(t, encodeIndexKey(reflect.ValueOf(math.Copysign(0, -1))), encodeIndexKey(reflect.ValueOf(0.0)))
+	ExpectedEqual(t, encodeIndexKey(reflect.ValueOf(now)), encodeIndexKey(reflect.ValueOf(now.UTC())))
+}
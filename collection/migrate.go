@@ -0,0 +1,388 @@
+package collection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"peterdekok.nl/gotools/borm/codec"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	"reflect"
+	"sort"
+)
+
+// Bucket holding metadata, in a sub bucket per collection.
+// Collections are named after their model type, which is not expected to be named like this.
+const metaBucket = "_borm"
+
+const schemaVersionKey = "schema-version"
+
+// Migration migrates the records of a collection to a schema version, see WithMigrations.
+type Migration struct {
+	// Version is the schema version the records have once migrated, starting at 1
+	Version uint64
+	// Migrate changes a decoded record, the fields of the model are held by "Instance",
+	// the id, version and timestamps by "Model". Nested objects are decoded as maps with string keys.
+	Migrate func(r map[string]interface{}) error
+}
+
+// MigrationReport reports the schema versions before and after migrating a collection, and the number of migrated records.
+type MigrationReport struct {
+	From    uint64
+	To      uint64
+	Records int
+}
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// WithMigrations registers the migrations of the collection.
+// The schema version of the collection is stored in the database, migrations to a later version are run
+// on every record in order when the collection is registered, in a single transaction.
+// The previous versions of the models and the records of the collection held by the change log are migrated
+// within the same transaction.
+// When a migration fails, or a migrated record does not unmarshal into the model, the transaction is rolled back.
+// Gob records can not be migrated.
+func WithMigrations(ms ...Migration) RegisterOption {
+	return func(col *Collection) {
+		col.migrations = append(col.migrations, ms...)
+	}
+}
+
+// DryRunMigrations runs the migrations of the model, as registered with the options, without committing them.
+// The collection is not registered. When the database is read-only, the migrated records are only checked
+// within a read transaction.
+func (cs *Collections) DryRunMigrations(mi model.Interface, opts ...RegisterOption) (MigrationReport, error) {
+	iv, _, err := model.CheckInterface(mi)
+
+	if err != nil {
+		return MigrationReport{}, fmt.Errorf("failed to migrate model: %s", err)
+	}
+
+	c, err := cs.newCollection(iv.Type(), cs.log.WithField("collection", iv.Type().Name()), opts)
+
+	if err != nil {
+		return MigrationReport{}, fmt.Errorf("failed to migrate model: %s", err)
+	}
+
+	r, err := c.migrate(true)
+
+	if err != nil {
+		return r, fmt.Errorf("failed to migrate model: %s", err)
+	}
+
+	return r, nil
+}
+
+// SchemaVersion returns the schema version of the collection, it is zero when the collection has no migrations.
+func (c *Collection) SchemaVersion() uint64 {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.schemaVersion
+}
+
+// migrate migrates the records of the collection to the latest schema version.
+func (c *Collection) migrate(dryRun bool) (MigrationReport, error) {
+	if len(c.migrations) == 0 {
+		return MigrationReport{}, nil
+	}
+
+	ms, err := sortMigrations(c.migrations)
+
+	if err != nil {
+		return MigrationReport{}, err
+	}
+
+	latest := ms[len(ms)-1].Version
+
+	var r MigrationReport
+
+	// Check the version first, so collections without pending migrations can be read-only
+	err = c.root.store.View(func(tx storage.Tx) error {
+		r.From = schemaVersion(tx, c.name)
+
+		return nil
+	})
+
+	if err != nil {
+		return r, err
+	}
+
+	r.To = r.From
+
+	if r.From > latest {
+		return r, fmt.Errorf("schema version %d is newer than the latest migration %d", r.From, latest)
+	}
+
+	if r.From < latest && c.root.store.ReadOnly() && !dryRun {
+		return r, fmt.Errorf("pending migrations: %w", ErrReadOnly)
+	}
+
+	if r.From < latest {
+		// Dry runs roll back the update, they can only read read-only databases
+		run := c.root.store.Update
+
+		if dryRun && c.root.store.ReadOnly() {
+			run = c.root.store.View
+		}
+
+		err = run(func(tx storage.Tx) error {
+			r.From = schemaVersion(tx, c.name)
+			r.Records = 0
+
+			if err := c.migrateRecords(tx, ms, &r); err != nil {
+				return err
+			}
+
+			if !tx.Writable() {
+				return nil
+			}
+
+			if err := setSchemaVersion(tx, c.name, latest); err != nil {
+				return err
+			}
+
+			if dryRun {
+				return errDryRun
+			}
+
+			return nil
+		})
+
+		if err != nil && err != errDryRun {
+			return r, err
+		}
+
+		r.To = latest
+	}
+
+	if !dryRun {
+		c.Lock()
+		c.schemaVersion = r.To
+		c.Unlock()
+
+		c.log.WithField("from", r.From).WithField("to", r.To).WithField("records", r.Records).Debug("Migrated collection")
+	}
+
+	return r, nil
+}
+
+// migrateRecords runs the migrations after the schema version of the report on the records of the collection.
+// Within read transactions the migrated records are only checked, not stored.
+func (c *Collection) migrateRecords(tx storage.Tx, ms []Migration, r *MigrationReport) error {
+	pending := make([]Migration, 0, len(ms))
+
+	for _, m := range ms {
+		if m.Version > r.From {
+			pending = append(pending, m)
+		}
+	}
+
+	b := tx.Bucket([]byte(c.name))
+
+	if b == nil || len(pending) == 0 {
+		return nil
+	}
+
+	var keys, values [][]byte
+
+	err := b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			keys = append(keys, append([]byte{}, k...))
+			values = append(values, append([]byte{}, v...))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for x, k := range keys {
+		v, err := c.migrateRecord(k, values[x], pending)
+
+		if err != nil {
+			return fmt.Errorf("failed to migrate record %s: %s", k, err)
+		}
+
+		if tx.Writable() {
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
+		}
+
+		r.Records++
+	}
+
+	if err := c.migrateHistory(b, pending, tx.Writable()); err != nil {
+		return err
+	}
+
+	if err := c.migrateChanges(tx, pending); err != nil {
+		return err
+	}
+
+	// The persisted indexes are rebuilt, as the migrations may have changed indexed fields
+	if tx.Writable() && b.Bucket([]byte(indexBucket)) != nil {
+		return b.DeleteBucket([]byte(indexBucket))
+	}
+
+	return nil
+}
+
+// migrateRecord runs the migrations on a record, which keeps its codec.
+func (c *Collection) migrateRecord(k, v []byte, ms []Migration) ([]byte, error) {
+	v, err := c.decode(k, v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cd, err := codec.Of(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cd.ID() == codec.Gob.ID() {
+		return nil, errors.New("gob records can not be migrated")
+	}
+
+	var r map[string]interface{}
+
+	if cd.ID() == codec.JSON.ID() {
+		// Numbers are kept as is, so large integers do not lose precision
+		d := json.NewDecoder(bytes.NewReader(v))
+		d.UseNumber()
+
+		err = d.Decode(&r)
+	} else {
+		_, err = codec.Decode(v, &r)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	r = normalize(r).(map[string]interface{})
+
+	for _, m := range ms {
+		if err := m.Migrate(r); err != nil {
+			return nil, fmt.Errorf("migration %d failed: %s", m.Version, err)
+		}
+	}
+
+	if v, err = codec.Encode(cd, r); err != nil {
+		return nil, err
+	}
+
+	// The migrated record should unmarshal into the model
+	var nmi model.Interface
+
+	nmiV := reflect.ValueOf(&nmi)
+	nmiV.Elem().Set(reflect.New(c.mt))
+
+	if _, err := model.Unmarshal(v, nmi, c); err != nil {
+		return nil, err
+	}
+
+	return c.seal(k, v)
+}
+
+// normalize converts maps with keys of other types, as decoded by some codecs, to maps with string keys.
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = normalize(e)
+		}
+
+		return t
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+
+		for k, e := range t {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+
+		return m
+	case []interface{}:
+		for x, e := range t {
+			t[x] = normalize(e)
+		}
+
+		return t
+	}
+
+	return v
+}
+
+// sortMigrations orders the migrations by version, the versions should be unique and not zero.
+func sortMigrations(ms []Migration) ([]Migration, error) {
+	sorted := append([]Migration{}, ms...)
+
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a].Version < sorted[b].Version
+	})
+
+	for x, m := range sorted {
+		if m.Version == 0 {
+			return nil, errors.New("invalid migration version 0")
+		}
+
+		if m.Migrate == nil {
+			return nil, fmt.Errorf("migration %d has no migrate function", m.Version)
+		}
+
+		if x > 0 && sorted[x-1].Version == m.Version {
+			return nil, fmt.Errorf("duplicate migration version %d", m.Version)
+		}
+	}
+
+	return sorted, nil
+}
+
+// schemaVersion returns the stored schema version of the collection.
+func schemaVersion(tx storage.Tx, name string) uint64 {
+	b := tx.Bucket([]byte(metaBucket))
+
+	if b != nil {
+		b = b.Bucket([]byte(name))
+	}
+
+	if b == nil {
+		return 0
+	}
+
+	v := b.Get([]byte(schemaVersionKey))
+
+	if len(v) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(v)
+}
+
+func setSchemaVersion(tx storage.Tx, name string, version uint64) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+
+	if err != nil {
+		return err
+	}
+
+	b, err = b.CreateBucketIfNotExists([]byte(name))
+
+	if err != nil {
+		return err
+	}
+
+	v := make([]byte, 8)
+
+	binary.BigEndian.PutUint64(v, version)
+
+	return b.Put([]byte(schemaVersionKey), v)
+}
@@ -0,0 +1,302 @@
+package collection
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"peterdekok.nl/gotools/borm/codec"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	. "peterdekok.nl/gotools/test"
+	"strings"
+	"testing"
+)
+
+// TestMigrationUser is the first schema of TestMigrationPerson
+type TestMigrationUser struct {
+	model.Model
+
+	Name string
+	Age  string
+}
+
+type TestMigrationPerson struct {
+	model.Model
+
+	FullName string `borm:"index"`
+	Age      int
+}
+
+// migrationsPerson rename Name to FullName and change the type of Age from string to int
+var migrationsPerson = []Migration{
+	{
+		Version: 2,
+		Migrate: func(r map[string]interface{}) error {
+			i := r["Instance"].(map[string]interface{})
+
+			var age int
+
+			if err := json.Unmarshal([]byte(i["Age"].(string)), &age); err != nil {
+				return err
+			}
+
+			i["Age"] = age
+
+			return nil
+		},
+	},
+	{
+		Version: 1,
+		Migrate: func(r map[string]interface{}) error {
+			i := r["Instance"].(map[string]interface{})
+
+			i["FullName"] = strings.ToUpper(i["Name"].(string))
+
+			delete(i, "Name")
+
+			return nil
+		},
+	},
+}
+
+// copyBucket stores the records of one collection as another, to change the model type of the records.
+func copyBucket(t *testing.T, s storage.Storage, from, to string) {
+	t.Helper()
+
+	err := s.Update(func(tx storage.Tx) error {
+		dst, err := tx.CreateBucketIfNotExists([]byte(to))
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket([]byte(from)).ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+
+			return dst.Put(k, v)
+		})
+	})
+
+	ExpectedNoError(t, err)
+}
+
+func TestCollection_migrate(t *testing.T) {
+	t.Parallel()
+
+	for _, cd := range []codec.Codec{codec.JSON, codec.MessagePack, codec.CBOR} {
+		store := storage.NewMemory()
+
+		csA, err := Open(&Options{storage: store, codec: cd})
+
+		ExpectedNoError(t, err)
+
+		cA, err := csA.Register(&TestMigrationUser{})
+
+		ExpectedNoError(t, err)
+
+		mA := &TestMigrationUser{Name: "john doe", Age: "42"}
+		mB := &TestMigrationUser{Name: "jane doe", Age: "invalid"}
+
+		ExpectedNoError(t, cA.Create(mA))
+
+		copyBucket(t, store, "TestMigrationUser", "TestMigrationPerson")
+
+		// Without migrations the records do not unmarshal
+		_, err = csA.Register(&TestMigrationPerson{})
+
+		ExpectedEqualF(t, err != nil, true, false, "expected the records not to unmarshal")
+
+		r, err := csA.DryRunMigrations(&TestMigrationPerson{}, WithMigrations(migrationsPerson...))
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, r, MigrationReport{From: 0, To: 2, Records: 1})
+
+		// The dry run did not change the records
+		r, err = csA.DryRunMigrations(&TestMigrationPerson{}, WithMigrations(migrationsPerson...))
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, r, MigrationReport{From: 0, To: 2, Records: 1})
+
+		cB, err := csA.Register(&TestMigrationPerson{}, WithMigrations(migrationsPerson...))
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, cB.(*Collection).SchemaVersion(), uint64(2))
+		ExpectedEqual(t, cB.Count(), 1)
+
+		mC := cB.MustFind(mA.Id()).(*TestMigrationPerson)
+
+		ExpectedEqual(t, mC.FullName, "JOHN DOE")
+		ExpectedEqual(t, mC.Age, 42)
+		ExpectedEqual(t, mC.Version(), uint64(1))
+		ExpectedEqualF(t, mC.CreatedAt().Equal(mA.CreatedAt()), true, false, "expected the timestamps to be kept")
+
+		// The index is rebuilt from the migrated records
+		ms, err := cB.FindBy("FullName", "JOHN DOE")
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, len(ms), 1)
+
+		ExpectedNoError(t, mC.Save())
+
+		// Migrations are only run once
+		csB, err := Open(&Options{storage: store, codec: cd})
+
+		ExpectedNoError(t, err)
+
+		cC, err := csB.Register(&TestMigrationPerson{}, WithMigrations(migrationsPerson...))
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, cC.MustFind(mA.Id()).(*TestMigrationPerson).FullName, "JOHN DOE")
+
+		// A failing migration rolls back all records
+		ExpectedNoError(t, cA.Create(mB))
+
+		copyBucket(t, store, "TestMigrationUser", "TestMigrationPerson2")
+
+		csC, err := Open(&Options{storage: store, codec: cd})
+
+		ExpectedNoError(t, err)
+
+		_, err = csC.DryRunMigrations(&TestMigrationPerson2{}, WithMigrations(migrationsPerson...))
+
+		ExpectedEqualF(t, err != nil, true, false, "expected the dry run to fail")
+
+		_, err = csC.Register(&TestMigrationPerson2{}, WithMigrations(migrationsPerson...))
+
+		ExpectedEqualF(t, err != nil, true, false, "expected the migration to fail")
+
+		err = store.View(func(tx storage.Tx) error {
+			ExpectedEqual(t, schemaVersion(tx, "TestMigrationPerson2"), uint64(0))
+
+			return nil
+		})
+
+		ExpectedNoError(t, err)
+
+		ExpectedNoError(t, mB.Delete())
+		ExpectedNoError(t, cA.Purge(mB))
+	}
+}
+
+func TestCollection_migrate_readOnly(t *testing.T) {
+	defer os.Remove("testdata/migrate-readonly.db")
+
+	csA, err := Open(&Options{file: "testdata/migrate-readonly.db"})
+
+	ExpectedNoError(t, err)
+
+	cA, err := csA.Register(&TestMigrationUser{}, WithHistory())
+
+	ExpectedNoError(t, err)
+
+	m := &TestMigrationUser{Name: "john doe", Age: "41"}
+
+	ExpectedNoError(t, cA.Create(m))
+
+	m.Age = "42"
+
+	ExpectedNoError(t, m.Save())
+
+	copyBucket(t, csA.store, "TestMigrationUser", "TestMigrationPerson")
+
+	ExpectedNoError(t, csA.Close())
+
+	opt, err := NewOptions(WithFile("testdata/migrate-readonly.db"), WithReadOnly(true))
+
+	ExpectedNoError(t, err)
+
+	csB, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, csB.Close())
+	}()
+
+	// Dry runs only read the records of read-only databases
+	r, err := csB.DryRunMigrations(&TestMigrationPerson{}, WithMigrations(migrationsPerson...))
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, r, MigrationReport{From: 0, To: 2, Records: 1})
+
+	_, err = csB.DryRunMigrations(&TestMigrationPerson{}, WithMigrations(Migration{
+		Version: 1,
+		Migrate: func(r map[string]interface{}) error { return errors.New("failed") },
+	}))
+
+	ExpectedError(t, err, "failed to migrate model: failed to migrate record "+m.Id().String()+": migration 1 failed: failed")
+
+	_, err = csB.Register(&TestMigrationPerson{}, WithMigrations(migrationsPerson...))
+
+	ExpectedError(t, err, "failed to register model: pending migrations: collections are read-only")
+}
+
+type TestMigrationPerson2 struct {
+	model.Model
+
+	FullName string
+	Age      int
+}
+
+func TestCollection_migrate_errors(t *testing.T) {
+	t.Parallel()
+
+	store := storage.NewMemory()
+
+	cs, err := Open(&Options{storage: store})
+
+	ExpectedNoError(t, err)
+
+	noop := func(r map[string]interface{}) error { return nil }
+
+	_, err = cs.Register(&TestCollectionStructB{}, WithMigrations(Migration{Version: 0, Migrate: noop}))
+
+	ExpectedError(t, err, "failed to register model: invalid migration version 0")
+
+	_, err = cs.Register(&TestCollectionStructB{}, WithMigrations(Migration{Version: 1}))
+
+	ExpectedError(t, err, "failed to register model: migration 1 has no migrate function")
+
+	_, err = cs.Register(&TestCollectionStructB{}, WithMigrations(Migration{Version: 1, Migrate: noop}, Migration{Version: 1, Migrate: noop}))
+
+	ExpectedError(t, err, "failed to register model: duplicate migration version 1")
+
+	c, err := cs.Register(&TestCollectionStructB{}, WithMigrations(Migration{Version: 3, Migrate: noop}))
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, c.(*Collection).SchemaVersion(), uint64(3))
+
+	// The database was migrated by a newer version
+	csB, err := Open(&Options{storage: store})
+
+	ExpectedNoError(t, err)
+
+	_, err = csB.Register(&TestCollectionStructB{}, WithMigrations(Migration{Version: 2, Migrate: noop}))
+
+	ExpectedError(t, err, "failed to register model: schema version 3 is newer than the latest migration 2")
+
+	// Gob records can not be migrated
+	csC, err := Open(&Options{storage: store, codec: codec.Gob})
+
+	ExpectedNoError(t, err)
+
+	cC, err := csC.Register(&TestCollectionStructA{})
+
+	ExpectedNoError(t, err)
+	ExpectedNoError(t, cC.Create(&TestCollectionStructA{}))
+
+	csD, err := Open(&Options{storage: store})
+
+	ExpectedNoError(t, err)
+
+	_, err = csD.Register(&TestCollectionStructA{}, WithMigrations(Migration{
+		Version: 1,
+		Migrate: func(r map[string]interface{}) error {
+			return errors.New("not called")
+		},
+	}))
+
+	ExpectedEqualF(t, strings.HasSuffix(err.Error(), "gob records can not be migrated"), true, false, "expected gob records not to be migrated")
+}
@@ -0,0 +1,86 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"peterdekok.nl/gotools/borm/storage"
+)
+
+var (
+	// ErrLocked is returned when the database is still locked by another process after the timeout.
+	ErrLocked = errors.New("database locked")
+	// ErrPermissionDenied is returned when the database file may not be opened.
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrCorrupted is returned when the database file is not a valid database.
+	ErrCorrupted = errors.New("database corrupted")
+	// ErrInvalidOptions is returned when the options are invalid, it is not wrapped in an *OpenError.
+	ErrInvalidOptions = errors.New("invalid options")
+)
+
+// OpenError is returned when the database can not be opened.
+// Match the cause with errors.Is, e.g. `errors.Is(err, ErrLocked)`.
+type OpenError struct {
+	File string
+	// One of ErrLocked, ErrPermissionDenied or ErrCorrupted, nil for other causes
+	Kind error
+	Err  error
+}
+
+// Open opens the database of the collections.
+// Unlike Init, an *OpenError is returned when the database can not be opened.
+// Invalid options are reported before the database is opened, as ErrInvalidOptions.
+func Open(options *Options) (*Collections, error) {
+	if options == nil {
+		options = &Options{}
+	}
+
+	cs, err := open(options)
+
+	if errors.Is(err, ErrInvalidOptions) {
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, newOpenError(options.file, err)
+	}
+
+	return cs, nil
+}
+
+func newOpenError(file string, err error) *OpenError {
+	e := &OpenError{
+		File: file,
+		Err:  err,
+	}
+
+	switch {
+	case errors.Is(err, bolt.ErrTimeout):
+		e.Kind = ErrLocked
+	case errors.Is(err, os.ErrPermission):
+		e.Kind = ErrPermissionDenied
+	case errors.Is(err, bolt.ErrInvalid), errors.Is(err, bolt.ErrVersionMismatch), errors.Is(err, bolt.ErrChecksum),
+		errors.Is(err, storage.ErrTruncated):
+		e.Kind = ErrCorrupted
+	}
+
+	return e
+}
+
+func (e *OpenError) Error() string {
+	if e.Kind != nil {
+		return fmt.Sprintf("failed to open database %s: %s: %s", e.File, e.Kind, e.Err)
+	}
+
+	return fmt.Sprintf("failed to open database %s: %s", e.File, e.Err)
+}
+
+func (e *OpenError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the cause of the error is target, e.g. ErrLocked.
+func (e *OpenError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
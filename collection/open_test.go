@@ -0,0 +1,107 @@
+package collection
+
+import (
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"peterdekok.nl/gotools/borm/storage"
+	. "peterdekok.nl/gotools/test"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOpen(t *testing.T) {
+	csA, err := Open(nil)
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		if err := boltDB(csA).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	ExpectedEqual(t, boltDB(csA).Path(), "testdata/models.db")
+
+	csB, err := Open(&Options{
+		dbTimeout: 50 * time.Millisecond,
+	})
+
+	ExpectedZeroValueF(t, csB, true, "no collections expected on error")
+	ExpectedError(t, err, "failed to open database testdata/models.db: database locked: timeout")
+	ExpectedEqualF(t, errors.Is(err, ErrLocked), true, false, "expected a locked error")
+	ExpectedEqualF(t, errors.Is(err, bolt.ErrTimeout), true, false, "expected the bolt error to be wrapped")
+
+	if err := ioutil.WriteFile("testdata/corrupted.db", []byte("corrupted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove("testdata/corrupted.db")
+
+	_, err = Open(&Options{
+		file: "testdata/corrupted.db",
+	})
+
+	ExpectedError(t, err, "failed to open database testdata/corrupted.db: database corrupted: invalid database")
+	ExpectedEqualF(t, errors.Is(err, ErrCorrupted), true, false, "expected a corrupted error")
+
+	// Truncated files are detected before bbolt reads the missing pages
+	csC, err := Open(&Options{
+		file: "testdata/truncated.db",
+	})
+
+	ExpectedNoError(t, err)
+
+	defer os.Remove("testdata/truncated.db")
+
+	c, err := csC.Register(&TestCollectionStructB{})
+
+	ExpectedNoError(t, err)
+
+	for x := 0; x < 100; x++ {
+		ExpectedNoError(t, c.Create(&TestCollectionStructB{FieldA: strings.Repeat("a", 1024)}))
+	}
+
+	pageSize := boltDB(csC).Info().PageSize
+
+	ExpectedNoError(t, csC.Close())
+
+	if err := os.Truncate("testdata/truncated.db", int64(4*pageSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(&Options{
+		file: "testdata/truncated.db",
+	})
+
+	ExpectedEqualF(t, errors.Is(err, ErrCorrupted), true, false, "expected a corrupted error")
+	ExpectedEqualF(t, errors.Is(err, storage.ErrTruncated), true, false, "expected a truncated error")
+
+	_, err = Open(&Options{
+		file: "testdata/missing/models.db",
+	})
+
+	ExpectedError(t, err, "failed to open database testdata/missing/models.db: open testdata/missing/models.db: no such file or directory")
+
+	var oe *OpenError
+
+	ExpectedEqualF(t, errors.As(err, &oe), true, true, "expected an open error")
+	ExpectedZeroValue(t, oe.Kind)
+}
+
+func TestNewOpenError(t *testing.T) {
+	err := newOpenError("models.db", &os.PathError{Op: "open", Path: "models.db", Err: syscall.EACCES})
+
+	ExpectedEqual(t, err.Kind, ErrPermissionDenied)
+	ExpectedEqualF(t, errors.Is(err, ErrPermissionDenied), true, false, "expected a permission error")
+	ExpectedEqualF(t, errors.Is(err, ErrLocked), false, false, "expected no locked error")
+	ExpectedError(t, err, "failed to open database models.db: permission denied: open models.db: permission denied")
+
+	ExpectedEqual(t, newOpenError("models.db", bolt.ErrChecksum).Kind, ErrCorrupted)
+	ExpectedEqual(t, newOpenError("models.db", bolt.ErrVersionMismatch).Kind, ErrCorrupted)
+}
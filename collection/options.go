@@ -0,0 +1,367 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"peterdekok.nl/gotools/borm/codec"
+	"peterdekok.nl/gotools/borm/compress"
+	"peterdekok.nl/gotools/borm/encrypt"
+	"peterdekok.nl/gotools/borm/storage"
+	"peterdekok.nl/gotools/logger"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Options configure how the database of the collections is opened.
+// Create them with NewOptions, zero values are replaced by the DefaultOptions.
+type Options struct {
+	file      string
+	dbTimeout time.Duration
+	fileMode  os.FileMode
+
+	noSync          bool
+	noFreelistSync  bool
+	initialMmapSize int
+	freelistType    bolt.FreelistType
+	readOnly        bool
+
+	memory  bool
+	storage storage.Storage
+
+	codec codec.Codec
+
+	compressor           compress.Compressor
+	compressionThreshold int
+
+	keyring *encrypt.Keyring
+	keys    encrypt.KeyProvider
+
+	changeLog      bool
+	changeMaxAge   time.Duration
+	changeMaxCount int
+
+	logger logger.Logger
+	clock  func() time.Time
+
+	completed bool
+}
+
+// Option sets one of the Options, see NewOptions.
+type Option func(opt *Options)
+
+var DefaultOptions = &Options{
+	file:         "models.db",
+	dbTimeout:    50 * time.Millisecond,
+	fileMode:     0600,
+	freelistType: bolt.FreelistArrayType,
+}
+
+// NewOptions creates options from the given option functions, e.g.
+//
+//	NewOptions(WithFile("data/models.db"), WithTimeout(time.Second))
+//
+// An error is returned when the resulting options are invalid.
+func NewOptions(opts ...Option) (*Options, error) {
+	opt := &Options{}
+
+	for _, o := range opts {
+		o(opt)
+	}
+
+	if err := opt.validate(); err != nil {
+		return nil, err
+	}
+
+	return opt, nil
+}
+
+// WithFile sets the path of the database file.
+func WithFile(file string) Option {
+	return func(opt *Options) {
+		opt.file = file
+	}
+}
+
+// WithTimeout sets how long to wait for the lock on the database file.
+func WithTimeout(timeout time.Duration) Option {
+	return func(opt *Options) {
+		opt.dbTimeout = timeout
+	}
+}
+
+// WithFileMode sets the permissions of the database file when it is created.
+func WithFileMode(mode os.FileMode) Option {
+	return func(opt *Options) {
+		opt.fileMode = mode
+	}
+}
+
+// WithBoltOptions copies NoSync, NoFreelistSync, InitialMmapSize, FreelistType and ReadOnly from the bolt options.
+// The timeout is set by WithTimeout.
+func WithBoltOptions(bo *bolt.Options) Option {
+	return func(opt *Options) {
+		if bo == nil {
+			return
+		}
+
+		opt.noSync = bo.NoSync
+		opt.noFreelistSync = bo.NoFreelistSync
+		opt.initialMmapSize = bo.InitialMmapSize
+		opt.freelistType = bo.FreelistType
+		opt.readOnly = bo.ReadOnly
+	}
+}
+
+// WithReadOnly opens the database read-only, changing models results in ErrReadOnly.
+// Bolt holds a shared lock on a database opened read-only, so it can be opened by multiple readers,
+// but not while a process holds it for writing: opening it times out with ErrLocked.
+// To inspect the database of a running process, open a snapshot written by that process with BackupToFile
+// or BackupHandler instead. Refresh opens the file again, so it reads the snapshot which replaced it since.
+func WithReadOnly(readOnly bool) Option {
+	return func(opt *Options) {
+		opt.readOnly = readOnly
+	}
+}
+
+// WithInMemory keeps the collections in memory only, the database file is never opened.
+// Models are lost when the collections are closed.
+// It conflicts with WithReadOnly, WithStorage and the options of the database file, like WithFile and WithBoltOptions.
+func WithInMemory() Option {
+	return func(opt *Options) {
+		opt.memory = true
+	}
+}
+
+// WithStorage stores the collections in the given storage instead of a database file.
+// It conflicts with the options of the database file, like WithFile and WithBoltOptions,
+// and with WithReadOnly, as the storage determines whether it is read-only.
+func WithStorage(s storage.Storage) Option {
+	return func(opt *Options) {
+		opt.storage = s
+	}
+}
+
+// WithCodec sets the codec models are encoded with when saved, JSON by default.
+// Records are decoded with the codec they were encoded with, so the codec of an existing database can be changed,
+// its records are converted as their models are saved.
+func WithCodec(c codec.Codec) Option {
+	return func(opt *Options) {
+		opt.codec = c
+	}
+}
+
+// WithCompression compresses the records of the collections with the compressor,
+// records smaller than threshold bytes are stored uncompressed, zero uses the compress.DefaultThreshold.
+// Compressed and uncompressed records can be mixed, so compression can be enabled or disabled on an existing database.
+func WithCompression(c compress.Compressor, threshold int) Option {
+	return func(opt *Options) {
+		opt.compressor = c
+		opt.compressionThreshold = threshold
+	}
+}
+
+// WithEncryption encrypts the records of the collections with the primary key of the keyring.
+// Records are decrypted with the key they were encrypted with, so the keyring should hold every key still in use,
+// see Collections.RotateKey. Unencrypted records are read as well and encrypted once saved.
+// Indexes are not persisted, as their keys are the plain indexed values, they are rebuilt in memory on load instead.
+func WithEncryption(k *encrypt.Keyring) Option {
+	return func(opt *Options) {
+		opt.keyring = k
+	}
+}
+
+// WithKeyProvider sets the provider of the keys fields tagged `borm:"encrypt"` are encrypted with.
+// Encrypted fields remain encrypted in the records, even when they are exported, and are never indexed.
+// Keys of a field should remain available while records encrypted with them exist, RotateKey does not re-encrypt fields.
+// Values stored before a field was tagged are read as plain values, they are encrypted once the model is saved.
+// Gob records do not support this.
+func WithKeyProvider(p encrypt.KeyProvider) Option {
+	return func(opt *Options) {
+		opt.keys = p
+	}
+}
+
+// WithChangeLog appends every change of a model to the change log, see Collections.ChangesSince.
+// Entries older than maxAge and all but the last maxCount entries are removed as changes are appended,
+// zero disables either limit. Entries hold the records as stored, they are re-encrypted by RotateKey
+// and migrated along with the records of their collection.
+func WithChangeLog(maxAge time.Duration, maxCount int) Option {
+	return func(opt *Options) {
+		opt.changeLog = true
+		opt.changeMaxAge = maxAge
+		opt.changeMaxCount = maxCount
+	}
+}
+
+// WithLogger sets the logger of the collections.
+func WithLogger(l logger.Logger) Option {
+	return func(opt *Options) {
+		opt.logger = l
+	}
+}
+
+// WithClock sets the clock used to timestamp models.
+func WithClock(clock func() time.Time) Option {
+	return func(opt *Options) {
+		opt.clock = clock
+	}
+}
+
+func (opt *Options) complete() *Options {
+	if opt.completed {
+		return opt
+	}
+
+	opt.completed = true
+
+	if reflect.ValueOf(opt.file).IsZero() {
+		opt.file = DefaultOptions.file
+	}
+
+	// Adding 50 ms, due to flock retry delay being subtracted from timeout
+	opt.dbTimeout += DefaultOptions.dbTimeout
+
+	if opt.fileMode == 0 {
+		opt.fileMode = DefaultOptions.fileMode
+	}
+
+	if opt.freelistType == "" {
+		opt.freelistType = DefaultOptions.freelistType
+	}
+
+	if opt.codec == nil {
+		opt.codec = codec.JSON
+	}
+
+	if opt.compressionThreshold == 0 {
+		opt.compressionThreshold = compress.DefaultThreshold
+	}
+
+	if opt.logger == nil {
+		opt.logger = log
+	}
+
+	if opt.clock == nil {
+		opt.clock = time.Now
+	}
+
+	return opt
+}
+
+// validate checks the options, zero values are valid as they are replaced by the defaults.
+func (opt *Options) validate() error {
+	if opt.dbTimeout < 0 {
+		return fmt.Errorf("invalid timeout %s", opt.dbTimeout)
+	}
+
+	if opt.fileMode&^os.ModePerm != 0 || (opt.fileMode != 0 && opt.fileMode&0400 == 0) {
+		return fmt.Errorf("invalid file mode %s", opt.fileMode)
+	}
+
+	if opt.initialMmapSize < 0 {
+		return fmt.Errorf("invalid initial mmap size %d", opt.initialMmapSize)
+	}
+
+	if opt.compressionThreshold < 0 {
+		return fmt.Errorf("invalid compression threshold %d", opt.compressionThreshold)
+	}
+
+	if opt.changeMaxAge < 0 {
+		return fmt.Errorf("invalid change log age %s", opt.changeMaxAge)
+	}
+
+	if opt.changeMaxCount < 0 {
+		return fmt.Errorf("invalid change log count %d", opt.changeMaxCount)
+	}
+
+	switch opt.freelistType {
+	case "", bolt.FreelistArrayType, bolt.FreelistMapType:
+	default:
+		return fmt.Errorf("invalid freelist type %s", opt.freelistType)
+	}
+
+	// Completed options hold the defaults of the database file, they were validated before
+	if opt.completed {
+		return nil
+	}
+
+	return opt.validateStore()
+}
+
+// validateStore rejects the options which conflict with the store of the collections.
+func (opt *Options) validateStore() error {
+	var store string
+
+	switch {
+	case opt.memory && opt.storage != nil:
+		return errors.New("in-memory conflicts with storage")
+	case opt.memory:
+		store = "in-memory"
+	case opt.storage != nil:
+		store = "storage"
+	default:
+		return nil
+	}
+
+	if opt.readOnly {
+		return fmt.Errorf("read-only conflicts with %s", store)
+	}
+
+	if opt.file != "" || opt.fileMode != 0 || opt.dbTimeout != 0 || opt.noSync || opt.noFreelistSync ||
+		opt.initialMmapSize != 0 || opt.freelistType != "" {
+		return fmt.Errorf("database file options conflict with %s", store)
+	}
+
+	return nil
+}
+
+func (opt *Options) boltOptions() *bolt.Options {
+	return &bolt.Options{
+		Timeout:         opt.dbTimeout,
+		NoGrowSync:      false,
+		NoFreelistSync:  opt.noFreelistSync,
+		FreelistType:    opt.freelistType,
+		ReadOnly:        opt.readOnly,
+		InitialMmapSize: opt.initialMmapSize,
+		NoSync:          opt.noSync,
+	}
+}
+
+func (opt *Options) String() string {
+	strs := make([]string, 0, 13)
+
+	strs = append(strs, fmt.Sprintf(" file-path: %s", opt.file))
+	strs = append(strs, fmt.Sprintf("db-timeout: %s", opt.dbTimeout))
+	strs = append(strs, fmt.Sprintf("file-mode: %s", opt.fileMode))
+	strs = append(strs, fmt.Sprintf("read-only: %t", opt.readOnly))
+	strs = append(strs, fmt.Sprintf("no-sync: %t", opt.noSync))
+	strs = append(strs, fmt.Sprintf("no-freelist-sync: %t", opt.noFreelistSync))
+	strs = append(strs, fmt.Sprintf("initial-mmap-size: %d", opt.initialMmapSize))
+	strs = append(strs, fmt.Sprintf("freelist-type: %s", opt.freelistType))
+	strs = append(strs, fmt.Sprintf("in-memory: %t", opt.memory))
+	strs = append(strs, fmt.Sprintf("codec: %s", codecName(opt.codec)))
+	strs = append(strs, fmt.Sprintf("compression: %s", compressorName(opt.compressor)))
+	strs = append(strs, fmt.Sprintf("encryption: %t", opt.keyring != nil))
+	strs = append(strs, fmt.Sprintf("change-log: %t", opt.changeLog))
+
+	return strings.Join(strs, ", ")
+}
+
+func codecName(c codec.Codec) string {
+	if c == nil {
+		return ""
+	}
+
+	return c.Name()
+}
+
+func compressorName(c compress.Compressor) string {
+	if c == nil {
+		return "none"
+	}
+
+	return c.Name()
+}
@@ -0,0 +1,240 @@
+package collection
+
+import (
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"peterdekok.nl/gotools/borm/codec"
+	"peterdekok.nl/gotools/borm/compress"
+	"peterdekok.nl/gotools/borm/encrypt"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+	"time"
+)
+
+type TestOptionsClock struct{ model.Model }
+
+func TestOptions_complete(t *testing.T) {
+	optA := &Options{}
+	optA.complete()
+
+	ExpectedEqual(t, optA.file, "testdata/models.db")
+	ExpectedEqual(t, optA.dbTimeout, 50*time.Millisecond)
+
+	optB := &Options{
+		file: "testdata/test.db",
+	}
+	optB.complete()
+
+	ExpectedEqual(t, optB.file, "testdata/test.db")
+	ExpectedEqual(t, optB.dbTimeout, 50*time.Millisecond)
+
+	optC := &Options{
+		file:      "testdata/test.db",
+		dbTimeout: 200 * time.Millisecond,
+	}
+	optC.complete()
+
+	ExpectedEqual(t, optC.file, "testdata/test.db")
+	ExpectedEqual(t, optC.dbTimeout, 250*time.Millisecond)
+}
+
+func TestOptions_String(t *testing.T) {
+	optA := &Options{
+		file: "testdata/test.db",
+	}
+
+	ExpectedEqual(t, optA.String(), " file-path: testdata/test.db, db-timeout: 0s, file-mode: ----------, read-only: false, no-sync: false, no-freelist-sync: false, initial-mmap-size: 0, freelist-type: , in-memory: false, codec: , compression: none, encryption: false, change-log: false")
+
+	optA.complete()
+
+	ExpectedEqual(t, optA.String(), " file-path: testdata/test.db, db-timeout: 50ms, file-mode: -rw-------, read-only: false, no-sync: false, no-freelist-sync: false, initial-mmap-size: 0, freelist-type: array, in-memory: false, codec: json, compression: none, encryption: false, change-log: false")
+}
+
+func TestNewOptions(t *testing.T) {
+	optA, err := NewOptions()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, optA, &Options{})
+
+	clock := func() time.Time { return time.Time{} }
+
+	optB, err := NewOptions(
+		WithFile("testdata/test.db"),
+		WithTimeout(100*time.Millisecond),
+		WithFileMode(0640),
+		WithBoltOptions(&bolt.Options{
+			NoSync:          true,
+			NoFreelistSync:  true,
+			InitialMmapSize: 1 << 20,
+			FreelistType:    bolt.FreelistMapType,
+			ReadOnly:        true,
+			Timeout:         time.Hour,
+		}),
+		WithBoltOptions(nil),
+		WithCodec(codec.Gob),
+		WithCompression(compress.Zstd, 1024),
+		WithEncryption(encrypt.NewKeyring()),
+		WithChangeLog(time.Hour, 100),
+		WithLogger(log),
+		WithClock(clock),
+	)
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, optB.file, "testdata/test.db")
+	ExpectedEqual(t, optB.dbTimeout, 100*time.Millisecond)
+	ExpectedEqual(t, optB.fileMode, os.FileMode(0640))
+	ExpectedEqual(t, optB.noSync, true)
+	ExpectedEqual(t, optB.noFreelistSync, true)
+	ExpectedEqual(t, optB.initialMmapSize, 1<<20)
+	ExpectedEqual(t, optB.freelistType, bolt.FreelistMapType)
+	ExpectedEqual(t, optB.readOnly, true)
+	ExpectedEqual(t, optB.codec, codec.Gob)
+	ExpectedEqual(t, optB.compressor, compress.Zstd)
+	ExpectedEqual(t, optB.compressionThreshold, 1024)
+	ExpectedNoZeroValueF(t, optB.keyring, false, "expected the keyring to be set")
+	ExpectedEqual(t, optB.changeLog, true)
+	ExpectedEqual(t, optB.changeMaxAge, time.Hour)
+	ExpectedEqual(t, optB.changeMaxCount, 100)
+	ExpectedEqualF(t, optB.logger == log, true, false, "expected the logger to be set")
+	ExpectedEqualF(t, optB.clock != nil, true, false, "expected the clock to be set")
+
+	ExpectedEqual(t, optB.String(), " file-path: testdata/test.db, db-timeout: 100ms, file-mode: -rw-r-----, read-only: true, no-sync: true, no-freelist-sync: true, initial-mmap-size: 1048576, freelist-type: hashmap, in-memory: false, codec: gob, compression: zstd, encryption: true, change-log: true")
+
+	_, err = NewOptions(WithTimeout(-time.Second))
+
+	ExpectedError(t, err, "invalid timeout -1s")
+
+	_, err = NewOptions(WithFileMode(os.ModeDir | 0700))
+
+	ExpectedError(t, err, "invalid file mode drwx------")
+
+	_, err = NewOptions(WithFileMode(0200))
+
+	ExpectedError(t, err, "invalid file mode --w-------")
+
+	_, err = NewOptions(WithBoltOptions(&bolt.Options{InitialMmapSize: -1}))
+
+	ExpectedError(t, err, "invalid initial mmap size -1")
+
+	_, err = NewOptions(WithBoltOptions(&bolt.Options{FreelistType: "list"}))
+
+	ExpectedError(t, err, "invalid freelist type list")
+
+	_, err = NewOptions(WithCompression(compress.Gzip, -1))
+
+	ExpectedError(t, err, "invalid compression threshold -1")
+
+	_, err = NewOptions(WithChangeLog(-time.Hour, 0))
+
+	ExpectedError(t, err, "invalid change log age -1h0m0s")
+
+	_, err = NewOptions(WithChangeLog(0, -1))
+
+	ExpectedError(t, err, "invalid change log count -1")
+
+	// Options which are not used by the store of the collections
+	_, err = NewOptions(WithInMemory(), WithStorage(storage.NewMemory()))
+
+	ExpectedError(t, err, "in-memory conflicts with storage")
+
+	_, err = NewOptions(WithInMemory(), WithReadOnly(true))
+
+	ExpectedError(t, err, "read-only conflicts with in-memory")
+
+	_, err = NewOptions(WithStorage(storage.NewMemory()), WithReadOnly(true))
+
+	ExpectedError(t, err, "read-only conflicts with storage")
+
+	_, err = NewOptions(WithInMemory(), WithFile("testdata/memory.db"))
+
+	ExpectedError(t, err, "database file options conflict with in-memory")
+
+	_, err = NewOptions(WithStorage(storage.NewMemory()), WithTimeout(time.Second))
+
+	ExpectedError(t, err, "database file options conflict with storage")
+
+	_, err = NewOptions(WithStorage(storage.NewMemory()), WithBoltOptions(&bolt.Options{NoSync: true}))
+
+	ExpectedError(t, err, "database file options conflict with storage")
+
+	_, err = Open(&Options{memory: true, readOnly: true})
+
+	ExpectedError(t, err, "invalid options: read-only conflicts with in-memory")
+
+	opt, err := NewOptions(WithInMemory(), WithReadOnly(false))
+
+	ExpectedNoError(t, err)
+
+	cs, err := Open(opt)
+
+	ExpectedNoError(t, err)
+	ExpectedNoError(t, cs.Close())
+
+	// Completed options are accepted again
+	cs, err = Open(opt)
+
+	ExpectedNoError(t, err)
+	ExpectedNoError(t, cs.Close())
+}
+
+func TestOptions_complete_once(t *testing.T) {
+	opt, err := NewOptions(WithTimeout(100 * time.Millisecond))
+
+	ExpectedNoError(t, err)
+
+	opt.complete()
+	opt.complete()
+
+	ExpectedEqual(t, opt.dbTimeout, 150*time.Millisecond)
+	ExpectedEqual(t, opt.fileMode, os.FileMode(0600))
+	ExpectedEqual(t, opt.freelistType, bolt.FreelistArrayType)
+}
+
+func TestOpen_options(t *testing.T) {
+	opt, err := NewOptions(WithTimeout(-time.Second))
+
+	ExpectedError(t, err, "invalid timeout -1s")
+	ExpectedZeroValue(t, opt)
+
+	_, err = Open(&Options{dbTimeout: -time.Hour})
+
+	ExpectedError(t, err, "invalid options: invalid timeout -1h0m0s")
+	ExpectedEqualF(t, errors.Is(err, ErrInvalidOptions), true, false, "expected an invalid options error")
+
+	var oe *OpenError
+
+	ExpectedEqualF(t, errors.As(err, &oe), false, false, "invalid options should not be reported as open error")
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	opt, err = NewOptions(WithClock(func() time.Time { return now }))
+
+	ExpectedNoError(t, err)
+
+	cs, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	c, err := cs.Register(&TestOptionsClock{})
+
+	ExpectedNoError(t, err)
+
+	m := &TestOptionsClock{}
+
+	ExpectedNoError(t, c.Create(m))
+
+	ExpectedEqualF(t, m.CreatedAt().Equal(now), true, false, "model should be timestamped by the clock")
+	ExpectedEqualF(t, m.UpdatedAt().Equal(now), true, false, "model should be timestamped by the clock")
+}
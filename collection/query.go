@@ -0,0 +1,350 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"peterdekok.nl/gotools/borm/model"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Query is the query builder of a collection, see model.QueryInterface.
+type Query struct {
+	c *Collection
+
+	scope   model.Scope
+	filters []func(i model.Interface) bool
+	orders  []order
+	limit   int
+	offset  int
+
+	err error
+}
+
+type order struct {
+	f    *field
+	desc bool
+}
+
+// Where returns the models of the collection for which fn returns true, ordered by creation.
+// Soft deleted models are left out, unless requested by scope.
+func (c *Collection) Where(fn func(i model.Interface) bool, scope ...model.Scope) []model.Interface {
+	is := c.All(scope...)
+
+	n := 0
+
+	for _, i := range is {
+		if fn(i) {
+			is[n] = i
+			n++
+		}
+	}
+
+	return is[:n]
+}
+
+// Query starts a new query on the collection.
+func (c *Collection) Query() model.QueryInterface {
+	return &Query{
+		c:     c,
+		scope: model.WithoutDeleted,
+		limit: -1,
+	}
+}
+
+// Scope sets which models are considered with regard to soft deletes.
+func (q *Query) Scope(s model.Scope) model.QueryInterface {
+	q.scope = s
+
+	return q
+}
+
+// Where filters the models by a predicate.
+func (q *Query) Where(fn func(i model.Interface) bool) model.QueryInterface {
+	q.filters = append(q.filters, fn)
+
+	return q
+}
+
+// Eq filters the models on a field being equal to v.
+func (q *Query) Eq(field string, v interface{}) model.QueryInterface {
+	return q.filter(field, v, false, func(a, b reflect.Value) bool {
+		return equal(a, b)
+	})
+}
+
+// Gt filters the models on a field being greater than v.
+func (q *Query) Gt(field string, v interface{}) model.QueryInterface {
+	return q.filter(field, v, true, func(a, b reflect.Value) bool {
+		return compare(a, b) > 0
+	})
+}
+
+// Gte filters the models on a field being greater than or equal to v.
+func (q *Query) Gte(field string, v interface{}) model.QueryInterface {
+	return q.filter(field, v, true, func(a, b reflect.Value) bool {
+		return compare(a, b) >= 0
+	})
+}
+
+// Lt filters the models on a field being less than v.
+func (q *Query) Lt(field string, v interface{}) model.QueryInterface {
+	return q.filter(field, v, true, func(a, b reflect.Value) bool {
+		return compare(a, b) < 0
+	})
+}
+
+// Lte filters the models on a field being less than or equal to v.
+func (q *Query) Lte(field string, v interface{}) model.QueryInterface {
+	return q.filter(field, v, true, func(a, b reflect.Value) bool {
+		return compare(a, b) <= 0
+	})
+}
+
+// In filters the models on a field being equal to any of vs.
+func (q *Query) In(field string, vs ...interface{}) model.QueryInterface {
+	f := q.field(field)
+
+	if f == nil {
+		return q
+	}
+
+	rvs := make([]reflect.Value, 0, len(vs))
+
+	for _, v := range vs {
+		rv, err := f.value(v)
+
+		if err != nil {
+			return q.fail(err)
+		}
+
+		rvs = append(rvs, rv)
+	}
+
+	return q.Where(func(i model.Interface) bool {
+		fv := f.get(i)
+
+		for _, rv := range rvs {
+			if equal(fv, rv) {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// Contains filters the models on a field containing v.
+// String fields should contain v as substring, slices and arrays as element and maps as key.
+func (q *Query) Contains(field string, v interface{}) model.QueryInterface {
+	f := q.field(field)
+
+	if f == nil {
+		return q
+	}
+
+	var fn func(fv, rv reflect.Value) bool
+	var typ reflect.Type
+
+	switch f.typ.Kind() {
+	case reflect.String:
+		typ = f.typ
+		fn = func(fv, rv reflect.Value) bool {
+			return strings.Contains(fv.String(), rv.String())
+		}
+	case reflect.Slice, reflect.Array:
+		typ = f.typ.Elem()
+		fn = func(fv, rv reflect.Value) bool {
+			for x := 0; x < fv.Len(); x++ {
+				if equal(fv.Index(x), rv) {
+					return true
+				}
+			}
+
+			return false
+		}
+	case reflect.Map:
+		typ = f.typ.Key()
+		fn = func(fv, rv reflect.Value) bool {
+			return fv.MapIndex(rv).IsValid()
+		}
+	default:
+		return q.fail(fmt.Errorf("field %s (%s) can not contain values", f.name, f.typ))
+	}
+
+	rv, err := convert(v, typ, f.name)
+
+	if err != nil {
+		return q.fail(err)
+	}
+
+	return q.Where(func(i model.Interface) bool {
+		return fn(f.get(i), rv)
+	})
+}
+
+// OrderBy orders the models ascending by a field.
+// Multiple orders are applied in the order they are added, models are ordered by creation otherwise.
+func (q *Query) OrderBy(field string) model.QueryInterface {
+	return q.order(field, false)
+}
+
+// OrderByDesc orders the models descending by a field.
+func (q *Query) OrderByDesc(field string) model.QueryInterface {
+	return q.order(field, true)
+}
+
+// Limit limits the number of models returned, a negative limit removes the limit.
+func (q *Query) Limit(n int) model.QueryInterface {
+	q.limit = n
+
+	return q
+}
+
+// Offset skips the first n models.
+func (q *Query) Offset(n int) model.QueryInterface {
+	if n < 0 {
+		return q.fail(fmt.Errorf("invalid offset %d", n))
+	}
+
+	q.offset = n
+
+	return q
+}
+
+// All executes the query.
+func (q *Query) All() ([]model.Interface, error) {
+	is, err := q.matches()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if q.offset >= len(is) {
+		return is[:0], nil
+	}
+
+	is = is[q.offset:]
+
+	if q.limit >= 0 && q.limit < len(is) {
+		is = is[:q.limit]
+	}
+
+	return is, nil
+}
+
+// First executes the query and returns the first model.
+func (q *Query) First() (model.Interface, error) {
+	is, err := q.All()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(is) == 0 {
+		return nil, errors.New("model not found")
+	}
+
+	return is[0], nil
+}
+
+// Count executes the query and returns the number of matching models.
+// Limit and offset are not applied.
+func (q *Query) Count() (int, error) {
+	is, err := q.matches()
+
+	return len(is), err
+}
+
+func (q *Query) matches() ([]model.Interface, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	is := q.c.Where(func(i model.Interface) bool {
+		for _, fn := range q.filters {
+			if !fn(i) {
+				return false
+			}
+		}
+
+		return true
+	}, q.scope)
+
+	if len(q.orders) > 0 {
+		sort.SliceStable(is, func(a, b int) bool {
+			for _, o := range q.orders {
+				r := compare(o.f.get(is[a]), o.f.get(is[b]))
+
+				if r != 0 {
+					return (r < 0) != o.desc
+				}
+			}
+
+			return false
+		})
+	}
+
+	return is, nil
+}
+
+func (q *Query) filter(field string, v interface{}, ordered bool, fn func(a, b reflect.Value) bool) model.QueryInterface {
+	f := q.field(field)
+
+	if f == nil {
+		return q
+	}
+
+	if ordered && !isOrdered(f.typ) {
+		return q.fail(fmt.Errorf("field %s (%s) is not ordered", f.name, f.typ))
+	}
+
+	rv, err := f.value(v)
+
+	if err != nil {
+		return q.fail(err)
+	}
+
+	return q.Where(func(i model.Interface) bool {
+		return fn(f.get(i), rv)
+	})
+}
+
+func (q *Query) order(field string, desc bool) model.QueryInterface {
+	f := q.field(field)
+
+	if f == nil {
+		return q
+	}
+
+	if !isOrdered(f.typ) {
+		return q.fail(fmt.Errorf("field %s (%s) is not ordered", f.name, f.typ))
+	}
+
+	q.orders = append(q.orders, order{f: f, desc: desc})
+
+	return q
+}
+
+// field resolves a field, recording the error when the field is unknown.
+func (q *Query) field(name string) *field {
+	f, err := q.c.field(name)
+
+	if err != nil {
+		q.fail(err)
+
+		return nil
+	}
+
+	return f
+}
+
+// fail records the first error of the query.
+func (q *Query) fail(err error) model.QueryInterface {
+	if q.err == nil {
+		q.err = fmt.Errorf("invalid query: %w", err)
+	}
+
+	return q
+}
@@ -0,0 +1,303 @@
+package collection
+
+import (
+	"peterdekok.nl/gotools/borm/model"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+)
+
+type TestCollectionQuery struct {
+	model.Model
+	Name  string
+	Age   int
+	Tags  []string
+	Attrs map[string]int
+}
+
+func testQueryCollection(t *testing.T) (*Collections, model.CollectionInterface, []model.Interface) {
+	cs, cis := testCollections(t, &TestCollectionQuery{})
+
+	c := cis[0]
+
+	ms := []model.Interface{
+		&TestCollectionQuery{Name: "alice", Age: 42, Tags: []string{"admin"}, Attrs: map[string]int{"a": 1}},
+		&TestCollectionQuery{Name: "bob", Age: 30, Tags: []string{"user"}},
+		&TestCollectionQuery{Name: "carol", Age: 30, Tags: []string{"user", "admin"}},
+		&TestCollectionQuery{Name: "dave", Age: 18},
+	}
+
+	for _, m := range ms {
+		ExpectedNoError(t, c.Create(m))
+	}
+
+	return cs, c, ms
+}
+
+func TestCollection_Where(t *testing.T) {
+	cs, c, ms := testQueryCollection(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	adult := func(i model.Interface) bool {
+		return i.(*TestCollectionQuery).Age > 18
+	}
+
+	ExpectedEqual(t, c.Where(adult), ms[:3])
+
+	ExpectedNoError(t, ms[0].Delete())
+
+	ExpectedEqual(t, c.Where(adult), ms[1:3])
+	ExpectedEqual(t, c.Where(adult, model.WithDeleted), ms[:3])
+}
+
+func TestQuery_Eq(t *testing.T) {
+	cs, c, ms := testQueryCollection(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	is, err := c.Query().Eq("Age", 30).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[1:3])
+
+	is, err = c.Query().Eq("Age", int64(30)).Eq("Name", "carol").All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[2:3])
+
+	is, err = c.Query().Eq("Id", ms[3].Id()).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[3:])
+
+	_, err = c.Query().Eq("Unknown", 30).All()
+
+	ExpectedError(t, err, "invalid query: unknown field TestCollectionQuery.Unknown")
+
+	_, err = c.Query().Eq("Age", "30").All()
+
+	ExpectedError(t, err, "invalid query: invalid value 30 for field Age (int)")
+}
+
+func TestQuery_Gt(t *testing.T) {
+	cs, c, ms := testQueryCollection(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	is, err := c.Query().Gt("Age", 30).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[:1])
+
+	is, err = c.Query().Gte("Age", 30).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[:3])
+
+	is, err = c.Query().Lt("Age", 30).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[3:])
+
+	is, err = c.Query().Lte("Age", 30).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[1:])
+
+	is, err = c.Query().Gt("CreatedAt", ms[1].CreatedAt()).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[2:])
+
+	_, err = c.Query().Gt("Tags", "a").All()
+
+	ExpectedError(t, err, "invalid query: field Tags ([]string) is not ordered")
+}
+
+func TestQuery_In(t *testing.T) {
+	cs, c, ms := testQueryCollection(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	is, err := c.Query().In("Name", "alice", "dave", "eve").All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{ms[0], ms[3]})
+
+	is, err = c.Query().In("Name").All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 0)
+
+	_, err = c.Query().In("Name", "alice", 42).All()
+
+	ExpectedError(t, err, "invalid query: invalid value 42 for field Name (string)")
+}
+
+func TestQuery_Contains(t *testing.T) {
+	cs, c, ms := testQueryCollection(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	is, err := c.Query().Contains("Name", "a").All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{ms[0], ms[2], ms[3]})
+
+	is, err = c.Query().Contains("Tags", "admin").All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{ms[0], ms[2]})
+
+	is, err = c.Query().Contains("Attrs", "a").All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[:1])
+
+	_, err = c.Query().Contains("Age", 3).All()
+
+	ExpectedError(t, err, "invalid query: field Age (int) can not contain values")
+
+	_, err = c.Query().Contains("Tags", 3).All()
+
+	ExpectedError(t, err, "invalid query: invalid value 3 for field Tags (string)")
+}
+
+func TestQuery_OrderBy(t *testing.T) {
+	cs, c, ms := testQueryCollection(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	is, err := c.Query().OrderBy("Age").All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{ms[3], ms[1], ms[2], ms[0]})
+
+	is, err = c.Query().OrderBy("Age").OrderByDesc("Name").All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{ms[3], ms[2], ms[1], ms[0]})
+
+	is, err = c.Query().OrderByDesc("CreatedAt").All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{ms[3], ms[2], ms[1], ms[0]})
+
+	ExpectedNoError(t, ms[0].Save())
+
+	is, err = c.Query().OrderBy("UpdatedAt").All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, []model.Interface{ms[1], ms[2], ms[3], ms[0]})
+
+	_, err = c.Query().OrderBy("Attrs").All()
+
+	ExpectedError(t, err, "invalid query: field Attrs (map[string]int) is not ordered")
+}
+
+func TestQuery_Limit(t *testing.T) {
+	cs, c, ms := testQueryCollection(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	is, err := c.Query().Limit(2).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[:2])
+
+	is, err = c.Query().Offset(1).Limit(2).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[1:3])
+
+	is, err = c.Query().Offset(3).Limit(-1).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[3:])
+
+	is, err = c.Query().Offset(10).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(is), 0)
+
+	_, err = c.Query().Offset(-1).All()
+
+	ExpectedError(t, err, "invalid query: invalid offset -1")
+}
+
+func TestQuery_Scope(t *testing.T) {
+	cs, c, ms := testQueryCollection(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	ExpectedNoError(t, ms[1].Delete())
+
+	is, err := c.Query().Eq("Age", 30).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[2:3])
+
+	is, err = c.Query().Scope(model.WithDeleted).Eq("Age", 30).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[1:3])
+
+	is, err = c.Query().Scope(model.OnlyDeleted).All()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, is, ms[1:2])
+}
+
+func TestQuery_First(t *testing.T) {
+	cs, c, ms := testQueryCollection(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	i, err := c.Query().OrderByDesc("Age").First()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, i, ms[0])
+
+	_, err = c.Query().Eq("Name", "eve").First()
+
+	ExpectedError(t, err, "model not found")
+
+	_, err = c.Query().Eq("Unknown", "eve").First()
+
+	ExpectedError(t, err, "invalid query: unknown field TestCollectionQuery.Unknown")
+}
+
+func TestQuery_Count(t *testing.T) {
+	cs, c, _ := testQueryCollection(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	n, err := c.Query().Eq("Age", 30).Limit(1).Count()
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, n, 2)
+
+	_, err = c.Query().Eq("Unknown", 30).Count()
+
+	ExpectedError(t, err, "invalid query: unknown field TestCollectionQuery.Unknown")
+}
@@ -0,0 +1,134 @@
+package collection
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"peterdekok.nl/gotools/borm/compress"
+	"peterdekok.nl/gotools/borm/encrypt"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	"reflect"
+)
+
+// compression returns the compressor of the collection and the size below which records are not compressed.
+// The compressor is nil when records are not compressed.
+func (c *Collection) compression() (compress.Compressor, int) {
+	if c.compressor != nil {
+		if c.compressionThreshold == 0 {
+			return c.compressor, compress.DefaultThreshold
+		}
+
+		return c.compressor, c.compressionThreshold
+	}
+
+	return c.root.compressor, c.root.compressionThreshold
+}
+
+// encode marshals the model into the record stored in the database.
+func (c *Collection) encode(i model.Interface) ([]byte, error) {
+	v, err := i.Marshal()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.seal([]byte(i.Id().String()), v)
+}
+
+// seal turns a marshalled model into the record stored with key k, it is reverted by decode.
+// Records are compressed before they are encrypted, as encrypted records do not compress.
+func (c *Collection) seal(k, v []byte) ([]byte, error) {
+	if cp, threshold := c.compression(); cp != nil {
+		var err error
+
+		v, err = compress.Compress(cp, v, threshold)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.root.keyring == nil {
+		return v, nil
+	}
+
+	return c.root.keyring.Encrypt(v, c.ad(k))
+}
+
+// decode returns the marshalled model of the record stored with key k.
+// Records are decrypted and decompressed regardless of the options of the collection, so they can be mixed.
+func (c *Collection) decode(k, v []byte) ([]byte, error) {
+	if encrypt.Encrypted(v) {
+		if c.root.keyring == nil {
+			return nil, errors.New("encrypted record, encryption not enabled")
+		}
+
+		var err error
+
+		v, err = c.root.keyring.Decrypt(v, c.ad(k))
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return compress.Decompress(v)
+}
+
+// unseal returns a new instance of the model stored as record v with key k.
+func (c *Collection) unseal(k, v []byte) (model.Interface, error) {
+	var nmi model.Interface
+
+	nmiV := reflect.ValueOf(&nmi)
+	nmiV.Elem().Set(reflect.New(c.mt))
+
+	v, err := c.decode(k, v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := model.Unmarshal(v, nmi, c); err != nil {
+		return nil, err
+	}
+
+	return nmi, nil
+}
+
+// stored returns a new instance of the model as stored in the database, nil when it is not stored.
+func (c *Collection) stored(tx storage.Tx, id uuid.UUID) (model.Interface, error) {
+	b := tx.Bucket([]byte(c.name))
+
+	if b == nil {
+		return nil, nil
+	}
+
+	k := []byte(id.String())
+	v := b.Get(k)
+
+	if v == nil {
+		return nil, nil
+	}
+
+	return c.unseal(k, v)
+}
+
+// ad returns the additional data records are encrypted with, it binds a record to its collection and key,
+// so encrypted records can not be swapped.
+func (c *Collection) ad(k []byte) []byte {
+	ad := make([]byte, 0, len(c.name)+1+len(k))
+
+	ad = append(ad, c.name...)
+	ad = append(ad, 0)
+
+	return append(ad, k...)
+}
+
+// FieldKeyring returns the keyring a field tagged `borm:"encrypt"` is encrypted with, see WithKeyProvider.
+func (c *Collection) FieldKeyring(field string) (*encrypt.Keyring, error) {
+	if c.root.keys == nil {
+		return nil, errors.New("no key provider")
+	}
+
+	return c.root.keys.FieldKeyring(c.name, field)
+}
@@ -0,0 +1,165 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"peterdekok.nl/gotools/borm/encrypt"
+	"peterdekok.nl/gotools/borm/storage"
+	"sort"
+)
+
+// rotateBatchSize is the number of records re-encrypted per transaction by RotateKey
+var rotateBatchSize = 500
+
+// errBatchFull stops iterating a bucket once a batch is full
+var errBatchFull = errors.New("batch full")
+
+// RotateKey makes the key with the given id the primary key of the keyring and re-encrypts the records
+// of all registered collections with it, see WithEncryption.
+// Records are re-encrypted in batches, each in its own transaction, so other writes are not blocked for long.
+// The previous versions of the models and the records held by the change log are re-encrypted as well,
+// see WithHistory and WithChangeLog.
+// Once it returns, keys which are no longer primary can be removed from the keyring.
+// Buckets of collections which are not registered are not re-encrypted, nor are their entries of the change log.
+func (cs *Collections) RotateKey(id uint32) error {
+	if cs.keyring == nil {
+		err := errors.New("encryption not enabled")
+
+		cs.log.WithError(err).Error("Failed to rotate key")
+
+		return fmt.Errorf("failed to rotate key: %s", err)
+	}
+
+	if cs.store.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	if err := cs.keyring.SetPrimary(id); err != nil {
+		cs.log.WithError(err).Error("Failed to rotate key")
+
+		return fmt.Errorf("failed to rotate key: %s", err)
+	}
+
+	cs.RLock()
+
+	cols := make([]*Collection, 0, len(cs.c))
+
+	for _, c := range cs.c {
+		cols = append(cols, c)
+	}
+
+	cs.RUnlock()
+
+	sort.Slice(cols, func(a, b int) bool {
+		return cols[a].name < cols[b].name
+	})
+
+	for _, c := range cols {
+		n, err := c.rotate(id)
+
+		if err != nil {
+			c.log.WithError(err).Error("Failed to rotate key")
+
+			return fmt.Errorf("failed to rotate key of collection %s: %s", c.name, err)
+		}
+
+		c.log.WithField("key", id).WithField("records", n).Debug("Rotated key")
+	}
+
+	n, err := cs.rotateChanges(id, cols)
+
+	if err != nil {
+		cs.log.WithError(err).Error("Failed to rotate key")
+
+		return fmt.Errorf("failed to rotate key of change log: %s", err)
+	}
+
+	cs.log.WithField("key", id).WithField("changes", n).Debug("Rotated key of change log")
+
+	return nil
+}
+
+// rotate re-encrypts the records and previous versions of the collection which are not encrypted with the key,
+// returning their number.
+func (c *Collection) rotate(id uint32) (int, error) {
+	var after []byte
+
+	total := 0
+
+	for done := false; !done; {
+		err := c.root.store.Update(func(tx storage.Tx) error {
+			b := tx.Bucket([]byte(c.name))
+
+			if b == nil {
+				done = true
+
+				return nil
+			}
+
+			var keys, values [][]byte
+
+			err := b.ForEach(func(k, v []byte) error {
+				// Nested buckets hold the indexes
+				if v == nil || (after != nil && string(k) <= string(after)) {
+					return nil
+				}
+
+				if len(keys) == rotateBatchSize {
+					return errBatchFull
+				}
+
+				if kid, err := encrypt.KeyID(v); err != nil || kid != id {
+					keys = append(keys, append([]byte{}, k...))
+					values = append(values, append([]byte{}, v...))
+				}
+
+				after = append(after[:0], k...)
+
+				return nil
+			})
+
+			if err != nil && err != errBatchFull {
+				return err
+			}
+
+			done = err == nil
+
+			for x, k := range keys {
+				v, err := c.reseal(k, values[x])
+
+				if err != nil {
+					return fmt.Errorf("failed to re-encrypt record %s: %s", k, err)
+				}
+
+				if err := b.Put(k, v); err != nil {
+					return err
+				}
+			}
+
+			total += len(keys)
+
+			return nil
+		})
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	n, err := c.rotateHistory(id)
+
+	return total + n, err
+}
+
+// reseal encrypts the record stored with key k with the primary key, decrypting it first when it is encrypted.
+func (c *Collection) reseal(k, v []byte) ([]byte, error) {
+	if encrypt.Encrypted(v) {
+		var err error
+
+		if v, err = c.root.keyring.Decrypt(v, c.ad(k)); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.root.keyring.Encrypt(v, c.ad(k))
+}
@@ -0,0 +1,281 @@
+package collection
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	"runtime"
+	"strconv"
+)
+
+// Tx persists models of any of the registered collections within a single database transaction.
+// It is only valid within the function passed to Collections.Transaction.
+type Tx struct {
+	cs *Collections
+	tx storage.Tx
+
+	// Functions reverting the in-memory state, in order of the changes
+	undo []func()
+	// Functions called once the transaction is committed, in order of the changes
+	commit []func()
+	// Events sent to the watchers once the transaction is committed
+	events []Event
+
+	// Id of the goroutine which started the transaction
+	owner uint64
+}
+
+// Transaction runs fn within a single database transaction.
+// When fn returns an error or panics, the database changes are discarded,
+// and the collections and timestamps of the models changed through the transaction are reverted.
+//
+// Models should be changed through the methods of the transaction only, the model's own methods start
+// a transaction of their own, which would wait for this one to finish, so within fn they return ErrNestedTransaction.
+// Models are locked after the transaction is started, by the transaction and the model's own methods alike.
+// Changes are visible in the collections before the transaction is committed.
+func (cs *Collections) Transaction(fn func(tx *Tx) error) error {
+	if err := cs.transaction(fn); err != nil {
+		cs.log.WithError(err).Error("Failed to commit transaction")
+
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (cs *Collections) transaction(fn func(tx *Tx) error) error {
+	if cs.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	owner := goroutineID()
+
+	if active, _ := cs.active.Load().(*Tx); active != nil && active.owner == owner {
+		return ErrNestedTransaction
+	}
+
+	t := &Tx{cs: cs, owner: owner}
+
+	err := cs.update(t, fn)
+
+	t.tx = nil
+
+	if err != nil {
+		// Commit failures have not been reverted yet
+		t.rollback()
+
+		return err
+	}
+
+	for _, fn := range t.commit {
+		fn()
+	}
+
+	return nil
+}
+
+// update runs fn within a database transaction, the events of the transaction are sent once it is committed.
+func (cs *Collections) update(t *Tx, fn func(tx *Tx) error) error {
+	cs.commitMu.Lock()
+	defer cs.commitMu.Unlock()
+
+	cs.active.Store(t)
+	defer cs.active.Store((*Tx)(nil))
+
+	err := cs.store.Update(func(tx storage.Tx) error {
+		t.tx = tx
+
+		// Reverted while holding the database lock, so no other transaction observes the changes
+		defer func() {
+			if r := recover(); r != nil {
+				t.rollback()
+
+				panic(r)
+			}
+		}()
+
+		if err := fn(t); err != nil {
+			t.rollback()
+
+			return err
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		cs.emit(t.events)
+	}
+
+	return err
+}
+
+// goroutineID returns the id of the calling goroutine, as listed in its stack trace.
+func goroutineID() uint64 {
+	b := make([]byte, 64)
+	b = b[:runtime.Stack(b, false)]
+
+	// The trace starts with "goroutine <id> [<state>]:"
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+
+	if x := bytes.IndexByte(b, ' '); x >= 0 {
+		b = b[:x]
+	}
+
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+
+	return id
+}
+
+// txCollection persists the models of a collection within a transaction, see Collection.Transact.
+type txCollection struct {
+	*Collection
+
+	t *Tx
+}
+
+func (c *txCollection) Save(i model.Interface) error {
+	return c.saveIn(c.t, i)
+}
+
+func (c *txCollection) Delete(i model.Interface) error {
+	return c.deleteIn(c.t, i)
+}
+
+func (c *txCollection) Restore(i model.Interface) error {
+	return c.restoreIn(c.t, i)
+}
+
+// Transact runs fn within a transaction, the collection passed to fn persists models within it.
+// It implements model.Transactor, so the model's own methods lock the model after the transaction is started.
+// When no transaction can be started, fn runs with the collection itself, which reports the error.
+func (c *Collection) Transact(fn func(c model.CollectionInterface) error) error {
+	started := false
+
+	err := c.root.transaction(func(t *Tx) error {
+		started = true
+
+		return fn(&txCollection{Collection: c, t: t})
+	})
+
+	if !started {
+		return fn(c)
+	}
+
+	return err
+}
+
+// Create embeds the model in the collection and saves it.
+func (t *Tx) Create(ci model.CollectionInterface, i model.Interface) error {
+	if _, err := t.collection(ci); err != nil {
+		return fmt.Errorf("failed to create model: %w", err)
+	}
+
+	if _, err := model.Embed(i, ci); err != nil {
+		return err
+	}
+
+	return t.Save(i)
+}
+
+// Save saves the model within the transaction, see the model's Save method.
+func (t *Tx) Save(i model.Interface) error {
+	c, err := t.collection(i.Collection())
+
+	if err != nil {
+		return fmt.Errorf("failed to save model: %w", err)
+	}
+
+	t.onRollback(model.Snapshot(i))
+
+	err = model.SaveWith(i, func(i model.Interface) error {
+		return c.saveIn(t, i)
+	})
+
+	if h, ok := i.(model.AfterSaver); ok && err == nil {
+		t.onCommit(h.AfterSave)
+	}
+
+	return err
+}
+
+// Delete soft deletes the model within the transaction, see the model's Delete method.
+func (t *Tx) Delete(i model.Interface) error {
+	c, err := t.collection(i.Collection())
+
+	if err != nil {
+		return fmt.Errorf("failed to delete model: %w", err)
+	}
+
+	t.onRollback(model.Snapshot(i))
+
+	err = model.DeleteWith(i, func(i model.Interface) error {
+		return c.deleteIn(t, i)
+	})
+
+	if h, ok := i.(model.AfterDeleter); ok && err == nil {
+		t.onCommit(h.AfterDelete)
+	}
+
+	return err
+}
+
+// Restore reverts the soft delete of the model within the transaction, see the model's Restore method.
+func (t *Tx) Restore(i model.Interface) error {
+	c, err := t.collection(i.Collection())
+
+	if err != nil {
+		return fmt.Errorf("failed to restore model: %w", err)
+	}
+
+	t.onRollback(model.Snapshot(i))
+
+	return model.RestoreWith(i, func(i model.Interface) error {
+		return c.restoreIn(t, i)
+	})
+}
+
+// Purge permanently removes a soft deleted model within the transaction.
+func (t *Tx) Purge(i model.Interface) error {
+	c, err := t.collection(i.Collection())
+
+	if err != nil {
+		return fmt.Errorf("failed to purge model: %w", err)
+	}
+
+	return c.purgeIn(t, i)
+}
+
+// collection resolves a collection registered with the collections of the transaction.
+func (t *Tx) collection(ci model.CollectionInterface) (*Collection, error) {
+	if t.tx == nil {
+		return nil, errors.New("transaction closed")
+	}
+
+	c, ok := ci.(*Collection)
+
+	if !ok || c == nil || c.root != t.cs {
+		return nil, errors.New("collection not part of transaction")
+	}
+
+	return c, nil
+}
+
+func (t *Tx) onRollback(fn func()) {
+	t.undo = append(t.undo, fn)
+}
+
+func (t *Tx) onCommit(fn func()) {
+	t.commit = append(t.commit, fn)
+}
+
+// rollback reverts the in-memory changes, most recent first.
+func (t *Tx) rollback() {
+	for x := len(t.undo) - 1; x >= 0; x-- {
+		t.undo[x]()
+	}
+
+	t.undo = nil
+}
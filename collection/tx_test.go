@@ -0,0 +1,460 @@
+package collection
+
+import (
+	"errors"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+	"time"
+)
+
+type TestTxOrder struct {
+	model.Model
+	Number string `borm:"unique"`
+}
+
+type TestTxLine struct {
+	model.Model
+	Order string `borm:"index"`
+}
+
+type TestTxHooked struct {
+	model.Model
+	calls []string
+}
+
+func (m *TestTxHooked) BeforeSave() error {
+	m.calls = append(m.calls, "BeforeSave")
+
+	return nil
+}
+
+func (m *TestTxHooked) AfterSave() {
+	m.calls = append(m.calls, "AfterSave")
+}
+
+func (m *TestTxHooked) AfterDelete() {
+	m.calls = append(m.calls, "AfterDelete")
+}
+
+func (m *TestTxHooked) AfterLoad() {
+	m.calls = append(m.calls, "AfterLoad")
+}
+
+func TestCollections_Transaction(t *testing.T) {
+	cs, cis := testCollections(t, &TestTxOrder{}, &TestTxLine{})
+
+	orders, lines := cis[0], cis[1]
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	order := &TestTxOrder{Number: "A1"}
+	lineA := &TestTxLine{Order: "A1"}
+	lineB := &TestTxLine{Order: "A1"}
+
+	err := cs.Transaction(func(tx *Tx) error {
+		if err := tx.Create(orders, order); err != nil {
+			return err
+		}
+
+		if err := tx.Create(lines, lineA); err != nil {
+			return err
+		}
+
+		return tx.Create(lines, lineB)
+	})
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, order.Exists(), true)
+	ExpectedEqual(t, orders.Count(), 1)
+	ExpectedEqual(t, lines.Count(), 2)
+
+	err = cs.store.View(func(tx storage.Tx) error {
+		ExpectedNoZeroValue(t, tx.Bucket([]byte("TestTxOrder")).Get([]byte(order.Id().String())))
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	// Using the transaction after it finished
+	var closed *Tx
+
+	ExpectedNoError(t, cs.Transaction(func(tx *Tx) error {
+		closed = tx
+
+		return nil
+	}))
+
+	ExpectedError(t, closed.Save(order), "failed to save model: transaction closed")
+
+	// Collections of other databases are not part of the transaction
+	err = cs.Transaction(func(tx *Tx) error {
+		return tx.Create(&Collection{}, &TestTxLine{})
+	})
+
+	ExpectedError(t, err, "failed to commit transaction: failed to create model: collection not part of transaction")
+}
+
+func TestCollections_Transaction_rollback(t *testing.T) {
+	cs, cis := testCollections(t, &TestTxOrder{}, &TestTxLine{})
+
+	orders, lines := cis[0], cis[1]
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	order := &TestTxOrder{Number: "A1"}
+	line := &TestTxLine{Order: "A1"}
+
+	ExpectedNoError(t, cs.Transaction(func(tx *Tx) error {
+		if err := tx.Create(orders, order); err != nil {
+			return err
+		}
+
+		return tx.Create(lines, line)
+	}))
+
+	orderBackup := order.UpdatedAt()
+	lineBackup := line.UpdatedAt()
+
+	failed := errors.New("failed")
+	added := &TestTxLine{Order: "B1"}
+
+	err := cs.Transaction(func(tx *Tx) error {
+		order.Number = "B1"
+		line.Order = "B1"
+
+		if err := tx.Save(order); err != nil {
+			return err
+		}
+
+		if err := tx.Delete(line); err != nil {
+			return err
+		}
+
+		if err := tx.Create(lines, added); err != nil {
+			return err
+		}
+
+		return failed
+	})
+
+	ExpectedError(t, err, "failed to commit transaction: failed")
+	ExpectedEqualF(t, errors.Is(err, failed), true, true, "expected the error of the function")
+
+	ExpectedEqualF(t, order.UpdatedAt().Equal(orderBackup), true, false, "timestamps should be restored on rollback")
+	ExpectedEqualF(t, line.UpdatedAt().Equal(lineBackup), true, false, "timestamps should be restored on rollback")
+	ExpectedEqual(t, line.Deleted(), false)
+	ExpectedEqual(t, added.Exists(), false)
+
+	ExpectedEqual(t, lines.Count(), 1)
+	ExpectedEqual(t, lines.Count(model.WithDeleted), 1)
+
+	// Indexes and unique constraints are reverted to the persisted values
+	found, err := lines.FindBy("Order", "A1")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(found), 1)
+
+	found, err = lines.FindBy("Order", "B1")
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, len(found), 0)
+
+	ExpectedError(t, orders.Create(&TestTxOrder{Number: "A1"}), "failed to save model: failed to save model: duplicate value for TestTxOrder.Number")
+
+	// Nothing was persisted
+	order.Number = "A1"
+	line.Order = "A1"
+
+	err = cs.store.View(func(tx storage.Tx) error {
+		ExpectedZeroValue(t, tx.Bucket([]byte("TestTxLine")).Get([]byte(added.Id().String())))
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	delete(cs.c, "TestTxLine")
+
+	lines, err = cs.Register(&TestTxLine{})
+
+	ExpectedNoError(t, err)
+
+	loaded, err := lines.Find(line.Id())
+
+	ExpectedNoError(t, err)
+	ExpectedEqualF(t, loaded.UpdatedAt().Equal(lineBackup), true, false, "persisted model should not be changed")
+}
+
+func TestCollections_Transaction_hooks(t *testing.T) {
+	cs, _ := testCollections(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	c, err := cs.Register(&TestTxHooked{})
+
+	ExpectedNoError(t, err)
+
+	m := &TestTxHooked{}
+
+	// After hooks are called once the transaction is committed
+	err = cs.Transaction(func(tx *Tx) error {
+		if err := tx.Create(c, m); err != nil {
+			return err
+		}
+
+		ExpectedEqual(t, m.calls, []string{"BeforeSave"})
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, m.calls, []string{"BeforeSave", "AfterSave"})
+
+	m.calls = nil
+
+	err = cs.Transaction(func(tx *Tx) error {
+		if err := tx.Save(m); err != nil {
+			return err
+		}
+
+		if err := tx.Delete(m); err != nil {
+			return err
+		}
+
+		return errors.New("failed")
+	})
+
+	ExpectedError(t, err, "failed to commit transaction: failed")
+	ExpectedEqual(t, m.calls, []string{"BeforeSave"})
+
+	m.calls = nil
+
+	ExpectedNoError(t, cs.Transaction(func(tx *Tx) error {
+		return tx.Delete(m)
+	}))
+
+	ExpectedEqual(t, m.calls, []string{"AfterDelete"})
+
+	// Loaded models are passed to AfterLoad
+	delete(cs.c, "TestTxHooked")
+
+	c, err = cs.Register(&TestTxHooked{})
+
+	ExpectedNoError(t, err)
+
+	loaded, err := c.Find(m.Id(), model.WithDeleted)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, loaded.(*TestTxHooked).calls, []string{"AfterLoad"})
+}
+
+func TestCollections_Transaction_panic(t *testing.T) {
+	cs, cis := testCollections(t, &TestTxOrder{})
+
+	orders := cis[0]
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	order := &TestTxOrder{Number: "A1"}
+
+	func() {
+		defer func() {
+			ExpectedEqualF(t, recover(), interface{}("panic"), false, "panic should be passed on")
+		}()
+
+		_ = cs.Transaction(func(tx *Tx) error {
+			if err := tx.Create(orders, order); err != nil {
+				return err
+			}
+
+			panic("panic")
+		})
+	}()
+
+	ExpectedEqual(t, order.Exists(), false)
+	ExpectedEqual(t, orders.Count(), 0)
+
+	// The database is usable after the panic
+	ExpectedNoError(t, orders.Create(&TestTxOrder{Number: "A1"}))
+}
+
+func TestCollections_Transaction_concurrent(t *testing.T) {
+	cs, cis := testCollections(t, &TestTxOrder{})
+
+	orders := cis[0]
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	order := &TestTxOrder{Number: "A1"}
+
+	ExpectedNoError(t, orders.Create(order))
+
+	// Saving the model within a transaction and by its own method at the same time should not deadlock
+	done := make(chan error, 2)
+
+	go func() {
+		for x := 0; x < 50; x++ {
+			err := cs.Transaction(func(tx *Tx) error {
+				return tx.Save(order)
+			})
+
+			if err != nil {
+				done <- err
+
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	go func() {
+		for x := 0; x < 50; x++ {
+			if err := order.Save(); err != nil {
+				done <- err
+
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	for x := 0; x < 2; x++ {
+		select {
+		case err := <-done:
+			ExpectedNoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Deadlocked saving the model")
+		}
+	}
+
+	ExpectedEqual(t, order.Version(), uint64(101))
+}
+
+func TestCollections_Transaction_nested(t *testing.T) {
+	cs, cis := testCollections(t, &TestTxOrder{})
+
+	orders := cis[0]
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	order := &TestTxOrder{Number: "A1"}
+	other := &TestTxOrder{Number: "B1"}
+
+	// Persisting models other than through the transaction should fail instead of deadlock
+	done := make(chan error, 1)
+
+	go func() {
+		done <- cs.Transaction(func(tx *Tx) error {
+			if err := tx.Create(orders, order); err != nil {
+				return err
+			}
+
+			updatedAt := order.UpdatedAt()
+
+			err := order.Save()
+
+			ExpectedEqualF(t, errors.Is(err, ErrNestedTransaction), true, false, "expected a nested transaction error")
+			ExpectedEqual(t, order.UpdatedAt(), updatedAt)
+
+			err = order.Delete()
+
+			ExpectedEqualF(t, errors.Is(err, ErrNestedTransaction), true, false, "expected a nested transaction error")
+			ExpectedEqual(t, order.Deleted(), false)
+
+			err = orders.Create(other)
+
+			ExpectedEqualF(t, errors.Is(err, ErrNestedTransaction), true, false, "expected a nested transaction error")
+
+			err = cs.Transaction(func(tx *Tx) error {
+				return nil
+			})
+
+			ExpectedEqualF(t, errors.Is(err, ErrNestedTransaction), true, false, "expected a nested transaction error")
+
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		ExpectedNoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Deadlocked saving the model")
+	}
+
+	ExpectedEqual(t, order.Version(), uint64(1))
+	ExpectedEqual(t, other.Exists(), false)
+	ExpectedEqual(t, orders.Count(), 1)
+
+	// The model's own methods work again once the transaction is committed
+	ExpectedNoError(t, order.Save())
+	ExpectedEqual(t, order.Version(), uint64(2))
+}
+
+func TestCollection_Save_faultyStorage(t *testing.T) {
+	f := storage.NewFaulty(storage.NewMemory())
+
+	opt, err := NewOptions(WithStorage(f))
+
+	ExpectedNoError(t, err)
+
+	cs, err := Open(opt)
+
+	ExpectedNoError(t, err)
+
+	orders, err := cs.Register(&TestTxOrder{})
+
+	ExpectedNoError(t, err)
+
+	failed := errors.New("failed")
+
+	// The commit fails after the model and its indexes were written
+	f.Fail(storage.OpCommit, failed)
+
+	order := &TestTxOrder{Number: "A1"}
+
+	err = orders.Create(order)
+
+	ExpectedEqualF(t, errors.Is(err, failed), true, false, "expected the storage error")
+	ExpectedEqual(t, order.Exists(), false)
+	ExpectedEqual(t, order.Version(), uint64(0))
+	ExpectedEqual(t, orders.Count(), 0)
+
+	f.Reset()
+
+	ExpectedNoError(t, order.Save())
+
+	f.Fail(storage.OpPut, failed)
+
+	order.Number = "B1"
+
+	err = order.Save()
+
+	ExpectedEqualF(t, errors.Is(err, failed), true, false, "expected the storage error")
+	ExpectedEqual(t, order.Version(), uint64(1))
+
+	f.Reset()
+
+	// The unique value of the persisted model is kept
+	ExpectedError(t, orders.Create(&TestTxOrder{Number: "A1"}), "failed to save model: failed to save model: duplicate value for TestTxOrder.Number")
+
+	ExpectedNoError(t, cs.Close())
+}
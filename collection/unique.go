@@ -0,0 +1,169 @@
+package collection
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"peterdekok.nl/gotools/borm/model"
+	"sort"
+	"strings"
+)
+
+// UniqueError is returned when saving a model would violate a unique constraint.
+type UniqueError struct {
+	Collection string
+	Fields     []string
+	// Id of the model already holding the value
+	Id uuid.UUID
+}
+
+// unique is a unique constraint on one or more fields of the collection.
+// Tag `borm:"unique"` makes a single field unique, fields tagged `borm:"unique=name"` are unique combined.
+// Soft deleted models keep their values, so restoring them can not violate the constraint.
+type unique struct {
+	name   string
+	fields []*field
+
+	keys map[uuid.UUID]string
+	ids  map[string]uuid.UUID
+}
+
+func (e *UniqueError) Error() string {
+	return fmt.Sprintf("duplicate value for %s.%s", e.Collection, strings.Join(e.Fields, "+"))
+}
+
+// initUniques creates the unique constraints declared on the fields of the model type.
+func (c *Collection) initUniques() error {
+	groups := make(map[string]*unique)
+
+	for _, f := range c.fields() {
+		name, ok := f.tags["unique"]
+
+		if !ok {
+			continue
+		}
+
+		if !isOrdered(f.typ) {
+			return fmt.Errorf("field %s.%s (%s) can not be unique", c.name, f.name, f.typ)
+		}
+
+		if name == "" {
+			name = f.name
+		}
+
+		u, ok := groups[name]
+
+		if !ok {
+			u = &unique{name: name}
+			u.reset()
+
+			groups[name] = u
+		}
+
+		u.fields = append(u.fields, f)
+	}
+
+	c.uniques = make([]*unique, 0, len(groups))
+
+	for _, u := range groups {
+		c.uniques = append(c.uniques, u)
+	}
+
+	sort.Slice(c.uniques, func(a, b int) bool {
+		return c.uniques[a].name < c.uniques[b].name
+	})
+
+	return nil
+}
+
+// uniqueKeys encodes the values of the unique constraints of a model.
+// An error is returned when a value is already held by another model.
+func (c *Collection) uniqueKeys(i model.Interface) ([]string, error) {
+	keys := make([]string, len(c.uniques))
+
+	for x, u := range c.uniques {
+		keys[x] = u.key(i)
+
+		if id, ok := u.ids[keys[x]]; ok && id != i.Id() {
+			names := make([]string, len(u.fields))
+
+			for n, f := range u.fields {
+				names[n] = f.name
+			}
+
+			return nil, &UniqueError{
+				Collection: c.name,
+				Fields:     names,
+				Id:         id,
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// constrain registers the unique values of a model.
+func (c *Collection) constrain(id uuid.UUID, keys []string) {
+	for x, u := range c.uniques {
+		u.put(id, keys[x])
+	}
+}
+
+// unconstrain releases the unique values of a model.
+func (c *Collection) unconstrain(id uuid.UUID) {
+	for _, u := range c.uniques {
+		u.remove(id)
+	}
+}
+
+// loadUniques rebuilds the unique constraints from the loaded models.
+func (c *Collection) loadUniques() {
+	for _, u := range c.uniques {
+		u.reset()
+	}
+
+	for id, i := range c.m {
+		keys := make([]string, len(c.uniques))
+
+		for x, u := range c.uniques {
+			keys[x] = u.key(i)
+
+			if other, ok := u.ids[keys[x]]; ok && other != id {
+				c.log.WithField("unique", u.name).WithField("id", id).WithField("other", other).Warn("Duplicate value loaded")
+			}
+		}
+
+		c.constrain(id, keys)
+	}
+}
+
+func (u *unique) reset() {
+	u.keys = make(map[uuid.UUID]string)
+	u.ids = make(map[string]uuid.UUID)
+}
+
+func (u *unique) key(i model.Interface) string {
+	var b strings.Builder
+
+	for _, f := range u.fields {
+		b.Write(encodeIndexKey(f.get(i)))
+	}
+
+	return b.String()
+}
+
+func (u *unique) put(id uuid.UUID, key string) {
+	u.remove(id)
+
+	u.keys[id] = key
+	u.ids[key] = id
+}
+
+func (u *unique) remove(id uuid.UUID) {
+	if key, ok := u.keys[id]; ok {
+		delete(u.keys, id)
+
+		if u.ids[key] == id {
+			delete(u.ids, key)
+		}
+	}
+}
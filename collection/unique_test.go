@@ -0,0 +1,124 @@
+package collection
+
+import (
+	"errors"
+	"peterdekok.nl/gotools/borm/model"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+)
+
+type TestCollectionUnique struct {
+	model.Model
+	Email  string `borm:"unique"`
+	Tenant int    `borm:"unique=tenant_name"`
+	Name   string `borm:"unique=tenant_name"`
+}
+
+type TestCollectionUniqueInvalid struct {
+	model.Model
+	Tags []string `borm:"unique"`
+}
+
+func TestCollection_initUniques(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	_, err := cs.Register(&TestCollectionUniqueInvalid{})
+
+	ExpectedError(t, err, "failed to register model: field TestCollectionUniqueInvalid.Tags ([]string) can not be unique")
+
+	c, err := cs.Register(&TestCollectionUnique{})
+
+	ExpectedNoError(t, err)
+
+	cA := c.(*Collection)
+
+	ExpectedEqual(t, len(cA.uniques), 2)
+	ExpectedEqual(t, cA.uniques[0].name, "Email")
+	ExpectedEqual(t, len(cA.uniques[0].fields), 1)
+	ExpectedEqual(t, cA.uniques[1].name, "tenant_name")
+	ExpectedEqual(t, len(cA.uniques[1].fields), 2)
+}
+
+func TestCollection_Save_unique(t *testing.T) {
+	cs, cis := testCollections(t, &TestCollectionUnique{})
+
+	c := cis[0]
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	mA := &TestCollectionUnique{Email: "a@example.com", Tenant: 1, Name: "alice"}
+
+	ExpectedNoError(t, c.Create(mA))
+
+	// Saving the same model again is not a violation
+	ExpectedNoError(t, mA.Save())
+
+	mB := &TestCollectionUnique{Email: "a@example.com", Tenant: 1, Name: "bob"}
+
+	err := c.Create(mB)
+
+	ExpectedError(t, err, "failed to save model: failed to save model: duplicate value for TestCollectionUnique.Email")
+
+	var ue *UniqueError
+
+	ExpectedEqualF(t, errors.As(err, &ue), true, true, "expected a unique error")
+	ExpectedEqual(t, ue.Fields, []string{"Email"})
+	ExpectedEqual(t, ue.Id, mA.Id())
+
+	ExpectedZeroValueF(t, mB.Exists(), false, "model violating a constraint should not be saved")
+
+	mB.Email = "b@example.com"
+	mB.Name = "alice"
+
+	err = mB.Save()
+
+	ExpectedError(t, err, "failed to save model: failed to save model: duplicate value for TestCollectionUnique.Tenant+Name")
+
+	mB.Tenant = 2
+
+	ExpectedNoError(t, mB.Save())
+
+	// Releasing a value by changing it
+	mA.Email = "c@example.com"
+
+	ExpectedNoError(t, mA.Save())
+
+	mB.Email = "a@example.com"
+
+	ExpectedNoError(t, mB.Save())
+
+	// Soft deleted models keep their values
+	ExpectedNoError(t, mB.Delete())
+
+	mC := &TestCollectionUnique{Email: "a@example.com", Tenant: 3}
+
+	err = c.Create(mC)
+
+	ExpectedError(t, err, "failed to save model: failed to save model: duplicate value for TestCollectionUnique.Email")
+
+	// Purged models do not
+	ExpectedNoError(t, c.Purge(mB))
+
+	ExpectedNoError(t, mC.Save())
+
+	// Constraints are rebuilt on load
+	delete(cs.c, "TestCollectionUnique")
+
+	c, err = cs.Register(&TestCollectionUnique{})
+
+	ExpectedNoError(t, err)
+
+	err = c.Create(&TestCollectionUnique{Email: "c@example.com", Tenant: 4})
+
+	ExpectedError(t, err, "failed to save model: failed to save model: duplicate value for TestCollectionUnique.Email")
+}
@@ -0,0 +1,240 @@
+package collection
+
+import (
+	"fmt"
+	"peterdekok.nl/gotools/borm/model"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationError is returned when saving a model which fails validation, it lists every failing field.
+type ValidationError struct {
+	Collection string
+	Fields     []*FieldError
+	// Error returned by the Validate method of the model
+	Err error
+}
+
+// FieldError describes a field failing one of its validation rules.
+type FieldError struct {
+	Field   string
+	Rule    string
+	Message string
+}
+
+// validator holds the validation rules declared on a field of the collection.
+// Tag `borm:"required"` rejects the zero value, `borm:"min=1,max=64"` limit numbers by value and strings,
+// slices and maps by length, `borm:"regex=^[a-z]+$"` matches strings against the expression.
+// The expression may contain commas, so regex should be the last option of the tag.
+type validator struct {
+	f *field
+
+	required bool
+	min, max string
+	regex    *regexp.Regexp
+
+	// Limits of min and max, either values or lengths
+	minV, maxV float64
+	length     bool
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields)+1)
+
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Error())
+	}
+
+	if e.Err != nil {
+		msgs = append(msgs, e.Err.Error())
+	}
+
+	return fmt.Sprintf("invalid %s: %s", e.Collection, strings.Join(msgs, ", "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// initValidators creates the validators declared on the fields of the model type.
+func (c *Collection) initValidators() error {
+	c.validators = make([]*validator, 0)
+
+	for _, f := range c.fields() {
+		v := &validator{f: f}
+
+		_, v.required = f.tags["required"]
+		v.min, v.max = f.tags["min"], f.tags["max"]
+
+		if err := v.init(f.tags); err != nil {
+			return fmt.Errorf("invalid validation of field %s.%s (%s): %s", c.name, f.name, f.typ, err)
+		}
+
+		if v.required || v.min != "" || v.max != "" || v.regex != nil {
+			c.validators = append(c.validators, v)
+		}
+	}
+
+	return nil
+}
+
+func (v *validator) init(tags map[string]string) error {
+	typ := v.f.typ
+
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if v.min != "" || v.max != "" {
+		switch typ.Kind() {
+		case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+			v.length = true
+		default:
+			if !isNumeric(typ.Kind()) {
+				return fmt.Errorf("min and max are not supported")
+			}
+		}
+	}
+
+	var err error
+
+	if v.min != "" {
+		if v.minV, err = v.limit(v.min); err != nil {
+			return err
+		}
+	}
+
+	if v.max != "" {
+		if v.maxV, err = v.limit(v.max); err != nil {
+			return err
+		}
+	}
+
+	if expr, ok := tags["regex"]; ok {
+		if typ.Kind() != reflect.String {
+			return fmt.Errorf("regex is not supported")
+		}
+
+		if v.regex, err = regexp.Compile(expr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// limit parses the value of min or max, lengths should be whole numbers.
+func (v *validator) limit(s string) (float64, error) {
+	if v.length {
+		n, err := strconv.Atoi(s)
+
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid length %s", s)
+		}
+
+		return float64(n), nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit %s", s)
+	}
+
+	return f, nil
+}
+
+// validate validates the model by the validators of the collection and its Validate method.
+// The returned error is a *ValidationError.
+func (c *Collection) validate(i model.Interface) error {
+	var fes []*FieldError
+
+	for _, v := range c.validators {
+		if fe := v.validate(v.f.get(i)); fe != nil {
+			fes = append(fes, fe)
+		}
+	}
+
+	var err error
+
+	if h, ok := i.(model.Validator); ok {
+		err = h.Validate()
+	}
+
+	if len(fes) == 0 && err == nil {
+		return nil
+	}
+
+	return &ValidationError{
+		Collection: c.name,
+		Fields:     fes,
+		Err:        err,
+	}
+}
+
+// validate returns the first rule the value fails, a nil pointer only fails required.
+func (v *validator) validate(rv reflect.Value) *FieldError {
+	if rv.IsZero() && v.required {
+		return v.fail("required", "is required")
+	}
+
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+
+		rv = rv.Elem()
+	}
+
+	if v.min != "" || v.max != "" {
+		var n float64
+
+		switch {
+		case rv.Kind() == reflect.String:
+			n = float64(utf8.RuneCountInString(rv.String()))
+		case v.length:
+			n = float64(rv.Len())
+		case rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64:
+			n = rv.Float()
+		case rv.Kind() >= reflect.Uint && rv.Kind() <= reflect.Uint64:
+			n = float64(rv.Uint())
+		default:
+			n = float64(rv.Int())
+		}
+
+		unit := ""
+
+		if v.length {
+			unit = " long"
+		}
+
+		if v.min != "" && n < v.minV {
+			return v.fail("min", fmt.Sprintf("should be at least %s%s", v.min, unit))
+		}
+
+		if v.max != "" && n > v.maxV {
+			return v.fail("max", fmt.Sprintf("should be at most %s%s", v.max, unit))
+		}
+	}
+
+	if v.regex != nil && !v.regex.MatchString(rv.String()) {
+		return v.fail("regex", fmt.Sprintf("should match %s", v.regex))
+	}
+
+	return nil
+}
+
+func (v *validator) fail(rule, msg string) *FieldError {
+	return &FieldError{
+		Field:   v.f.name,
+		Rule:    rule,
+		Message: msg,
+	}
+}
@@ -0,0 +1,239 @@
+package collection
+
+import (
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"peterdekok.nl/gotools/borm/model"
+	"peterdekok.nl/gotools/borm/storage"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+)
+
+type TestCollectionValidated struct {
+	model.Model
+	Name  string   `borm:"required,min=2,max=8"`
+	Age   int      `borm:"min=18,max=130"`
+	Score *float64 `borm:"max=1.5"`
+	Tags  []string `borm:"max=2"`
+	Code  string   `borm:"regex=^[a-z]{2,3}$"`
+}
+
+func (m *TestCollectionValidated) Validate() error {
+	if m.Name == "root" {
+		return errors.New("Name is reserved")
+	}
+
+	return nil
+}
+
+type TestCollectionValidatedInvalidRule struct {
+	model.Model
+	Active bool `borm:"min=1"`
+}
+
+type TestCollectionValidatedInvalidLength struct {
+	model.Model
+	Name string `borm:"min=1.5"`
+}
+
+type TestCollectionValidatedInvalidRegex struct {
+	model.Model
+	Code string `borm:"regex=["`
+}
+
+type TestCollectionValidatedQuery struct {
+	model.Model
+	Email string `borm:"index"`
+}
+
+// Validate queries the collection of the model, which is not locked yet
+func (m *TestCollectionValidatedQuery) Validate() error {
+	is, err := m.Collection().FindBy("Email", m.Email)
+
+	if err != nil {
+		return err
+	}
+
+	for _, i := range is {
+		if i.Id() != m.Id() {
+			return errors.New("Email is taken")
+		}
+	}
+
+	if _, err := m.Collection().Find(m.Id()); err != nil && m.Collection().Count() >= 2 {
+		return errors.New("too many models")
+	}
+
+	return nil
+}
+
+func TestCollection_initValidators(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	_, err := cs.Register(&TestCollectionValidatedInvalidRule{})
+
+	ExpectedError(t, err, "failed to register model: invalid validation of field TestCollectionValidatedInvalidRule.Active (bool): min and max are not supported")
+
+	_, err = cs.Register(&TestCollectionValidatedInvalidLength{})
+
+	ExpectedError(t, err, "failed to register model: invalid validation of field TestCollectionValidatedInvalidLength.Name (string): invalid length 1.5")
+
+	_, err = cs.Register(&TestCollectionValidatedInvalidRegex{})
+
+	ExpectedError(t, err, "failed to register model: invalid validation of field TestCollectionValidatedInvalidRegex.Code (string): error parsing regexp: missing closing ]: `[`")
+
+	c, err := cs.Register(&TestCollectionValidated{})
+
+	ExpectedNoError(t, err)
+
+	cA := c.(*Collection)
+
+	ExpectedEqual(t, len(cA.validators), 5)
+	ExpectedEqual(t, cA.validators[4].regex.String(), "^[a-z]{2,3}$")
+}
+
+func TestCollection_Save_validation(t *testing.T) {
+	cs := Init(nil)
+
+	defer func() {
+		if err := boltDB(cs).Close(); err != nil {
+			t.Error("Failed to close db")
+
+			t.Fail()
+		}
+	}()
+
+	err := boltDB(cs).Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("TestCollectionValidated"))
+	})
+
+	if err != nil && err != bolt.ErrBucketNotFound {
+		t.Fatal(err)
+	}
+
+	c, err := cs.Register(&TestCollectionValidated{})
+
+	ExpectedNoError(t, err)
+
+	score := 2.0
+
+	m := &TestCollectionValidated{
+		Age:   12,
+		Score: &score,
+		Tags:  []string{"a", "b", "c"},
+		Code:  "abcd",
+	}
+
+	err = c.Create(m)
+
+	ExpectedError(t, err, "failed to save model: failed to save model: invalid TestCollectionValidated: Name is required, Age should be at least 18, Score should be at most 1.5, Tags should be at most 2 long, Code should match ^[a-z]{2,3}$")
+
+	var ve *ValidationError
+
+	ExpectedEqualF(t, errors.As(err, &ve), true, true, "expected a validation error")
+	ExpectedEqual(t, len(ve.Fields), 5)
+	ExpectedEqual(t, ve.Fields[0].Field, "Name")
+	ExpectedEqual(t, ve.Fields[0].Rule, "required")
+	ExpectedEqual(t, ve.Fields[3].Rule, "max")
+
+	ExpectedEqual(t, m.Exists(), false)
+	ExpectedEqual(t, c.Count(), 0)
+
+	// Lengths of strings are counted in characters
+	m.Name = "ééééééééé"
+	m.Age = 18
+	m.Score = nil
+	m.Tags = nil
+	m.Code = "ab"
+
+	ExpectedError(t, m.Save(), "failed to save model: failed to save model: invalid TestCollectionValidated: Name should be at most 8 long")
+
+	m.Name = "éé"
+
+	ExpectedNoError(t, m.Save())
+
+	// Failures restore the timestamps and are not persisted
+	backup := m.UpdatedAt()
+
+	m.Name = "root"
+
+	err = m.Save()
+
+	ExpectedError(t, err, "failed to save model: failed to save model: invalid TestCollectionValidated: Name is reserved")
+	ExpectedEqualF(t, m.UpdatedAt().Equal(backup), true, false, "timestamps should be restored on validation errors")
+	ExpectedEqual(t, m.Version(), uint64(1))
+
+	delete(cs.c, "TestCollectionValidated")
+
+	c, err = cs.Register(&TestCollectionValidated{})
+
+	ExpectedNoError(t, err)
+
+	loaded, err := c.Find(m.Id())
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, loaded.(*TestCollectionValidated).Name, "éé")
+
+	// Models stored before their rules were declared can be deleted and restored, but not saved
+	invalid := loaded.(*TestCollectionValidated)
+	invalid.Name = ""
+
+	cv := c.(*Collection)
+
+	err = cs.store.Update(func(tx storage.Tx) error {
+		return cv.write(tx, invalid, cv.indexKeys(invalid))
+	})
+
+	ExpectedNoError(t, err)
+
+	ExpectedNoError(t, invalid.Delete())
+	ExpectedEqual(t, invalid.Deleted(), true)
+
+	ExpectedNoError(t, invalid.Restore())
+	ExpectedEqual(t, invalid.Deleted(), false)
+
+	ExpectedError(t, invalid.Save(), "failed to save model: failed to save model: invalid TestCollectionValidated: Name is required")
+}
+
+func TestParseTag_regex(t *testing.T) {
+	ExpectedEqual(t, parseTag("required, regex=^a{1,2}$"), map[string]string{"required": "", "regex": "^a{1,2}$"})
+}
+
+func TestCollection_Save_validationQuery(t *testing.T) {
+	cs, err := Open(&Options{memory: true})
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	c, err := cs.Register(&TestCollectionValidatedQuery{})
+
+	ExpectedNoError(t, err)
+
+	m := &TestCollectionValidatedQuery{Email: "a@example.com"}
+
+	ExpectedNoError(t, c.Create(m))
+	ExpectedNoError(t, m.Save())
+
+	err = c.Create(&TestCollectionValidatedQuery{Email: "a@example.com"})
+
+	ExpectedError(t, err, "failed to save model: failed to save model: invalid TestCollectionValidatedQuery: Email is taken")
+
+	ExpectedNoError(t, c.Create(&TestCollectionValidatedQuery{Email: "b@example.com"}))
+
+	err = cs.Transaction(func(tx *Tx) error {
+		return tx.Create(c, &TestCollectionValidatedQuery{Email: "c@example.com"})
+	})
+
+	ExpectedError(t, err, "failed to commit transaction: failed to save model: failed to save model: invalid TestCollectionValidatedQuery: too many models")
+}
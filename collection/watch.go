@@ -0,0 +1,300 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"peterdekok.nl/gotools/borm/model"
+	"time"
+)
+
+// EventType is the kind of change of a model reported by a watch.
+type EventType int
+
+// Types of the changes, a restore reverts a soft delete and a purge removes the model permanently.
+const (
+	Created EventType = iota + 1
+	Updated
+	Deleted
+	Restored
+	Purged
+)
+
+// Event reports a change of a model, it is sent once the transaction of the change is committed.
+type Event struct {
+	Type       EventType
+	Collection string
+	Id         uuid.UUID
+	// Model as stored before the change, nil for created models
+	Old model.Interface
+	// Model as stored after the change, nil for purged models
+	New model.Interface
+	// Time of the change, by the clock of the collections
+	Time time.Time
+	// Number of events dropped for the watcher since the previous event, see SlowConsumerPolicy
+	Dropped int
+}
+
+// Filter selects the events sent to a watcher, it should not block.
+type Filter func(e Event) bool
+
+// SlowConsumerPolicy determines what happens to events which do not fit the buffer of a watcher.
+// Changes are never delayed by a watcher.
+type SlowConsumerPolicy int
+
+const (
+	// DropNewest drops the event, the number of dropped events is reported by the next event sent.
+	DropNewest SlowConsumerPolicy = iota
+	// DropOldest drops the oldest buffered event to make room.
+	DropOldest
+	// Disconnect closes the channel of the watcher.
+	Disconnect
+)
+
+// DefaultWatchBuffer is the number of events buffered for a watcher, see WithWatchBuffer.
+const DefaultWatchBuffer = 64
+
+// WatchOption configures a watcher, see Collections.Watch.
+type WatchOption func(w *watcher)
+
+type watcher struct {
+	// Name of the watched collection, all collections are watched when empty
+	collection string
+	filter     Filter
+	policy     SlowConsumerPolicy
+
+	ch      chan Event
+	size    int
+	dropped int
+
+	// Closed once the watcher is removed
+	done chan struct{}
+}
+
+var eventTypes = map[EventType]string{
+	Created:  "created",
+	Updated:  "updated",
+	Deleted:  "deleted",
+	Restored: "restored",
+	Purged:   "purged",
+}
+
+func (t EventType) String() string {
+	if s, ok := eventTypes[t]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// WithWatchBuffer sets the number of events buffered for the watcher, it defaults to DefaultWatchBuffer.
+func WithWatchBuffer(size int) WatchOption {
+	return func(w *watcher) {
+		w.size = size
+	}
+}
+
+// WithSlowConsumerPolicy sets what happens to events when the buffer of the watcher is full,
+// it defaults to DropNewest.
+func WithSlowConsumerPolicy(p SlowConsumerPolicy) WatchOption {
+	return func(w *watcher) {
+		w.policy = p
+	}
+}
+
+// Watch returns a channel receiving the changes of the models of all registered collections, in order of commit.
+// A nil filter selects all events. The channel is closed when the context is done or the collections are closed.
+func (cs *Collections) Watch(ctx context.Context, filter Filter, opts ...WatchOption) (<-chan Event, error) {
+	ch, err := cs.watch(ctx, "", filter, opts)
+
+	if err != nil {
+		cs.log.WithError(err).Error("Failed to watch collections")
+
+		return nil, fmt.Errorf("failed to watch collections: %s", err)
+	}
+
+	return ch, nil
+}
+
+// Watch returns a channel receiving the changes of the models of the collection, see Collections.Watch.
+func (c *Collection) Watch(ctx context.Context, filter Filter, opts ...WatchOption) (<-chan Event, error) {
+	ch, err := c.root.watch(ctx, c.name, filter, opts)
+
+	if err != nil {
+		c.log.WithError(err).Error("Failed to watch collection")
+
+		return nil, fmt.Errorf("failed to watch collection: %s", err)
+	}
+
+	return ch, nil
+}
+
+func (cs *Collections) watch(ctx context.Context, collection string, filter Filter, opts []WatchOption) (<-chan Event, error) {
+	w := &watcher{
+		collection: collection,
+		filter:     filter,
+		size:       DefaultWatchBuffer,
+		done:       make(chan struct{}),
+	}
+
+	for _, o := range opts {
+		o(w)
+	}
+
+	if w.size < 1 {
+		return nil, fmt.Errorf("invalid watch buffer %d", w.size)
+	}
+
+	if w.policy < DropNewest || w.policy > Disconnect {
+		return nil, fmt.Errorf("invalid slow consumer policy %d", w.policy)
+	}
+
+	w.ch = make(chan Event, w.size)
+
+	cs.watchMu.Lock()
+
+	if cs.watchers == nil {
+		cs.watchers = make(map[*watcher]struct{})
+	}
+
+	cs.watchers[w] = struct{}{}
+
+	cs.watchMu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			cs.watchMu.Lock()
+			defer cs.watchMu.Unlock()
+
+			cs.unwatch(w)
+		case <-w.done:
+		}
+	}()
+
+	return w.ch, nil
+}
+
+// watched reports whether changes of the collection are watched, so their events should be collected.
+func (cs *Collections) watched(collection string) bool {
+	cs.watchMu.Lock()
+	defer cs.watchMu.Unlock()
+
+	for w := range cs.watchers {
+		if w.collection == "" || w.collection == collection {
+			return true
+		}
+	}
+
+	return false
+}
+
+// emit sends the events of a committed transaction to the watchers.
+func (cs *Collections) emit(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	cs.watchMu.Lock()
+	defer cs.watchMu.Unlock()
+
+	for _, e := range events {
+		for w := range cs.watchers {
+			if w.collection != "" && w.collection != e.Collection {
+				continue
+			}
+
+			if w.filter != nil && !w.filter(e) {
+				continue
+			}
+
+			cs.send(w, e)
+		}
+	}
+}
+
+// send sends the event to the watcher, applying its policy when the buffer is full.
+// The watchers should be locked.
+func (cs *Collections) send(w *watcher, e Event) {
+	e.Dropped = w.dropped
+
+	select {
+	case w.ch <- e:
+		w.dropped = 0
+
+		return
+	default:
+	}
+
+	switch w.policy {
+	case DropOldest:
+		// The watcher may have received an event in the meantime
+		select {
+		case <-w.ch:
+			w.dropped++
+		default:
+		}
+
+		e.Dropped = w.dropped
+
+		select {
+		case w.ch <- e:
+			w.dropped = 0
+		default:
+			w.dropped++
+		}
+	case Disconnect:
+		cs.log.WithField("collection", w.collection).Warn("Disconnecting slow watcher")
+
+		cs.unwatch(w)
+	default:
+		w.dropped++
+	}
+}
+
+// unwatch removes the watcher and closes its channel, the watchers should be locked.
+func (cs *Collections) unwatch(w *watcher) {
+	if _, ok := cs.watchers[w]; !ok {
+		return
+	}
+
+	delete(cs.watchers, w)
+
+	close(w.ch)
+	close(w.done)
+}
+
+// unwatchAll removes all watchers.
+func (cs *Collections) unwatchAll() {
+	cs.watchMu.Lock()
+	defer cs.watchMu.Unlock()
+
+	for w := range cs.watchers {
+		cs.unwatch(w)
+	}
+}
+
+// event collects the change of a model in the transaction, old is the model as stored before the change.
+// The collection should be locked.
+func (c *Collection) event(t *Tx, typ EventType, id uuid.UUID, old model.Interface) error {
+	e := Event{
+		Type:       typ,
+		Collection: c.name,
+		Id:         id,
+		Old:        old,
+		Time:       c.Now(),
+	}
+
+	if typ != Purged {
+		var err error
+
+		// A new instance, so later changes of the model do not affect the event
+		if e.New, err = c.stored(t.tx, id); err != nil {
+			return err
+		}
+	}
+
+	t.events = append(t.events, e)
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"peterdekok.nl/gotools/borm/model"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+)
+
+type TestWatchUser struct {
+	model.Model
+	Name string
+}
+
+type TestWatchGroup struct {
+	model.Model
+	Name string
+}
+
+func testWatchCollections(t *testing.T) (*Collections, *Collection, *Collection) {
+	cs, err := Open(&Options{memory: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := cs.Register(&TestWatchUser{})
+
+	ExpectedNoError(t, err)
+
+	groups, err := cs.Register(&TestWatchGroup{})
+
+	ExpectedNoError(t, err)
+
+	return cs, users.(*Collection), groups.(*Collection)
+}
+
+func TestCollection_Watch(t *testing.T) {
+	cs, users, groups := testWatchCollections(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch, err := users.Watch(ctx, nil)
+
+	ExpectedNoError(t, err)
+
+	u := &TestWatchUser{Name: "alice"}
+
+	ExpectedNoError(t, users.Create(u))
+	ExpectedNoError(t, groups.Create(&TestWatchGroup{Name: "admins"}))
+
+	u.Name = "bob"
+
+	ExpectedNoError(t, u.Save())
+	ExpectedNoError(t, u.Delete())
+	ExpectedNoError(t, u.Restore())
+	ExpectedNoError(t, u.Delete())
+	ExpectedNoError(t, users.Purge(u))
+
+	types := []EventType{Created, Updated, Deleted, Restored, Deleted, Purged}
+
+	for _, typ := range types {
+		e := <-ch
+
+		ExpectedEqual(t, e.Type, typ)
+		ExpectedEqual(t, e.Collection, "TestWatchUser")
+		ExpectedEqual(t, e.Id, u.Id())
+		ExpectedEqual(t, e.Dropped, 0)
+		ExpectedEqualF(t, e.Time.IsZero(), false, false, "expected the time of the change")
+	}
+
+	ExpectedEqual(t, len(ch), 0)
+
+	// Old and new values are copies of the stored models
+	u = &TestWatchUser{Name: "carol"}
+
+	ExpectedNoError(t, users.Create(u))
+
+	u.Name = "dave"
+
+	ExpectedNoError(t, u.Save())
+
+	e := <-ch
+
+	ExpectedEqual(t, e.Old, model.Interface(nil))
+	ExpectedEqual(t, e.New.(*TestWatchUser).Name, "carol")
+
+	e = <-ch
+
+	ExpectedEqual(t, e.Old.(*TestWatchUser).Name, "carol")
+	ExpectedEqual(t, e.New.(*TestWatchUser).Name, "dave")
+	ExpectedEqual(t, e.New.Version(), uint64(2))
+	ExpectedEqualF(t, e.New != u, true, false, "expected a copy of the model")
+
+	// Events of rolled back transactions are not sent
+	err = cs.Transaction(func(tx *Tx) error {
+		if err := tx.Create(users, &TestWatchUser{Name: "eve"}); err != nil {
+			return err
+		}
+
+		return errors.New("failed")
+	})
+
+	ExpectedError(t, err, "failed to commit transaction: failed")
+	ExpectedEqual(t, len(ch), 0)
+
+	// Filters select the events
+	filtered, err := users.Watch(ctx, func(e Event) bool {
+		return e.Type == Deleted
+	})
+
+	ExpectedNoError(t, err)
+
+	ExpectedNoError(t, u.Save())
+	ExpectedNoError(t, u.Delete())
+
+	ExpectedEqual(t, (<-filtered).Type, Deleted)
+	ExpectedEqual(t, len(filtered), 0)
+
+	cancel()
+
+	// The channels are closed when the context is done
+	for range ch {
+	}
+
+	_, ok := <-filtered
+
+	ExpectedEqual(t, ok, false)
+
+	_, err = users.Watch(context.Background(), nil, WithWatchBuffer(0))
+
+	ExpectedError(t, err, "failed to watch collection: invalid watch buffer 0")
+
+	_, err = users.Watch(context.Background(), nil, WithSlowConsumerPolicy(SlowConsumerPolicy(3)))
+
+	ExpectedError(t, err, "failed to watch collection: invalid slow consumer policy 3")
+}
+
+func TestCollections_Watch(t *testing.T) {
+	cs, users, groups := testWatchCollections(t)
+
+	ch, err := cs.Watch(context.Background(), nil)
+
+	ExpectedNoError(t, err)
+
+	err = cs.Transaction(func(tx *Tx) error {
+		if err := tx.Create(users, &TestWatchUser{Name: "alice"}); err != nil {
+			return err
+		}
+
+		return tx.Create(groups, &TestWatchGroup{Name: "admins"})
+	})
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqual(t, (<-ch).Collection, "TestWatchUser")
+	ExpectedEqual(t, (<-ch).Collection, "TestWatchGroup")
+
+	// The channels are closed with the collections
+	ExpectedNoError(t, cs.Close())
+
+	_, ok := <-ch
+
+	ExpectedEqual(t, ok, false)
+}
+
+func TestCollections_Watch_slowConsumer(t *testing.T) {
+	cs, users, _ := testWatchCollections(t)
+
+	defer func() {
+		ExpectedNoError(t, cs.Close())
+	}()
+
+	newest, err := cs.Watch(context.Background(), nil, WithWatchBuffer(2))
+
+	ExpectedNoError(t, err)
+
+	oldest, err := cs.Watch(context.Background(), nil, WithWatchBuffer(2), WithSlowConsumerPolicy(DropOldest))
+
+	ExpectedNoError(t, err)
+
+	disconnect, err := cs.Watch(context.Background(), nil, WithWatchBuffer(2), WithSlowConsumerPolicy(Disconnect))
+
+	ExpectedNoError(t, err)
+
+	us := make([]*TestWatchUser, 4)
+
+	for x := range us {
+		us[x] = &TestWatchUser{}
+
+		ExpectedNoError(t, users.Create(us[x]))
+	}
+
+	// The oldest events are dropped to make room
+	e := <-oldest
+
+	ExpectedEqual(t, e.Id, us[2].Id())
+	ExpectedEqual(t, e.Dropped, 1)
+
+	e = <-oldest
+
+	ExpectedEqual(t, e.Id, us[3].Id())
+	ExpectedEqual(t, e.Dropped, 1)
+
+	// The newest events are dropped, the next event reports them
+	ExpectedEqual(t, (<-newest).Id, us[0].Id())
+	ExpectedEqual(t, (<-newest).Id, us[1].Id())
+
+	ExpectedNoError(t, us[0].Save())
+
+	e = <-newest
+
+	ExpectedEqual(t, e.Id, us[0].Id())
+	ExpectedEqual(t, e.Type, Updated)
+	ExpectedEqual(t, e.Dropped, 2)
+
+	e = <-oldest
+
+	ExpectedEqual(t, e.Type, Updated)
+	ExpectedEqual(t, e.Dropped, 0)
+
+	// The slow watcher is disconnected after the buffered events
+	ExpectedEqual(t, (<-disconnect).Id, us[0].Id())
+	ExpectedEqual(t, (<-disconnect).Id, us[1].Id())
+
+	_, ok := <-disconnect
+
+	ExpectedEqual(t, ok, false)
+}
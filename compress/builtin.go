@@ -0,0 +1,94 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+)
+
+var (
+	// Gzip compresses records with compress/gzip.
+	Gzip Compressor = gzipCompressor{}
+	// Snappy compresses records with snappy, it is fast, but compresses less than the others.
+	Snappy Compressor = snappyCompressor{}
+	// Zstd compresses records with zstandard.
+	Zstd Compressor = zstdCompressor{}
+
+	// The zstd encoder and decoder are safe for concurrent use of EncodeAll and DecodeAll
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+type gzipCompressor struct{}
+type snappyCompressor struct{}
+type zstdCompressor struct{}
+
+func (gzipCompressor) ID() byte {
+	return 0x81
+}
+
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (gzipCompressor) Compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+func (snappyCompressor) ID() byte {
+	return 0x82
+}
+
+func (snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (snappyCompressor) Compress(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b), nil
+}
+
+func (snappyCompressor) Decompress(b []byte) ([]byte, error) {
+	return snappy.Decode(nil, b)
+}
+
+func (zstdCompressor) ID() byte {
+	return 0x83
+}
+
+func (zstdCompressor) Name() string {
+	return "zstd"
+}
+
+func (zstdCompressor) Compress(b []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(b, nil), nil
+}
+
+func (zstdCompressor) Decompress(b []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(b, nil)
+}
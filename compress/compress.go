@@ -0,0 +1,138 @@
+// Package compress compresses the records persisted by the collections.
+// Compressed records start with a header byte holding the ID of the compressor, which never collides with
+// the first byte of an uncompressed record, so compressed and uncompressed records can coexist.
+package compress
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Compressor compresses and decompresses records.
+type Compressor interface {
+	// ID is the header byte of every record compressed by the compressor.
+	ID() byte
+	Name() string
+
+	Compress(b []byte) ([]byte, error)
+	Decompress(b []byte) ([]byte, error)
+}
+
+const (
+	// IDs from MinID up to and including MaxID are reserved for compressors, records of codecs start below MinID
+	MinID byte = 0x80
+	MaxID byte = 0xbf
+
+	// IDs from MinCustomID up to and including MaxID are free for custom compressors
+	MinCustomID byte = 0x90
+
+	// DefaultThreshold is the size in bytes below which records are stored uncompressed by default
+	DefaultThreshold = 256
+)
+
+var (
+	compressors = make(map[byte]Compressor)
+	mu          sync.RWMutex
+)
+
+func init() {
+	for _, c := range []Compressor{Gzip, Snappy, Zstd} {
+		compressors[c.ID()] = c
+	}
+}
+
+// Register registers a custom compressor, so records compressed with it can be decompressed.
+func Register(c Compressor) error {
+	if c.ID() < MinCustomID || c.ID() > MaxID {
+		return fmt.Errorf("invalid compressor id %#x for compressor %s", c.ID(), c.Name())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if other, ok := compressors[c.ID()]; ok {
+		return fmt.Errorf("duplicate compressor id %#x for compressors %s and %s", c.ID(), other.Name(), c.Name())
+	}
+
+	compressors[c.ID()] = c
+
+	return nil
+}
+
+// Lookup returns the compressor with the given ID.
+func Lookup(id byte) (Compressor, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	c, ok := compressors[id]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown compressor id %#x", id)
+	}
+
+	return c, nil
+}
+
+// Compressors returns the registered compressors, ordered by ID.
+func Compressors() []Compressor {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	cs := make([]Compressor, 0, len(compressors))
+
+	for _, c := range compressors {
+		cs = append(cs, c)
+	}
+
+	sort.Slice(cs, func(a, b int) bool {
+		return cs[a].ID() < cs[b].ID()
+	})
+
+	return cs
+}
+
+// Compressed reports whether the record is compressed.
+func Compressed(b []byte) bool {
+	return len(b) > 0 && b[0] >= MinID && b[0] <= MaxID
+}
+
+// Compress compresses the record with the compressor, prefixed by the ID of the compressor.
+// Records smaller than threshold, or which do not get smaller, are returned as is.
+func Compress(c Compressor, b []byte, threshold int) ([]byte, error) {
+	if Compressed(b) {
+		return nil, fmt.Errorf("invalid record, header byte %#x is reserved for compressed records", b[0])
+	}
+
+	if len(b) < threshold {
+		return b, nil
+	}
+
+	cb, err := c.Compress(b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cb)+1 >= len(b) {
+		return b, nil
+	}
+
+	return append([]byte{c.ID()}, cb...), nil
+}
+
+// Decompress decompresses the record with the compressor it was compressed with.
+// Uncompressed records are returned as is.
+func Decompress(b []byte) ([]byte, error) {
+	if !Compressed(b) {
+		return b, nil
+	}
+
+	c, err := Lookup(b[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Decompress(b[1:])
+}
@@ -0,0 +1,101 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+)
+
+type TestCompressor struct {
+	id byte
+}
+
+func (c TestCompressor) ID() byte                            { return c.id }
+func (c TestCompressor) Name() string                        { return "test" }
+func (c TestCompressor) Compress(_ []byte) ([]byte, error)   { return nil, errors.New("test") }
+func (c TestCompressor) Decompress(_ []byte) ([]byte, error) { return nil, errors.New("test") }
+
+func TestRegister(t *testing.T) {
+	ExpectedError(t, Register(TestCompressor{id: 0x81}), "invalid compressor id 0x81 for compressor test")
+	ExpectedError(t, Register(TestCompressor{id: 0xc0}), "invalid compressor id 0xc0 for compressor test")
+
+	ExpectedNoError(t, Register(TestCompressor{id: MaxID}))
+
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		delete(compressors, MaxID)
+	}()
+
+	ExpectedError(t, Register(TestCompressor{id: MaxID}), "duplicate compressor id 0xbf for compressors test and test")
+
+	c, err := Lookup(MaxID)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, c, Compressor(TestCompressor{id: MaxID}))
+
+	_, err = Lookup(0xa0)
+
+	ExpectedError(t, err, "unknown compressor id 0xa0")
+
+	cs := Compressors()
+
+	ExpectedEqual(t, len(cs), 4)
+	ExpectedEqual(t, cs[0], Gzip)
+	ExpectedEqual(t, cs[3], Compressor(TestCompressor{id: MaxID}))
+
+	_, err = Compress(TestCompressor{id: MaxID}, bytes.Repeat([]byte("a"), 10), 0)
+
+	ExpectedError(t, err, "test")
+
+	_, err = Decompress([]byte{MaxID, 0x00})
+
+	ExpectedError(t, err, "test")
+}
+
+func TestCompress(t *testing.T) {
+	large := append([]byte(`{"Text":"`), bytes.Repeat([]byte("compress me "), 100)...)
+	small := []byte(`{"Text":"small"}`)
+
+	for _, c := range []Compressor{Gzip, Snappy, Zstd} {
+		b, err := Compress(c, large, DefaultThreshold)
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, b[0], c.ID())
+		ExpectedEqualF(t, len(b) < len(large), true, false, c.Name()+" should compress the record")
+		ExpectedEqual(t, Compressed(b), true)
+
+		d, err := Decompress(b)
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, d, large)
+
+		// Records below the threshold are stored raw
+		b, err = Compress(c, small, DefaultThreshold)
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, b, small)
+		ExpectedEqual(t, Compressed(b), false)
+
+		d, err = Decompress(b)
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, d, small)
+
+		// Records which do not get smaller are stored raw as well
+		b, err = Compress(c, []byte{0x01, 0x02}, 0)
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, b, []byte{0x01, 0x02})
+	}
+
+	_, err := Compress(Gzip, []byte{0x81}, 0)
+
+	ExpectedError(t, err, "invalid record, header byte 0x81 is reserved for compressed records")
+
+	_, err = Decompress([]byte{0xa0})
+
+	ExpectedError(t, err, "unknown compressor id 0xa0")
+}
@@ -0,0 +1,224 @@
+// Package encrypt encrypts the records persisted by the collections with AEAD ciphers.
+// Encrypted records start with a header holding the algorithm and the ID of the key they were encrypted with,
+// so records encrypted with different keys, and unencrypted records, can coexist.
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"sync"
+)
+
+// Algorithm is the AEAD algorithm a key encrypts records with, it is the first byte of encrypted records.
+type Algorithm byte
+
+const (
+	// AESGCM encrypts with AES-GCM, the key should be 16, 24 or 32 bytes
+	AESGCM Algorithm = 0xe1
+	// XChaCha20Poly1305 encrypts with XChaCha20-Poly1305, the key should be 32 bytes
+	XChaCha20Poly1305 Algorithm = 0xe2
+)
+
+// headerSize is the size of the algorithm and the key ID preceding the nonce of encrypted records
+const headerSize = 5
+
+// Keyring holds the keys records are encrypted with.
+// New records are encrypted with the primary key, records are decrypted with the key they were encrypted with.
+type Keyring struct {
+	keys    map[uint32]*key
+	primary uint32
+
+	sync.RWMutex
+}
+
+// KeyProvider provides the keyrings fields tagged `borm:"encrypt"` are encrypted with.
+// A Keyring provides itself for every field.
+type KeyProvider interface {
+	FieldKeyring(collection, field string) (*Keyring, error)
+}
+
+type key struct {
+	alg  Algorithm
+	aead cipher.AEAD
+}
+
+// NewKeyring creates an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys: make(map[uint32]*key),
+	}
+}
+
+// FieldKeyring returns the keyring itself, so a keyring can be used as key provider.
+func (k *Keyring) FieldKeyring(_, _ string) (*Keyring, error) {
+	return k, nil
+}
+
+func (a Algorithm) String() string {
+	switch a {
+	case AESGCM:
+		return "aes-gcm"
+	case XChaCha20Poly1305:
+		return "xchacha20-poly1305"
+	default:
+		return fmt.Sprintf("unknown (%#x)", byte(a))
+	}
+}
+
+func (a Algorithm) aead(secret []byte) (cipher.AEAD, error) {
+	switch a {
+	case AESGCM:
+		b, err := aes.NewCipher(secret)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return cipher.NewGCM(b)
+	case XChaCha20Poly1305:
+		return chacha20poly1305.NewX(secret)
+	default:
+		return nil, fmt.Errorf("unknown algorithm %#x", byte(a))
+	}
+}
+
+// Add adds a key to the keyring, the first key added becomes the primary key.
+func (k *Keyring) Add(id uint32, alg Algorithm, secret []byte) error {
+	aead, err := alg.aead(secret)
+
+	if err != nil {
+		return fmt.Errorf("invalid key %d: %s", id, err)
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("duplicate key %d", id)
+	}
+
+	if len(k.keys) == 0 {
+		k.primary = id
+	}
+
+	k.keys[id] = &key{
+		alg:  alg,
+		aead: aead,
+	}
+
+	return nil
+}
+
+// Remove removes a key from the keyring, records encrypted with it can no longer be decrypted.
+// The primary key can not be removed.
+func (k *Keyring) Remove(id uint32) error {
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("unknown key %d", id)
+	}
+
+	if id == k.primary {
+		return fmt.Errorf("key %d is the primary key", id)
+	}
+
+	delete(k.keys, id)
+
+	return nil
+}
+
+// SetPrimary sets the key new records are encrypted with.
+func (k *Keyring) SetPrimary(id uint32) error {
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("unknown key %d", id)
+	}
+
+	k.primary = id
+
+	return nil
+}
+
+// Primary returns the ID of the key new records are encrypted with.
+func (k *Keyring) Primary() uint32 {
+	k.RLock()
+	defer k.RUnlock()
+
+	return k.primary
+}
+
+// Encrypt encrypts the record with the primary key, ad is authenticated but not encrypted.
+func (k *Keyring) Encrypt(b, ad []byte) ([]byte, error) {
+	k.RLock()
+	id := k.primary
+	ky, ok := k.keys[id]
+	k.RUnlock()
+
+	if !ok {
+		return nil, errors.New("empty keyring")
+	}
+
+	ns := ky.aead.NonceSize()
+
+	out := make([]byte, headerSize+ns, headerSize+ns+len(b)+ky.aead.Overhead())
+
+	out[0] = byte(ky.alg)
+	binary.BigEndian.PutUint32(out[1:headerSize], id)
+
+	if _, err := rand.Read(out[headerSize:]); err != nil {
+		return nil, err
+	}
+
+	return ky.aead.Seal(out, out[headerSize:], b, ad), nil
+}
+
+// Decrypt decrypts the record with the key it was encrypted with, ad should match the ad it was encrypted with.
+func (k *Keyring) Decrypt(b, ad []byte) ([]byte, error) {
+	id, err := KeyID(b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	k.RLock()
+	ky, ok := k.keys[id]
+	k.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key %d", id)
+	}
+
+	if Algorithm(b[0]) != ky.alg {
+		return nil, fmt.Errorf("record encrypted with %s, key %d uses %s", Algorithm(b[0]), id, ky.alg)
+	}
+
+	ns := ky.aead.NonceSize()
+
+	if len(b) < headerSize+ns {
+		return nil, errors.New("invalid encrypted record")
+	}
+
+	return ky.aead.Open(nil, b[headerSize:headerSize+ns], b[headerSize+ns:], ad)
+}
+
+// Encrypted reports whether the record is encrypted.
+func Encrypted(b []byte) bool {
+	return len(b) > 0 && (Algorithm(b[0]) == AESGCM || Algorithm(b[0]) == XChaCha20Poly1305)
+}
+
+// KeyID returns the ID of the key the record was encrypted with.
+func KeyID(b []byte) (uint32, error) {
+	if !Encrypted(b) || len(b) < headerSize {
+		return 0, errors.New("invalid encrypted record")
+	}
+
+	return binary.BigEndian.Uint32(b[1:headerSize]), nil
+}
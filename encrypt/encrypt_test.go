@@ -0,0 +1,110 @@
+package encrypt
+
+import (
+	"bytes"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	k := NewKeyring()
+
+	_, err := k.Encrypt([]byte("record"), nil)
+
+	ExpectedError(t, err, "empty keyring")
+
+	ExpectedError(t, k.Add(1, AESGCM, []byte("short")), "invalid key 1: crypto/aes: invalid key size 5")
+	ExpectedError(t, k.Add(1, XChaCha20Poly1305, []byte("short")), "invalid key 1: chacha20poly1305: bad key length")
+	ExpectedError(t, k.Add(1, Algorithm(0x01), bytes.Repeat([]byte("a"), 32)), "invalid key 1: unknown algorithm 0x1")
+
+	ExpectedNoError(t, k.Add(1, AESGCM, bytes.Repeat([]byte("a"), 16)))
+	ExpectedNoError(t, k.Add(2, XChaCha20Poly1305, bytes.Repeat([]byte("b"), 32)))
+
+	ExpectedError(t, k.Add(2, AESGCM, bytes.Repeat([]byte("b"), 32)), "duplicate key 2")
+
+	// The first key is the primary key
+	ExpectedEqual(t, k.Primary(), uint32(1))
+
+	ExpectedError(t, k.SetPrimary(3), "unknown key 3")
+	ExpectedError(t, k.Remove(3), "unknown key 3")
+	ExpectedError(t, k.Remove(1), "key 1 is the primary key")
+
+	// A keyring provides itself as the keyring of every field
+	fk, err := k.FieldKeyring("collection", "field")
+
+	ExpectedNoError(t, err)
+	ExpectedEqualF(t, fk == k, true, false, "expected the keyring to provide itself")
+}
+
+func TestKeyring_Encrypt(t *testing.T) {
+	k := NewKeyring()
+
+	ExpectedNoError(t, k.Add(1, AESGCM, bytes.Repeat([]byte("a"), 32)))
+	ExpectedNoError(t, k.Add(2, XChaCha20Poly1305, bytes.Repeat([]byte("b"), 32)))
+
+	record := []byte(`{"Name":"secret"}`)
+	ad := []byte("collection")
+
+	for _, id := range []uint32{1, 2} {
+		ExpectedNoError(t, k.SetPrimary(id))
+
+		b, err := k.Encrypt(record, ad)
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, Encrypted(b), true)
+		ExpectedEqualF(t, bytes.Contains(b, []byte("secret")), false, false, "expected the record to be encrypted")
+
+		kid, err := KeyID(b)
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, kid, id)
+
+		// Nonces are random
+		b2, err := k.Encrypt(record, ad)
+
+		ExpectedNoError(t, err)
+		ExpectedNotEqual(t, b2, b)
+
+		d, err := k.Decrypt(b, ad)
+
+		ExpectedNoError(t, err)
+		ExpectedEqual(t, d, record)
+
+		_, err = k.Decrypt(b, []byte("other"))
+
+		ExpectedEqualF(t, err != nil, true, false, "expected records to be bound to their additional data")
+	}
+
+	// Records remain readable with keys which are no longer primary
+	b, err := k.Encrypt(record, ad)
+
+	ExpectedNoError(t, err)
+	ExpectedNoError(t, k.SetPrimary(1))
+	ExpectedNoError(t, k.Remove(2))
+
+	_, err = k.Decrypt(b, ad)
+
+	ExpectedError(t, err, "unknown key 2")
+
+	b, err = k.Encrypt(record, ad)
+
+	ExpectedNoError(t, err)
+
+	b[0] = byte(XChaCha20Poly1305)
+
+	_, err = k.Decrypt(b, ad)
+
+	ExpectedError(t, err, "record encrypted with xchacha20-poly1305, key 1 uses aes-gcm")
+
+	b[0] = byte(AESGCM)
+
+	_, err = k.Decrypt(b[:headerSize+1], ad)
+
+	ExpectedError(t, err, "invalid encrypted record")
+
+	_, err = k.Decrypt(record, ad)
+
+	ExpectedError(t, err, "invalid encrypted record")
+
+	ExpectedEqual(t, Encrypted(nil), false)
+}
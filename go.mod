@@ -3,9 +3,14 @@ module peterdekok.nl/gotools/borm
 go 1.13
 
 require (
+	github.com/fxamacker/cbor/v2 v2.2.0
+	github.com/golang/snappy v0.0.2
 	github.com/google/uuid v1.1.1
+	github.com/klauspost/compress v1.11.0
 	github.com/sirupsen/logrus v1.4.2
-	go.etcd.io/bbolt v1.3.4
+	github.com/vmihailenco/msgpack/v5 v5.0.0
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	peterdekok.nl/gotools/logger v0.0.3
 	peterdekok.nl/gotools/test v0.0.1
 )
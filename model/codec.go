@@ -0,0 +1,528 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"peterdekok.nl/gotools/borm/codec"
+	"peterdekok.nl/gotools/borm/encrypt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// record holds the embedded model in records of codecs other than JSON.
+type record struct {
+	Id        uuid.UUID
+	Version   uint64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt time.Time
+}
+
+// envelope is the record layout of a model type for codecs other than JSON, and for models with encrypted fields.
+// The embedded Model has no exported fields, which not every codec accepts, so it is left out of the instance.
+// Fields tagged `borm:"encrypt"` hold their encrypted value in the instance, including those of embedded structs.
+type envelope struct {
+	typ reflect.Type
+	// Layout records are decoded with, encrypted fields are decoded as is,
+	// as records stored before a field was encrypted hold its plain value
+	raw reflect.Type
+	// Layout of the instance
+	l *layout
+}
+
+// layout maps the fields of a generated struct to the fields of a struct of the model.
+type layout struct {
+	typ reflect.Type
+	raw reflect.Type
+	// Fields of the generated structs, by position
+	slots []slot
+	// Whether the struct holds encrypted fields, directly or in embedded structs
+	encrypted bool
+}
+
+// slot is a field of a generated struct.
+type slot struct {
+	// Index of the field in the struct of the model, through embedded structs
+	index []int
+	// Name of the field when it is encrypted
+	encrypted string
+	// Layout of an embedded struct holding encrypted fields, which is stored as a struct of its own
+	sub *layout
+}
+
+type envelopeKey struct {
+	t reflect.Type
+	// JSON flattens embedded structs, other codecs store them as structs of their own
+	flat bool
+}
+
+var envelopes sync.Map
+
+func envelopeOf(t reflect.Type, flat bool) *envelope {
+	k := envelopeKey{t: t, flat: flat}
+
+	if e, ok := envelopes.Load(k); ok {
+		return e.(*envelope)
+	}
+
+	var l *layout
+
+	if flat {
+		l = flatLayout(t)
+	} else {
+		l = nestedLayout(t, true)
+	}
+
+	e := &envelope{
+		typ: reflect.StructOf([]reflect.StructField{
+			{Name: "Model", Type: reflect.TypeOf(record{})},
+			{Name: "Instance", Type: l.typ},
+		}),
+		raw: reflect.StructOf([]reflect.StructField{
+			{Name: "Model", Type: reflect.TypeOf(record{})},
+			{Name: "Instance", Type: l.raw},
+		}),
+		l: l,
+	}
+
+	envelopes.Store(k, e)
+
+	return e
+}
+
+// isModel reports whether the field holds the embedded Model.
+func isModel(sf reflect.StructField) bool {
+	mt := reflect.TypeOf(Model{})
+
+	return sf.Type == mt || sf.Type == reflect.PtrTo(mt)
+}
+
+// embeddedStruct returns the struct type of an embedded struct field, nil for other fields.
+func embeddedStruct(sf reflect.StructField) reflect.Type {
+	if !sf.Anonymous {
+		return nil
+	}
+
+	ft := sf.Type
+
+	if ft.Kind() == reflect.Ptr {
+		ft = ft.Elem()
+	}
+
+	if ft.Kind() != reflect.Struct {
+		return nil
+	}
+
+	return ft
+}
+
+// flatLayout lays out the exported fields of the model type, including those promoted from embedded structs,
+// like JSON flattens them.
+func flatLayout(t reflect.Type) *layout {
+	names := make([]string, 0, t.NumField())
+
+	var walk func(typ reflect.Type, root bool)
+
+	walk = func(typ reflect.Type, root bool) {
+		for x := 0; x < typ.NumField(); x++ {
+			sf := typ.Field(x)
+
+			if root && isModel(sf) {
+				continue
+			}
+
+			if st := embeddedStruct(sf); st != nil {
+				walk(st, false)
+
+				continue
+			}
+
+			if sf.PkgPath == "" {
+				names = append(names, sf.Name)
+			}
+		}
+	}
+
+	walk(t, true)
+
+	l := &layout{}
+	seen := make(map[string]bool, len(names))
+
+	var sfs, raws []reflect.StructField
+
+	for _, name := range names {
+		// Shadowed and ambiguous fields are left out, as JSON does
+		sf, ok := t.FieldByName(name)
+
+		if !ok || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+
+		typ, raw := sf.Type, sf.Type
+
+		s := slot{index: sf.Index}
+
+		if isEncrypted(sf) {
+			s.encrypted = name
+			l.encrypted = true
+
+			typ, raw = encryptedTypes()
+		}
+
+		sfs = append(sfs, reflect.StructField{Name: name, Type: typ, Tag: sf.Tag})
+		raws = append(raws, reflect.StructField{Name: name, Type: raw, Tag: sf.Tag})
+		l.slots = append(l.slots, s)
+	}
+
+	l.typ = reflect.StructOf(sfs)
+	l.raw = reflect.StructOf(raws)
+
+	return l
+}
+
+// nestedLayout lays out the exported fields of a struct, embedded structs are kept as fields of their own.
+// Embedded structs holding encrypted fields are laid out as well.
+func nestedLayout(t reflect.Type, root bool) *layout {
+	l := &layout{}
+
+	var sfs, raws []reflect.StructField
+
+	for x := 0; x < t.NumField(); x++ {
+		sf := t.Field(x)
+
+		if sf.PkgPath != "" || (root && isModel(sf)) {
+			continue
+		}
+
+		typ, raw := sf.Type, sf.Type
+
+		s := slot{index: sf.Index}
+
+		if isEncrypted(sf) {
+			s.encrypted = sf.Name
+			l.encrypted = true
+
+			typ, raw = encryptedTypes()
+		} else if st := embeddedStruct(sf); st != nil {
+			if sub := nestedLayout(st, false); sub.encrypted {
+				s.sub = sub
+				l.encrypted = true
+
+				typ, raw = sub.typ, sub.raw
+
+				if sf.Type.Kind() == reflect.Ptr {
+					typ, raw = reflect.PtrTo(typ), reflect.PtrTo(raw)
+				}
+			}
+		}
+
+		sfs = append(sfs, reflect.StructField{Name: sf.Name, Type: typ, Tag: sf.Tag})
+		raws = append(raws, reflect.StructField{Name: sf.Name, Type: raw, Tag: sf.Tag})
+		l.slots = append(l.slots, s)
+	}
+
+	l.typ = reflect.StructOf(sfs)
+	l.raw = reflect.StructOf(raws)
+
+	return l
+}
+
+// encryptedTypes returns the types an encrypted field is stored and decoded as.
+func encryptedTypes() (reflect.Type, reflect.Type) {
+	return reflect.TypeOf([]byte{}), reflect.TypeOf((*interface{})(nil)).Elem()
+}
+
+// fieldByIndex returns the field of v by its index through embedded structs.
+// Nil embedded pointers are allocated when alloc is set, otherwise the field is not ok.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for x, i := range index {
+		if x > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				// Pointers to unexported embedded structs can not be set
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+
+			v = v.Elem()
+		}
+
+		v = v.Field(i)
+	}
+
+	return v, true
+}
+
+// isEncrypted reports whether the field is tagged `borm:"encrypt"`.
+func isEncrypted(sf reflect.StructField) bool {
+	for _, opt := range strings.Split(sf.Tag.Get("borm"), ",") {
+		if strings.TrimSpace(opt) == "encrypt" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// codec returns the codec of the collection, models are encoded as JSON by default.
+func (m *Model) codec() codec.Codec {
+	if c, ok := m.c.(interface{ Codec() codec.Codec }); ok && c.Codec() != nil {
+		return c.Codec()
+	}
+
+	return codec.JSON
+}
+
+// marshalEnvelope encodes the model for codecs other than JSON, and for models with encrypted fields.
+func (m *Model) marshalEnvelope(c codec.Codec) ([]byte, error) {
+	iv := reflect.ValueOf(m.i).Elem()
+	e := envelopeOf(iv.Type(), c.ID() == codec.JSON.ID())
+
+	ev := reflect.New(e.typ).Elem()
+
+	ev.Field(0).Set(reflect.ValueOf(record{
+		Id:        m.m.Id,
+		Version:   m.m.Version,
+		CreatedAt: m.m.CreatedAt,
+		UpdatedAt: m.m.UpdatedAt,
+		DeletedAt: m.m.DeletedAt,
+	}))
+
+	if err := m.fill(e.l, ev.Field(1), iv); err != nil {
+		return nil, err
+	}
+
+	return codec.Encode(c, ev.Addr().Interface())
+}
+
+// fill copies the fields of the struct v into the generated struct dst of the layout, encrypting them as needed.
+func (m *Model) fill(l *layout, dst, v reflect.Value) error {
+	for n, s := range l.slots {
+		fv, ok := fieldByIndex(v, s.index, false)
+
+		if !ok {
+			continue
+		}
+
+		switch {
+		case s.encrypted != "":
+			b, err := m.encryptField(s.encrypted, fv)
+
+			if err != nil {
+				return fmt.Errorf("failed to encrypt field %s: %s", s.encrypted, err)
+			}
+
+			dst.Field(n).SetBytes(b)
+		case s.sub != nil && fv.Kind() == reflect.Ptr:
+			if fv.IsNil() {
+				continue
+			}
+
+			sv := reflect.New(s.sub.typ)
+
+			if err := m.fill(s.sub, sv.Elem(), fv.Elem()); err != nil {
+				return err
+			}
+
+			dst.Field(n).Set(sv)
+		case s.sub != nil:
+			if err := m.fill(s.sub, dst.Field(n), fv); err != nil {
+				return err
+			}
+		default:
+			dst.Field(n).Set(fv)
+		}
+	}
+
+	return nil
+}
+
+// unmarshalEnvelope decodes a record of a codec other than JSON, or of a model with encrypted fields.
+func (m *Model) unmarshalEnvelope(b []byte) error {
+	iv := reflect.ValueOf(m.i).Elem()
+
+	cd, err := codec.Of(b)
+
+	if err != nil {
+		return err
+	}
+
+	e := envelopeOf(iv.Type(), cd.ID() == codec.JSON.ID())
+
+	typ := e.raw
+
+	// Gob does not decode values into interface fields they were not encoded from
+	if cd.ID() == codec.Gob.ID() {
+		typ = e.typ
+	}
+
+	ev := reflect.New(typ)
+
+	if _, err := codec.Decode(b, ev.Interface()); err != nil {
+		return err
+	}
+
+	ev = ev.Elem()
+
+	r := ev.Field(0).Interface().(record)
+
+	m.m.Id = r.Id
+	m.m.Version = r.Version
+	m.m.CreatedAt = r.CreatedAt
+	m.m.UpdatedAt = r.UpdatedAt
+	m.m.DeletedAt = r.DeletedAt
+
+	return m.extract(cd, e.l, ev.Field(1), iv)
+}
+
+// extract copies the fields of the generated struct src of the layout into the struct v, decrypting them as needed.
+func (m *Model) extract(cd codec.Codec, l *layout, src, v reflect.Value) error {
+	for n, s := range l.slots {
+		sv := src.Field(n)
+
+		// Embedded pointers are only allocated for values, like JSON does
+		fv, ok := fieldByIndex(v, s.index, !sv.IsZero())
+
+		if !ok {
+			continue
+		}
+
+		switch {
+		case s.encrypted != "":
+			if err := m.decodeField(cd, s.encrypted, sv.Interface(), fv); err != nil {
+				return fmt.Errorf("failed to decrypt field %s: %s", s.encrypted, err)
+			}
+		case s.sub != nil && fv.Kind() == reflect.Ptr:
+			fv.Set(reflect.Zero(fv.Type()))
+
+			if sv.IsNil() {
+				continue
+			}
+
+			fv.Set(reflect.New(fv.Type().Elem()))
+
+			if err := m.extract(cd, s.sub, sv.Elem(), fv.Elem()); err != nil {
+				return err
+			}
+		case s.sub != nil:
+			if err := m.extract(cd, s.sub, sv, fv); err != nil {
+				return err
+			}
+		default:
+			fv.Set(sv)
+		}
+	}
+
+	return nil
+}
+
+// fieldKeyring returns the keyring of an encrypted field, provided by the collection.
+func (m *Model) fieldKeyring(name string) (*encrypt.Keyring, error) {
+	c, ok := m.c.(interface {
+		FieldKeyring(field string) (*encrypt.Keyring, error)
+	})
+
+	if !ok {
+		return nil, errors.New("no key provider")
+	}
+
+	return c.FieldKeyring(name)
+}
+
+// fieldAD returns the additional data a field is encrypted with, it binds the value to the model and the field.
+func (m *Model) fieldAD(name string) []byte {
+	return []byte(m.m.Id.String() + "." + name)
+}
+
+// encryptField encrypts the JSON encoding of the value of a field.
+func (m *Model) encryptField(name string, v reflect.Value) ([]byte, error) {
+	k, err := m.fieldKeyring(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(v.Interface())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return k.Encrypt(b, m.fieldAD(name))
+}
+
+// decodeField decodes the stored value of an encrypted field into v.
+// Values stored before the field was encrypted are decoded as plain values, they are encrypted once the model is saved.
+func (m *Model) decodeField(cd codec.Codec, name string, raw interface{}, v reflect.Value) error {
+	if b, ok := ciphertext(raw); ok || raw == nil {
+		return m.decryptField(name, b, v)
+	}
+
+	// Encoded again, so the value is decoded into the type of the field by the codec of the record
+	b, err := cd.Marshal(raw)
+
+	if err != nil {
+		return err
+	}
+
+	v.Set(reflect.Zero(v.Type()))
+
+	return cd.Unmarshal(b, v.Addr().Interface())
+}
+
+// ciphertext returns the stored value of an encrypted field, which JSON holds base64 encoded.
+// It is not ok for plain values, stored before the field was encrypted.
+func ciphertext(raw interface{}) ([]byte, bool) {
+	var b []byte
+
+	switch t := raw.(type) {
+	case []byte:
+		b = t
+	case string:
+		var err error
+
+		if b, err = base64.StdEncoding.DecodeString(t); err != nil {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	return b, len(b) == 0 || encrypt.Encrypted(b)
+}
+
+// decryptField decrypts the value of a field into v, an empty value results in the zero value.
+func (m *Model) decryptField(name string, b []byte, v reflect.Value) error {
+	v.Set(reflect.Zero(v.Type()))
+
+	if len(b) == 0 {
+		return nil
+	}
+
+	k, err := m.fieldKeyring(name)
+
+	if err != nil {
+		return err
+	}
+
+	b, err = k.Decrypt(b, m.fieldAD(name))
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v.Addr().Interface())
+}
+
+func (m *Model) hasEncryptedFields() bool {
+	return envelopeOf(reflect.TypeOf(m.i).Elem(), true).l.encrypted
+}
@@ -0,0 +1,77 @@
+package model
+
+// Models can implement the hook interfaces below to be called when they are created, saved, deleted or loaded,
+// by their own Save and Delete methods and by transactions alike.
+// Before hooks are called while the model is locked and stamped, an error aborts the operation and restores the timestamps.
+// After hooks are called once the model is persisted and unlocked, in transactions once the transaction is committed.
+
+// BeforeCreator is called before a new model is saved, before BeforeSave.
+type BeforeCreator interface {
+	BeforeCreate() error
+}
+
+// BeforeSaver is called before a model is saved.
+type BeforeSaver interface {
+	BeforeSave() error
+}
+
+// AfterSaver is called after a model is saved.
+type AfterSaver interface {
+	AfterSave()
+}
+
+// BeforeDeleter is called before a model is soft deleted.
+type BeforeDeleter interface {
+	BeforeDelete() error
+}
+
+// AfterDeleter is called after a model is soft deleted.
+type AfterDeleter interface {
+	AfterDelete()
+}
+
+// Validator is called by the collection before a model is persisted, after the validation rules of its struct tags.
+// An error aborts the operation, it is reported by the ValidationError of the collection.
+// It is called before the collection is locked, so it can query the collection of the model.
+type Validator interface {
+	Validate() error
+}
+
+// AfterLoader is called after a model is loaded from the database by its collection, while the collection is locked.
+type AfterLoader interface {
+	AfterLoad()
+}
+
+func (m *Model) beforeSave(create bool) error {
+	if h, ok := m.i.(BeforeCreator); ok && create {
+		if err := h.BeforeCreate(); err != nil {
+			return err
+		}
+	}
+
+	if h, ok := m.i.(BeforeSaver); ok {
+		return h.BeforeSave()
+	}
+
+	return nil
+}
+
+func (m *Model) beforeDelete() error {
+	if h, ok := m.i.(BeforeDeleter); ok {
+		return h.BeforeDelete()
+	}
+
+	return nil
+}
+
+func (m *Model) afterSave() {
+	if h, ok := m.i.(AfterSaver); ok {
+		h.AfterSave()
+	}
+}
+
+func (m *Model) afterDelete() {
+	if h, ok := m.i.(AfterDeleter); ok {
+		h.AfterDelete()
+	}
+}
@@ -14,13 +14,17 @@ type Interface interface {
 	CreatedAt() time.Time
 	UpdatedAt() time.Time
 	DeletedAt() time.Time
+	Version() uint64
 
 	Collection() CollectionInterface
 	Exists() bool
+	Deleted() bool
 
 	Marshal() ([]byte, error)
 	Unmarshal(b []byte) error
 	Save() error
+	Delete() error
+	Restore() error
 
 	sync.Locker
 }
@@ -29,6 +33,82 @@ type CollectionInterface interface {
 	Load() error
 	Create(i Interface) error
 	Save(i Interface) error
+	Delete(i Interface) error
+	Restore(i Interface) error
+	Purge(i Interface) error
+	PurgeDeletedBefore(t time.Time) (int, error)
+
+	Find(id uuid.UUID, scope ...Scope) (Interface, error)
+	MustFind(id uuid.UUID, scope ...Scope) Interface
+	All(scope ...Scope) []Interface
+	Count(scope ...Scope) int
+	Each(fn func(i Interface) bool, scope ...Scope)
+	FindBy(field string, v interface{}, scope ...Scope) ([]Interface, error)
+	FindRange(field string, from, to interface{}, scope ...Scope) ([]Interface, error)
+	Where(fn func(i Interface) bool, scope ...Scope) []Interface
+	Query() QueryInterface
+}
+
+// Transactor is implemented by collections which persist models in transactions, which lock the models they change.
+// The model's own methods persist through the collection passed to fn, within a transaction started
+// before the model is locked, so models are always locked after the transaction is started.
+type Transactor interface {
+	Transact(fn func(c CollectionInterface) error) error
+}
+
+// QueryInterface filters, orders and pages the models of a collection.
+// Fields are referenced by name, errors are reported once the query is executed.
+type QueryInterface interface {
+	Scope(s Scope) QueryInterface
+	Where(fn func(i Interface) bool) QueryInterface
+	Eq(field string, v interface{}) QueryInterface
+	Gt(field string, v interface{}) QueryInterface
+	Gte(field string, v interface{}) QueryInterface
+	Lt(field string, v interface{}) QueryInterface
+	Lte(field string, v interface{}) QueryInterface
+	In(field string, vs ...interface{}) QueryInterface
+	Contains(field string, v interface{}) QueryInterface
+	OrderBy(field string) QueryInterface
+	OrderByDesc(field string) QueryInterface
+	Limit(n int) QueryInterface
+	Offset(n int) QueryInterface
+
+	All() ([]Interface, error)
+	First() (Interface, error)
+	Count() (int, error)
+}
+
+// Scope selects which models a lookup considers with regard to soft deletes.
+type Scope int
+
+const (
+	// WithoutDeleted hides soft deleted models, this is the default for all lookups
+	WithoutDeleted Scope = iota
+	// WithDeleted includes soft deleted models
+	WithDeleted
+	// OnlyDeleted only includes soft deleted models
+	OnlyDeleted
+)
+
+// ScopeOf returns the scope passed to a lookup, defaulting to WithoutDeleted.
+func ScopeOf(scope []Scope) Scope {
+	if len(scope) == 0 {
+		return WithoutDeleted
+	}
+
+	return scope[0]
+}
+
+// Includes reports whether the model is part of the scope.
+func (s Scope) Includes(i Interface) bool {
+	switch s {
+	case WithDeleted:
+		return true
+	case OnlyDeleted:
+		return i.Deleted()
+	default:
+		return !i.Deleted()
+	}
 }
 
 func CheckInterface(i Interface) (reflect.Value, reflect.Value, error) {
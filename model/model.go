@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"peterdekok.nl/gotools/borm/codec"
 	"peterdekok.nl/gotools/logger"
 	"reflect"
 	"sync"
@@ -13,7 +14,9 @@ import (
 )
 
 type model struct {
-	Id        uuid.UUID
+	Id uuid.UUID
+	// Incremented by the collection on every save, used to detect conflicting saves
+	Version uint64
 	*timestamps
 }
 
@@ -62,7 +65,7 @@ func Embed(i Interface, c CollectionInterface) (Interface, error) {
 
 	m := &Model{
 		m: &model{
-			Id:        id,
+			Id: id,
 			timestamps: &timestamps{
 				CreatedAt: time.Time{},
 				UpdatedAt: time.Time{},
@@ -91,22 +94,34 @@ func Unmarshal(b []byte, i Interface, c CollectionInterface) (Interface, error)
 	return i, i.Unmarshal(b)
 }
 
+// Marshal encodes the model with the codec of its collection, JSON by default.
 func (m *Model) Marshal() ([]byte, error) {
 	if m == nil || m.m == nil {
 		return nil, errors.New("failed to marshal, nil receiver")
 	}
 
-	return json.Marshal(&marshaller{
+	c := m.codec()
+
+	if c.ID() != codec.JSON.ID() || m.hasEncryptedFields() {
+		return m.marshalEnvelope(c)
+	}
+
+	return codec.Encode(c, &marshaller{
 		Model:    m.m,
 		Instance: m.i,
 	})
 }
 
+// Unmarshal decodes the model with the codec it was encoded with.
 func (m *Model) Unmarshal(b []byte) error {
 	if m == nil || m.m == nil {
 		return errors.New("failed to unmarshal, nil receiver")
 	}
 
+	if len(b) > 0 && (b[0] != codec.JSON.ID() || m.hasEncryptedFields()) {
+		return m.unmarshalEnvelope(b)
+	}
+
 	return json.Unmarshal(b, &marshaller{
 		Model:    m.m,
 		Instance: m.i,
@@ -145,6 +160,15 @@ func (m *Model) DeletedAt() time.Time {
 	return m.m.DeletedAt
 }
 
+// Version returns the number of times the model has been saved.
+func (m *Model) Version() uint64 {
+	if m == nil || m.m == nil {
+		return 0
+	}
+
+	return m.m.Version
+}
+
 func (m *Model) Collection() CollectionInterface {
 	if m == nil {
 		return nil
@@ -161,7 +185,132 @@ func (m *Model) Exists() bool {
 	return !m.m.CreatedAt.IsZero()
 }
 
+func (m *Model) Deleted() bool {
+	if m == nil || m.m == nil {
+		return false
+	}
+
+	return !m.m.DeletedAt.IsZero()
+}
+
 func (m *Model) Save() error {
+	err := m.transact(func(c CollectionInterface) error {
+		return m.save(func(i Interface) error {
+			return c.Save(i)
+		})
+	})
+
+	if err == nil {
+		m.afterSave()
+	}
+
+	return err
+}
+
+// Delete soft deletes the model by stamping DeletedAt and persisting it.
+// The record itself is kept, it can be brought back with Restore.
+func (m *Model) Delete() error {
+	err := m.transact(func(c CollectionInterface) error {
+		return m.delete(func(i Interface) error {
+			return c.Delete(i)
+		})
+	})
+
+	if err == nil {
+		m.afterDelete()
+	}
+
+	return err
+}
+
+// Restore reverts a soft delete by clearing DeletedAt and persisting it.
+func (m *Model) Restore() error {
+	return m.transact(func(c CollectionInterface) error {
+		return m.restore(func(i Interface) error {
+			return c.Restore(i)
+		})
+	})
+}
+
+// transact runs fn within a transaction of the collection when it is a Transactor, see Transactor.
+// Timestamps and version are reverted when the transaction fails to commit after fn succeeded.
+func (m *Model) transact(fn func(c CollectionInterface) error) error {
+	if m == nil || m.m == nil {
+		return fn(nil)
+	}
+
+	t, ok := m.c.(Transactor)
+
+	if !ok {
+		return fn(m.c)
+	}
+
+	var (
+		revert func()
+		fnErr  error
+	)
+
+	err := t.Transact(func(c CollectionInterface) error {
+		revert = Snapshot(m.i)
+		fnErr = fn(c)
+
+		return fnErr
+	})
+
+	if err != nil && fnErr == nil && revert != nil {
+		revert()
+	}
+
+	return err
+}
+
+// SaveWith saves the model like its Save method, but persists it through fn instead of its collection.
+// The AfterSave hook is not called, as the model may not be persisted until fn's changes are committed.
+func SaveWith(i Interface, fn func(i Interface) error) error {
+	return embedded(i).save(fn)
+}
+
+// DeleteWith deletes the model like its Delete method, but persists it through fn instead of its collection.
+// The AfterDelete hook is not called, as the model may not be persisted until fn's changes are committed.
+func DeleteWith(i Interface, fn func(i Interface) error) error {
+	return embedded(i).delete(fn)
+}
+
+// RestoreWith restores the model like its Restore method, but persists it through fn instead of its collection.
+func RestoreWith(i Interface, fn func(i Interface) error) error {
+	return embedded(i).restore(fn)
+}
+
+// SetVersion sets the version of the model, it is advanced by the collection when the model is saved.
+// The model should be locked by the caller.
+func SetVersion(i Interface, v uint64) {
+	if m := embedded(i); m != nil && m.m != nil {
+		m.m.Version = v
+	}
+}
+
+// Snapshot captures the persisted state of the model, the returned function reverts the model to it.
+func Snapshot(i Interface) func() {
+	m := embedded(i)
+
+	if m == nil || m.m == nil {
+		return func() {}
+	}
+
+	m.Lock()
+	backup := m.m.BackupTimestamps()
+	version := m.m.Version
+	m.Unlock()
+
+	return func() {
+		m.Lock()
+		m.m.RestoreTimestamps(backup)
+		m.m.Version = version
+		m.Unlock()
+	}
+}
+
+func (m *Model) save(persist func(i Interface) error) error {
 	if m == nil || m.m == nil {
 		err := errors.New("model not initialized")
 
@@ -173,20 +322,143 @@ func (m *Model) Save() error {
 	m.Lock()
 	defer m.Unlock()
 
+	create := !m.Exists()
+
 	backup := m.m.BackupTimestamps()
 
-	m.m.UpdatedAt = time.Now()
+	m.m.UpdatedAt = m.now()
 
-	if !m.Exists() {
+	if create {
 		m.m.CreatedAt = m.m.UpdatedAt
 	}
 
-	if err := m.c.Save(m); err != nil {
+	if err := m.beforeSave(create); err != nil {
 		m.m.RestoreTimestamps(backup)
 
 		m.log.WithError(err).Error("Failed to save model")
 
-		return fmt.Errorf("failed to save model: %s", err)
+		return fmt.Errorf("failed to save model: %w", err)
+	}
+
+	if err := persist(m.i); err != nil {
+		m.m.RestoreTimestamps(backup)
+
+		m.log.WithError(err).Error("Failed to save model")
+
+		return fmt.Errorf("failed to save model: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Model) delete(persist func(i Interface) error) error {
+	if m == nil || m.m == nil {
+		err := errors.New("model not initialized")
+
+		log.WithError(err).Error("Failed to delete model")
+
+		return fmt.Errorf("failed to delete model: %s", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.checkDeletable(); err != nil {
+		m.log.WithError(err).Error("Failed to delete model")
+
+		return fmt.Errorf("failed to delete model: %s", err)
+	}
+
+	backup := m.m.BackupTimestamps()
+
+	m.m.UpdatedAt = m.now()
+	m.m.DeletedAt = m.m.UpdatedAt
+
+	if err := m.beforeDelete(); err != nil {
+		m.m.RestoreTimestamps(backup)
+
+		m.log.WithError(err).Error("Failed to delete model")
+
+		return fmt.Errorf("failed to delete model: %w", err)
+	}
+
+	if err := persist(m.i); err != nil {
+		m.m.RestoreTimestamps(backup)
+
+		m.log.WithError(err).Error("Failed to delete model")
+
+		return fmt.Errorf("failed to delete model: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Model) restore(persist func(i Interface) error) error {
+	if m == nil || m.m == nil {
+		err := errors.New("model not initialized")
+
+		log.WithError(err).Error("Failed to restore model")
+
+		return fmt.Errorf("failed to restore model: %s", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.Deleted() {
+		err := errors.New("model not deleted")
+
+		m.log.WithError(err).Error("Failed to restore model")
+
+		return fmt.Errorf("failed to restore model: %s", err)
+	}
+
+	backup := m.m.BackupTimestamps()
+
+	m.m.UpdatedAt = m.now()
+	m.m.DeletedAt = time.Time{}
+
+	if err := persist(m.i); err != nil {
+		m.m.RestoreTimestamps(backup)
+
+		m.log.WithError(err).Error("Failed to restore model")
+
+		return fmt.Errorf("failed to restore model: %w", err)
+	}
+
+	return nil
+}
+
+// embedded returns the embedded Model of a model.
+// The method is promoted by embedding, it can only be called from within this package.
+func (m *Model) embedded() *Model {
+	return m
+}
+
+func embedded(i Interface) *Model {
+	if e, ok := i.(interface{ embedded() *Model }); ok {
+		return e.embedded()
+	}
+
+	return nil
+}
+
+// now returns the current time from the collection when it has a clock, e.g. collection.WithClock.
+func (m *Model) now() time.Time {
+	if c, ok := m.c.(interface{ Now() time.Time }); ok {
+		return c.Now()
+	}
+
+	return time.Now()
+}
+
+func (m *Model) checkDeletable() error {
+	if !m.Exists() {
+		return errors.New("model does not exist")
+	}
+
+	if m.Deleted() {
+		return errors.New("model already deleted")
 	}
 
 	return nil
@@ -204,4 +476,4 @@ func (t *timestamps) RestoreTimestamps(backup timestamps) {
 	t.CreatedAt = backup.CreatedAt
 	t.UpdatedAt = backup.UpdatedAt
 	t.DeletedAt = backup.DeletedAt
-}
\ No newline at end of file
+}
@@ -1,10 +1,13 @@
 package model
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"peterdekok.nl/gotools/borm/codec"
+	"peterdekok.nl/gotools/borm/encrypt"
 	. "peterdekok.nl/gotools/test"
 	"testing"
 	"time"
@@ -23,11 +26,15 @@ func (m TestModelInterfaceNoModel) Id() uuid.UUID                   { return uui
 func (m TestModelInterfaceNoModel) CreatedAt() time.Time            { return time.Time{} }
 func (m TestModelInterfaceNoModel) UpdatedAt() time.Time            { return time.Time{} }
 func (m TestModelInterfaceNoModel) DeletedAt() time.Time            { return time.Time{} }
+func (m TestModelInterfaceNoModel) Version() uint64                 { return 0 }
 func (m TestModelInterfaceNoModel) Exists() bool                    { return true }
+func (m TestModelInterfaceNoModel) Deleted() bool                   { return false }
 func (m TestModelInterfaceNoModel) Collection() CollectionInterface { return nil }
 func (m TestModelInterfaceNoModel) Marshal() ([]byte, error)        { return nil, nil }
 func (m TestModelInterfaceNoModel) Unmarshal(b []byte) error        { return nil }
 func (m TestModelInterfaceNoModel) Save() error                     { return errors.New("error") }
+func (m TestModelInterfaceNoModel) Delete() error                   { return errors.New("error") }
+func (m TestModelInterfaceNoModel) Restore() error                  { return errors.New("error") }
 func (m TestModelInterfaceNoModel) Lock()                           {}
 func (m TestModelInterfaceNoModel) Unlock()                         {}
 
@@ -37,11 +44,15 @@ func (m *TestModelPtrToInt) Id() uuid.UUID                   { return uuid.New()
 func (m *TestModelPtrToInt) CreatedAt() time.Time            { return time.Time{} }
 func (m *TestModelPtrToInt) UpdatedAt() time.Time            { return time.Time{} }
 func (m *TestModelPtrToInt) DeletedAt() time.Time            { return time.Time{} }
+func (m *TestModelPtrToInt) Version() uint64                 { return 0 }
 func (m *TestModelPtrToInt) Exists() bool                    { return true }
+func (m *TestModelPtrToInt) Deleted() bool                   { return false }
 func (m *TestModelPtrToInt) Collection() CollectionInterface { return nil }
 func (m *TestModelPtrToInt) Marshal() ([]byte, error)        { return nil, nil }
 func (m *TestModelPtrToInt) Unmarshal(_ []byte) error        { return nil }
 func (m *TestModelPtrToInt) Save() error                     { return errors.New("error") }
+func (m *TestModelPtrToInt) Delete() error                   { return errors.New("error") }
+func (m *TestModelPtrToInt) Restore() error                  { return errors.New("error") }
 func (m *TestModelPtrToInt) Lock()                           {}
 func (m *TestModelPtrToInt) Unlock()                         {}
 
@@ -51,11 +62,15 @@ func (m *TestModelStructWrongTypeEmbed) Id() uuid.UUID                   { retur
 func (m *TestModelStructWrongTypeEmbed) CreatedAt() time.Time            { return time.Time{} }
 func (m *TestModelStructWrongTypeEmbed) UpdatedAt() time.Time            { return time.Time{} }
 func (m *TestModelStructWrongTypeEmbed) DeletedAt() time.Time            { return time.Time{} }
+func (m *TestModelStructWrongTypeEmbed) Version() uint64                 { return 0 }
 func (m *TestModelStructWrongTypeEmbed) Exists() bool                    { return true }
+func (m *TestModelStructWrongTypeEmbed) Deleted() bool                   { return false }
 func (m *TestModelStructWrongTypeEmbed) Collection() CollectionInterface { return nil }
 func (m *TestModelStructWrongTypeEmbed) Marshal() ([]byte, error)        { return nil, nil }
 func (m *TestModelStructWrongTypeEmbed) Unmarshal(_ []byte) error        { return nil }
 func (m *TestModelStructWrongTypeEmbed) Save() error                     { return errors.New("error") }
+func (m *TestModelStructWrongTypeEmbed) Delete() error                   { return errors.New("error") }
+func (m *TestModelStructWrongTypeEmbed) Restore() error                  { return errors.New("error") }
 func (m *TestModelStructWrongTypeEmbed) Lock()                           {}
 func (m *TestModelStructWrongTypeEmbed) Unlock()                         {}
 
@@ -65,25 +80,55 @@ func (m *TestModelPtrWrongTypeEmbed) Id() uuid.UUID                   { return u
 func (m *TestModelPtrWrongTypeEmbed) CreatedAt() time.Time            { return time.Time{} }
 func (m *TestModelPtrWrongTypeEmbed) UpdatedAt() time.Time            { return time.Time{} }
 func (m *TestModelPtrWrongTypeEmbed) DeletedAt() time.Time            { return time.Time{} }
+func (m *TestModelPtrWrongTypeEmbed) Version() uint64                 { return 0 }
 func (m *TestModelPtrWrongTypeEmbed) Exists() bool                    { return true }
+func (m *TestModelPtrWrongTypeEmbed) Deleted() bool                   { return false }
 func (m *TestModelPtrWrongTypeEmbed) Collection() CollectionInterface { return nil }
 func (m *TestModelPtrWrongTypeEmbed) Marshal() ([]byte, error)        { return nil, nil }
 func (m *TestModelPtrWrongTypeEmbed) Unmarshal(_ []byte) error        { return nil }
 func (m *TestModelPtrWrongTypeEmbed) Save() error                     { return errors.New("error") }
+func (m *TestModelPtrWrongTypeEmbed) Delete() error                   { return errors.New("error") }
+func (m *TestModelPtrWrongTypeEmbed) Restore() error                  { return errors.New("error") }
 func (m *TestModelPtrWrongTypeEmbed) Lock()                           {}
 func (m *TestModelPtrWrongTypeEmbed) Unlock()                         {}
 
 type TestModelCollection struct{}
 
-func (m *TestModelCollection) Load() error              { return nil }
-func (m *TestModelCollection) Create(_ Interface) error { return nil }
-func (m *TestModelCollection) Save(_ Interface) error   { return nil }
+func (m *TestModelCollection) Load() error                                            { return nil }
+func (m *TestModelCollection) Create(_ Interface) error                               { return nil }
+func (m *TestModelCollection) Save(_ Interface) error                                 { return nil }
+func (m *TestModelCollection) Delete(_ Interface) error                               { return nil }
+func (m *TestModelCollection) Restore(_ Interface) error                              { return nil }
+func (m *TestModelCollection) Purge(_ Interface) error                                { return nil }
+func (m *TestModelCollection) PurgeDeletedBefore(_ time.Time) (int, error)            { return 0, nil }
+func (m *TestModelCollection) Find(_ uuid.UUID, _ ...Scope) (Interface, error)        { return nil, nil }
+func (m *TestModelCollection) MustFind(_ uuid.UUID, _ ...Scope) Interface             { return nil }
+func (m *TestModelCollection) All(_ ...Scope) []Interface                             { return nil }
+func (m *TestModelCollection) Count(_ ...Scope) int                                   { return 0 }
+func (m *TestModelCollection) Each(_ func(i Interface) bool, _ ...Scope)              {}
+func (m *TestModelCollection) Where(_ func(i Interface) bool, _ ...Scope) []Interface { return nil }
+func (m *TestModelCollection) Query() QueryInterface                                  { return nil }
+func (m *TestModelCollection) FindBy(_ string, _ interface{}, _ ...Scope) ([]Interface, error) {
+	return nil, nil
+}
+func (m *TestModelCollection) FindRange(_ string, _, _ interface{}, _ ...Scope) ([]Interface, error) {
+	return nil, nil
+}
 
-type TestModelCollectionError struct{}
+type TestModelCollectionError struct{ TestModelCollection }
 
-func (m *TestModelCollectionError) Load() error              { return errors.New("error load") }
-func (m *TestModelCollectionError) Create(_ Interface) error { return errors.New("error create") }
-func (m *TestModelCollectionError) Save(_ Interface) error   { return errors.New("error save") }
+func (m *TestModelCollectionError) Load() error               { return errors.New("error load") }
+func (m *TestModelCollectionError) Create(_ Interface) error  { return errors.New("error create") }
+func (m *TestModelCollectionError) Save(_ Interface) error    { return errors.New("error save") }
+func (m *TestModelCollectionError) Delete(_ Interface) error  { return errors.New("error delete") }
+func (m *TestModelCollectionError) Restore(_ Interface) error { return errors.New("error restore") }
+func (m *TestModelCollectionError) Purge(_ Interface) error   { return errors.New("error purge") }
+func (m *TestModelCollectionError) PurgeDeletedBefore(_ time.Time) (int, error) {
+	return 0, errors.New("error purge")
+}
+func (m *TestModelCollectionError) Find(_ uuid.UUID, _ ...Scope) (Interface, error) {
+	return nil, errors.New("error find")
+}
 
 func TestCheckInterface(t *testing.T) {
 	var err error
@@ -519,4 +564,670 @@ func TestTimestamps_RestoreTimestamps(t *testing.T) {
 	backup.CreatedAt = timestamps.CreatedAt.Add(-1 * time.Hour)
 
 	ExpectedNotEqual(t, backup, timestamps)
-}
\ No newline at end of file
+}
+
+func TestModel_Delete(t *testing.T) {
+	var err error
+
+	mA := &TestModelStruct{}
+
+	err = mA.Delete()
+
+	ExpectedError(t, err, "failed to delete model: model not initialized")
+
+	c := &TestModelCollection{}
+	mB := &TestModelStruct{}
+
+	_, err = Embed(mB, c)
+
+	ExpectedNoError(t, err)
+
+	err = mB.Delete()
+
+	ExpectedError(t, err, "failed to delete model: model does not exist")
+
+	err = mB.Save()
+
+	ExpectedNoError(t, err)
+
+	mB.c = &TestModelCollectionError{}
+
+	timestampsBackupB := mB.m.BackupTimestamps()
+
+	err = mB.Delete()
+
+	ExpectedError(t, err, "failed to delete model: error delete")
+
+	ExpectedEqual(t, mB.m.BackupTimestamps(), timestampsBackupB)
+	ExpectedZeroValue(t, mB.DeletedAt())
+
+	mB.c = c
+
+	err = mB.Delete()
+
+	ExpectedNoError(t, err)
+
+	ExpectedNoZeroValue(t, mB.DeletedAt())
+	ExpectedEqualF(t, mB.DeletedAt().Equal(mB.UpdatedAt()), true, false, "Deleted at and updated at should be equal")
+	ExpectedEqualF(t, mB.CreatedAt().Equal(timestampsBackupB.CreatedAt), true, false, "Created at should not be changed on delete")
+
+	err = mB.Delete()
+
+	ExpectedError(t, err, "failed to delete model: model already deleted")
+}
+
+func TestModel_Restore(t *testing.T) {
+	var err error
+
+	mA := &TestModelStruct{}
+
+	err = mA.Restore()
+
+	ExpectedError(t, err, "failed to restore model: model not initialized")
+
+	c := &TestModelCollection{}
+	mB := &TestModelStruct{}
+
+	_, err = Embed(mB, c)
+
+	ExpectedNoError(t, err)
+
+	err = mB.Save()
+
+	ExpectedNoError(t, err)
+
+	err = mB.Restore()
+
+	ExpectedError(t, err, "failed to restore model: model not deleted")
+
+	err = mB.Delete()
+
+	ExpectedNoError(t, err)
+
+	mB.c = &TestModelCollectionError{}
+
+	timestampsBackupB := mB.m.BackupTimestamps()
+
+	err = mB.Restore()
+
+	ExpectedError(t, err, "failed to restore model: error restore")
+
+	ExpectedEqual(t, mB.m.BackupTimestamps(), timestampsBackupB)
+
+	mB.c = c
+
+	err = mB.Restore()
+
+	ExpectedNoError(t, err)
+
+	ExpectedZeroValue(t, mB.DeletedAt())
+	ExpectedEqualF(t, mB.UpdatedAt().After(timestampsBackupB.DeletedAt), true, false, "Updated at should be after deleted at")
+}
+
+func TestModel_Deleted(t *testing.T) {
+	c := &TestModelCollection{}
+
+	var i Interface = &TestModelStruct{}
+
+	ExpectedZeroValue(t, i.Deleted())
+
+	m, err := Embed(i, c)
+
+	ExpectedNoError(t, err)
+
+	ExpectedZeroValue(t, m.Deleted())
+
+	err = m.Save()
+
+	ExpectedNoError(t, err)
+
+	ExpectedZeroValueF(t, m.Deleted(), false, "model was saved, should not be deleted")
+
+	err = m.Delete()
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqualF(t, m.Deleted(), true, false, "model was deleted, should be deleted")
+}
+
+func TestScopeOf(t *testing.T) {
+	ExpectedEqual(t, ScopeOf(nil), WithoutDeleted)
+	ExpectedEqual(t, ScopeOf([]Scope{}), WithoutDeleted)
+	ExpectedEqual(t, ScopeOf([]Scope{WithDeleted}), WithDeleted)
+	ExpectedEqual(t, ScopeOf([]Scope{OnlyDeleted, WithDeleted}), OnlyDeleted)
+}
+
+func TestScope_Includes(t *testing.T) {
+	c := &TestModelCollection{}
+
+	mA := &TestModelStruct{}
+	mB := &TestModelStruct{}
+
+	_, _ = Embed(mA, c)
+	_, _ = Embed(mB, c)
+
+	ExpectedNoError(t, mA.Save())
+	ExpectedNoError(t, mB.Save())
+	ExpectedNoError(t, mB.Delete())
+
+	ExpectedEqual(t, WithoutDeleted.Includes(mA), true)
+	ExpectedEqual(t, WithoutDeleted.Includes(mB), false)
+	ExpectedEqual(t, WithDeleted.Includes(mA), true)
+	ExpectedEqual(t, WithDeleted.Includes(mB), true)
+	ExpectedEqual(t, OnlyDeleted.Includes(mA), false)
+	ExpectedEqual(t, OnlyDeleted.Includes(mB), true)
+}
+
+func TestSaveWith(t *testing.T) {
+	err := SaveWith(&TestModelStruct{}, func(_ Interface) error { return nil })
+
+	ExpectedError(t, err, "failed to save model: model not initialized")
+
+	mA := &TestModelStruct{}
+
+	_, err = Embed(mA, &TestModelCollectionError{})
+
+	ExpectedNoError(t, err)
+
+	var persisted Interface
+
+	err = SaveWith(mA, func(i Interface) error {
+		persisted = i
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	ExpectedEqualF(t, persisted == Interface(mA), true, false, "model should be persisted through the function")
+	ExpectedNoZeroValue(t, mA.CreatedAt())
+
+	backup := mA.m.BackupTimestamps()
+
+	err = SaveWith(mA, func(_ Interface) error { return errors.New("error persist") })
+
+	ExpectedError(t, err, "failed to save model: error persist")
+
+	ExpectedEqualF(t, mA.UpdatedAt().Equal(backup.UpdatedAt), true, false, "timestamps should be restored on error")
+}
+
+func TestDeleteWith(t *testing.T) {
+	mA := &TestModelStruct{}
+
+	_, err := Embed(mA, &TestModelCollectionError{})
+
+	ExpectedNoError(t, err)
+
+	err = DeleteWith(mA, func(_ Interface) error { return nil })
+
+	ExpectedError(t, err, "failed to delete model: model does not exist")
+
+	ExpectedNoError(t, SaveWith(mA, func(_ Interface) error { return nil }))
+	ExpectedNoError(t, DeleteWith(mA, func(_ Interface) error { return nil }))
+
+	ExpectedEqual(t, mA.Deleted(), true)
+
+	ExpectedNoError(t, RestoreWith(mA, func(_ Interface) error { return nil }))
+
+	ExpectedEqual(t, mA.Deleted(), false)
+}
+
+func TestSnapshot(t *testing.T) {
+	// Without an embedded model there is nothing to revert
+	Snapshot(TestModelInterfaceNoModel{})()
+
+	mA := &TestModelStruct{}
+
+	_, err := Embed(mA, &TestModelCollection{})
+
+	ExpectedNoError(t, err)
+
+	revert := Snapshot(mA)
+
+	ExpectedNoError(t, mA.Save())
+	ExpectedNoError(t, mA.Delete())
+
+	revert()
+
+	ExpectedZeroValue(t, mA.CreatedAt())
+	ExpectedZeroValue(t, mA.UpdatedAt())
+	ExpectedZeroValue(t, mA.DeletedAt())
+}
+
+func TestSetVersion(t *testing.T) {
+	// Without an embedded model there is no version
+	SetVersion(TestModelInterfaceNoModel{}, 1)
+
+	mA := &TestModelStruct{}
+
+	ExpectedEqual(t, mA.Version(), uint64(0))
+
+	_, err := Embed(mA, &TestModelCollection{})
+
+	ExpectedNoError(t, err)
+
+	SetVersion(mA, 3)
+
+	ExpectedEqual(t, mA.Version(), uint64(3))
+
+	revert := Snapshot(mA)
+
+	SetVersion(mA, 4)
+
+	revert()
+
+	ExpectedEqual(t, mA.Version(), uint64(3))
+}
+
+type TestModelCollectionClock struct {
+	TestModelCollection
+	now time.Time
+}
+
+func (m *TestModelCollectionClock) Now() time.Time { return m.now }
+
+func TestModel_now(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	mA := &TestModelStruct{}
+
+	_, err := Embed(mA, &TestModelCollectionClock{now: now})
+
+	ExpectedNoError(t, err)
+	ExpectedNoError(t, mA.Save())
+
+	ExpectedEqualF(t, mA.CreatedAt().Equal(now), true, false, "model should be timestamped by the clock of the collection")
+
+	now = now.Add(time.Hour)
+	mA.c.(*TestModelCollectionClock).now = now
+
+	ExpectedNoError(t, mA.Delete())
+
+	ExpectedEqualF(t, mA.DeletedAt().Equal(now), true, false, "model should be timestamped by the clock of the collection")
+}
+
+type TestModelCollectionCodec struct {
+	TestModelCollection
+	codec codec.Codec
+}
+
+func (m *TestModelCollectionCodec) Codec() codec.Codec { return m.codec }
+
+type TestModelCodec struct {
+	Model
+
+	FieldA string
+	FieldB int
+	FieldC []string
+	FieldD map[string]int
+
+	fieldE string
+}
+
+func TestModel_codec(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	for _, cd := range []codec.Codec{codec.JSON, codec.Gob, codec.MessagePack, codec.CBOR} {
+		c := &TestModelCollectionCodec{codec: cd}
+
+		mA := &TestModelCodec{
+			FieldA: "test-aaa",
+			FieldB: 42,
+			FieldC: []string{"a", "b"},
+			FieldD: map[string]int{"c": 3},
+			fieldE: "unexported",
+		}
+
+		_, err := Embed(mA, c)
+
+		ExpectedNoError(t, err)
+
+		mA.m.CreatedAt = now
+		mA.m.UpdatedAt = now
+		mA.m.Version = 3
+
+		b, err := mA.Marshal()
+
+		ExpectedNoError(t, err)
+		ExpectedEqualF(t, b[0], cd.ID(), false, fmt.Sprintf("%s record should start with the codec id", cd.Name()))
+
+		mB := &TestModelCodec{}
+
+		_, _ = Embed(mB, &TestModelCollection{})
+
+		// Records are decoded with the codec they were encoded with, regardless of the codec of the collection
+		err = mB.Unmarshal(b)
+
+		ExpectedNoError(t, err)
+
+		ExpectedEqual(t, mB.Id(), mA.Id())
+		ExpectedEqual(t, mB.Version(), uint64(3))
+		ExpectedEqualF(t, mB.CreatedAt().Equal(now), true, false, fmt.Sprintf("%s should keep the creation time", cd.Name()))
+		ExpectedEqualF(t, mB.UpdatedAt().Equal(now), true, false, fmt.Sprintf("%s should keep the update time", cd.Name()))
+		ExpectedEqualF(t, mB.DeletedAt().IsZero(), true, false, fmt.Sprintf("%s should keep the deletion time", cd.Name()))
+		ExpectedEqual(t, mB.FieldA, mA.FieldA)
+		ExpectedEqual(t, mB.FieldB, mA.FieldB)
+		ExpectedEqual(t, mB.FieldC, mA.FieldC)
+		ExpectedEqual(t, mB.FieldD, mA.FieldD)
+		ExpectedEqual(t, mB.fieldE, "")
+	}
+
+	mC := &TestModelCodec{}
+
+	_, _ = Embed(mC, &TestModelCollection{})
+
+	err := mC.Unmarshal([]byte{0xff})
+
+	ExpectedError(t, err, "unknown codec id 0xff")
+}
+
+type TestModelCollectionKeys struct {
+	TestModelCollectionCodec
+	keyring *encrypt.Keyring
+}
+
+func (m *TestModelCollectionKeys) FieldKeyring(_ string) (*encrypt.Keyring, error) {
+	if m.keyring == nil {
+		return nil, errors.New("no keyring")
+	}
+
+	return m.keyring, nil
+}
+
+type TestModelEncrypted struct {
+	Model
+
+	Name   string
+	Token  string         `borm:"encrypt" json:"token"`
+	Number int            `borm:"index, encrypt"`
+	Map    map[string]int `borm:"encrypt"`
+}
+
+func TestModel_encryptedFields(t *testing.T) {
+	keyring := encrypt.NewKeyring()
+
+	ExpectedNoError(t, keyring.Add(1, encrypt.AESGCM, []byte("0123456789abcdef")))
+
+	for _, cd := range []codec.Codec{codec.JSON, codec.Gob, codec.CBOR} {
+		c := &TestModelCollectionKeys{TestModelCollectionCodec: TestModelCollectionCodec{codec: cd}, keyring: keyring}
+
+		mA := &TestModelEncrypted{
+			Name:   "name",
+			Token:  "secret-token",
+			Number: 123456789,
+			Map:    map[string]int{"secret-key": 1},
+		}
+
+		_, err := Embed(mA, c)
+
+		ExpectedNoError(t, err)
+
+		b, err := mA.Marshal()
+
+		ExpectedNoError(t, err)
+		ExpectedEqualF(t, b[0], cd.ID(), false, fmt.Sprintf("%s record should start with the codec id", cd.Name()))
+		ExpectedEqualF(t, bytes.Contains(b, []byte("name")), true, false, "expected other fields to remain readable")
+		ExpectedEqualF(t, bytes.Contains(b, []byte("secret")), false, false, "expected the fields to be encrypted")
+		ExpectedEqualF(t, bytes.Contains(b, []byte("123456789")), false, false, "expected the fields to be encrypted")
+
+		mB := &TestModelEncrypted{Token: "other"}
+
+		_, _ = Embed(mB, c)
+
+		ExpectedNoError(t, mB.Unmarshal(b))
+
+		ExpectedEqual(t, mB.Id(), mA.Id())
+		ExpectedEqual(t, mB.Name, mA.Name)
+		ExpectedEqual(t, mB.Token, mA.Token)
+		ExpectedEqual(t, mB.Number, mA.Number)
+		ExpectedEqual(t, mB.Map, mA.Map)
+
+	}
+
+	// The fields are bound to their model
+	c := &TestModelCollectionKeys{keyring: keyring}
+
+	mA := &TestModelEncrypted{Token: "secret-token"}
+	mB := &TestModelEncrypted{}
+
+	_, _ = Embed(mA, c)
+	_, _ = Embed(mB, c)
+
+	b, err := mA.Marshal()
+
+	ExpectedNoError(t, err)
+
+	b = bytes.Replace(b, []byte(mA.Id().String()), []byte(mB.Id().String()), 1)
+
+	ExpectedError(t, mB.Unmarshal(b), "failed to decrypt field Token: cipher: message authentication failed")
+
+	mD := &TestModelEncrypted{Token: "secret-token"}
+
+	_, _ = Embed(mD, &TestModelCollection{})
+
+	_, err = mD.Marshal()
+
+	ExpectedError(t, err, "failed to encrypt field Token: no key provider")
+
+	mE := &TestModelEncrypted{Token: "secret-token"}
+
+	_, _ = Embed(mE, &TestModelCollectionKeys{})
+
+	_, err = mE.Marshal()
+
+	ExpectedError(t, err, "failed to encrypt field Token: no keyring")
+}
+
+// TestModelEncryptedBase is embedded by TestModelEncryptedEmbedded
+type TestModelEncryptedBase struct {
+	Label  string
+	Secret string `borm:"encrypt"`
+}
+
+type TestModelEncryptedPin struct {
+	Pin string `borm:"encrypt"`
+}
+
+type TestModelEncryptedEmbedded struct {
+	Model
+	TestModelEncryptedBase
+	*TestModelEncryptedPin
+
+	Name string
+}
+
+func TestModel_encryptedFields_embedded(t *testing.T) {
+	keyring := encrypt.NewKeyring()
+
+	ExpectedNoError(t, keyring.Add(1, encrypt.AESGCM, []byte("0123456789abcdef")))
+
+	for _, cd := range []codec.Codec{codec.JSON, codec.Gob, codec.MessagePack, codec.CBOR} {
+		c := &TestModelCollectionKeys{TestModelCollectionCodec: TestModelCollectionCodec{codec: cd}, keyring: keyring}
+
+		mA := &TestModelEncryptedEmbedded{
+			TestModelEncryptedBase: TestModelEncryptedBase{Label: "label", Secret: "hunter2-ssn"},
+			TestModelEncryptedPin:  &TestModelEncryptedPin{Pin: "hunter2-pin"},
+			Name:                   "name",
+		}
+
+		_, err := Embed(mA, c)
+
+		ExpectedNoError(t, err)
+
+		b, err := mA.Marshal()
+
+		ExpectedNoError(t, err)
+		ExpectedEqualF(t, bytes.Contains(b, []byte("label")), true, false, "expected other fields to remain readable")
+		ExpectedEqualF(t, bytes.Contains(b, []byte("hunter2")), false, false, cd.Name()+" fields of embedded structs should be encrypted")
+
+		mB := &TestModelEncryptedEmbedded{}
+
+		_, _ = Embed(mB, c)
+
+		ExpectedNoError(t, mB.Unmarshal(b))
+
+		ExpectedEqual(t, mB.Label, "label")
+		ExpectedEqual(t, mB.Secret, "hunter2-ssn")
+		ExpectedEqual(t, mB.Name, "name")
+		ExpectedEqualF(t, mB.TestModelEncryptedPin != nil, true, true, "expected the embedded pointer to be set")
+		ExpectedEqual(t, mB.Pin, "hunter2-pin")
+
+		// Nil embedded pointers remain nil
+		mA.TestModelEncryptedPin = nil
+
+		b, err = mA.Marshal()
+
+		ExpectedNoError(t, err)
+
+		mC := &TestModelEncryptedEmbedded{}
+
+		_, _ = Embed(mC, c)
+
+		ExpectedNoError(t, mC.Unmarshal(b))
+
+		ExpectedEqual(t, mC.Secret, "hunter2-ssn")
+		ExpectedEqualF(t, mC.TestModelEncryptedPin == nil, true, false, "expected the embedded pointer to remain nil")
+	}
+
+	// JSON records flatten embedded structs, plain records stored before the fields were encrypted are read as well
+	c := &TestModelCollectionKeys{keyring: keyring}
+
+	mA := &TestModelEncryptedEmbedded{
+		TestModelEncryptedBase: TestModelEncryptedBase{Label: "label", Secret: "hunter2-ssn"},
+		Name:                   "name",
+	}
+
+	_, _ = Embed(mA, c)
+
+	b, err := json.Marshal(&marshaller{Model: mA.m, Instance: &struct {
+		TestModelEncryptedBase
+		Name string
+	}{mA.TestModelEncryptedBase, mA.Name}})
+
+	ExpectedNoError(t, err)
+
+	mB := &TestModelEncryptedEmbedded{}
+
+	_, _ = Embed(mB, c)
+
+	ExpectedNoError(t, mB.Unmarshal(b))
+
+	ExpectedEqual(t, mB.Label, "label")
+	ExpectedEqual(t, mB.Secret, "hunter2-ssn")
+	ExpectedEqual(t, mB.Name, "name")
+
+	// Encrypted records keep the layout of plain records
+	b, err = mB.Marshal()
+
+	ExpectedNoError(t, err)
+
+	var r struct {
+		Instance map[string]interface{}
+	}
+
+	ExpectedNoError(t, json.Unmarshal(b, &r))
+
+	_, nested := r.Instance["TestModelEncryptedBase"]
+
+	ExpectedEqual(t, nested, false)
+	ExpectedEqual(t, r.Instance["Label"], "label")
+}
+
+type TestModelHooks struct {
+	Model
+	calls []string
+	err   error
+}
+
+func (m *TestModelHooks) BeforeCreate() error {
+	m.calls = append(m.calls, "BeforeCreate")
+
+	return m.err
+}
+
+func (m *TestModelHooks) BeforeSave() error {
+	m.calls = append(m.calls, "BeforeSave")
+
+	return m.err
+}
+
+func (m *TestModelHooks) AfterSave() {
+	m.calls = append(m.calls, "AfterSave")
+}
+
+func (m *TestModelHooks) BeforeDelete() error {
+	m.calls = append(m.calls, "BeforeDelete")
+
+	return m.err
+}
+
+func (m *TestModelHooks) AfterDelete() {
+	m.calls = append(m.calls, "AfterDelete")
+}
+
+func TestModel_hooks(t *testing.T) {
+	m := &TestModelHooks{}
+
+	_, err := Embed(m, &TestModelCollection{})
+
+	ExpectedNoError(t, err)
+
+	ExpectedNoError(t, m.Save())
+	ExpectedEqual(t, m.calls, []string{"BeforeCreate", "BeforeSave", "AfterSave"})
+
+	m.calls = nil
+
+	ExpectedNoError(t, m.Save())
+	ExpectedEqual(t, m.calls, []string{"BeforeSave", "AfterSave"})
+
+	m.calls = nil
+
+	ExpectedNoError(t, m.Delete())
+	ExpectedEqual(t, m.calls, []string{"BeforeDelete", "AfterDelete"})
+
+	m.calls = nil
+
+	// Before hooks abort the operation and restore the timestamps
+	ExpectedNoError(t, m.Restore())
+
+	backup := m.m.BackupTimestamps()
+
+	m.err = errors.New("invalid")
+
+	ExpectedError(t, m.Save(), "failed to save model: invalid")
+	ExpectedEqual(t, m.calls, []string{"BeforeSave"})
+	ExpectedEqual(t, m.m.BackupTimestamps(), backup)
+
+	m.calls = nil
+
+	ExpectedError(t, m.Delete(), "failed to delete model: invalid")
+	ExpectedEqual(t, m.calls, []string{"BeforeDelete"})
+	ExpectedEqual(t, m.m.BackupTimestamps(), backup)
+	ExpectedEqual(t, m.Deleted(), false)
+
+	// After hooks are only called once persisted
+	m.err = nil
+	m.calls = nil
+	m.c = &TestModelCollectionError{}
+
+	ExpectedError(t, m.Save(), "failed to save model: error save")
+	ExpectedEqual(t, m.calls, []string{"BeforeSave"})
+
+	// SaveWith leaves the after hook to the caller
+	m.calls = nil
+
+	ExpectedNoError(t, SaveWith(m, func(_ Interface) error { return nil }))
+	ExpectedEqual(t, m.calls, []string{"BeforeSave"})
+
+	mN := &TestModelHooks{}
+
+	_, err = Embed(mN, &TestModelCollection{})
+
+	ExpectedNoError(t, err)
+
+	mN.err = errors.New("invalid")
+
+	ExpectedError(t, mN.Save(), "failed to save model: invalid")
+	ExpectedEqual(t, mN.calls, []string{"BeforeCreate"})
+	ExpectedEqual(t, mN.Exists(), false)
+}
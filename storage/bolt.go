@@ -0,0 +1,539 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrTruncated is returned when a database file is smaller than its meta page records, see CheckBolt.
+var ErrTruncated = errors.New("database file truncated")
+
+// compactTxMaxSize is the number of bytes copied per transaction by Compact, like the compact command of bbolt
+var compactTxMaxSize int64 = 65536
+
+// boltOpen opens bbolt databases, replaced by tests to fail opening them
+var boltOpen = bolt.Open
+
+// Layout of the meta pages of bbolt, the first two pages of the database file
+const (
+	metaMagic   = 0xED0CDAED
+	metaVersion = 2
+	// Size of the page header followed by the meta
+	metaSize = 16 + 64
+)
+
+// Bolt stores the buckets in a bbolt database file, it is the default storage.
+type Bolt struct {
+	db *bolt.DB
+
+	// Mode and options to reopen the database file with, once it is swapped by Compact
+	mode    os.FileMode
+	options *bolt.Options
+
+	// Held for reading by transactions, for writing while the database file is swapped
+	mu sync.RWMutex
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+// compactWriter copies buckets into a compacted database, committing a transaction once it holds compactTxMaxSize bytes.
+type compactWriter struct {
+	db   *bolt.DB
+	tx   *bolt.Tx
+	size int64
+}
+
+// OpenBolt opens the bbolt database file, it is created when it does not exist.
+// The errors of bbolt are returned as is, ErrTruncated is returned for truncated files, see CheckBolt.
+func OpenBolt(file string, mode os.FileMode, options *bolt.Options) (*Bolt, error) {
+	if err := CheckBolt(file); err != nil {
+		return nil, err
+	}
+
+	db, err := boltOpen(file, mode, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewBolt(db)
+
+	s.mode = mode
+	s.options = options
+
+	return s, nil
+}
+
+// NewBolt uses an opened bbolt database as storage.
+// Once swapped by Compact, the database file is reopened with the default options.
+func NewBolt(db *bolt.DB) *Bolt {
+	return &Bolt{
+		db:   db,
+		mode: 0600,
+	}
+}
+
+// DB returns the underlying bbolt database.
+func (s *Bolt) DB() *bolt.DB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db
+}
+
+func (s *Bolt) View(fn func(tx Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *Bolt) Update(fn func(tx Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+// WriteTo writes a consistent copy of the database file to w, within a single read transaction.
+func (s *Bolt) WriteTo(w io.Writer) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n int64
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+
+		n, err = tx.WriteTo(w)
+
+		return err
+	})
+
+	return n, err
+}
+
+// Compact copies the buckets into a new database file at dst, leaving out the free pages of the database file.
+// It returns the sizes of the database file and the compacted file.
+// When swap is set, the compacted file replaces the database file by an atomic rename,
+// transactions are blocked until the compacted file is opened.
+// When the compacted file can not be opened, the database file is restored and opened again.
+// If that fails as well, the returned error matches ErrClosed and the storage can no longer be used.
+func (s *Bolt) Compact(dst string, swap bool) (int64, int64, error) {
+	if swap {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	} else {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		return 0, 0, fmt.Errorf("file %s already exists", dst)
+	} else if !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+
+	path := s.db.Path()
+
+	before, err := fileSize(path)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := s.compact(dst); err != nil {
+		_ = os.Remove(dst)
+
+		return before, 0, err
+	}
+
+	after, err := fileSize(dst)
+
+	if err != nil || !swap {
+		return before, after, err
+	}
+
+	if err := s.db.Close(); err != nil {
+		return before, after, err
+	}
+
+	return before, after, s.swap(path, dst)
+}
+
+// swap replaces the closed database file at path by the compacted file at dst and opens it.
+// The database file is linked to a temporary file first, so it can be restored.
+func (s *Bolt) swap(path, dst string) error {
+	orig := dst + ".orig"
+
+	if err := os.Link(path, orig); err != nil {
+		return s.reopen(path, err)
+	}
+
+	defer os.Remove(orig)
+
+	if err := os.Rename(dst, path); err != nil {
+		return s.reopen(path, err)
+	}
+
+	db, err := boltOpen(path, s.mode, s.options)
+
+	if err != nil {
+		return s.restore(path, orig, err)
+	}
+
+	s.db = db
+
+	return nil
+}
+
+// restore moves the database file back from orig to path and opens it, as swapping it failed with cause.
+func (s *Bolt) restore(path, orig string, cause error) error {
+	if err := os.Rename(orig, path); err != nil {
+		return fmt.Errorf("%w: %s, failed to restore database file: %s", ErrClosed, cause, err)
+	}
+
+	return s.reopen(path, cause)
+}
+
+// reopen opens the database file at path again, as swapping it failed with cause.
+func (s *Bolt) reopen(path string, cause error) error {
+	db, err := boltOpen(path, s.mode, s.options)
+
+	if err != nil {
+		return fmt.Errorf("%w: %s, failed to reopen database file: %s", ErrClosed, cause, err)
+	}
+
+	s.db = db
+
+	return cause
+}
+
+// compact copies the buckets into a new database file, in transactions of at most compactTxMaxSize bytes.
+func (s *Bolt) compact(dst string) error {
+	ddb, err := bolt.Open(dst, s.mode, nil)
+
+	if err != nil {
+		return err
+	}
+
+	w := &compactWriter{db: ddb}
+
+	if w.tx, err = ddb.Begin(true); err == nil {
+		err = s.db.View(func(stx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				return w.copyBucket([][]byte{name}, b)
+			})
+		})
+
+		if err == nil {
+			err = w.tx.Commit()
+		} else if w.tx != nil {
+			_ = w.tx.Rollback()
+		}
+	}
+
+	if cerr := ddb.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// reserve commits the transaction when n more bytes exceed compactTxMaxSize, and begins the next one.
+func (w *compactWriter) reserve(n int64) error {
+	if w.size > 0 && w.size+n > compactTxMaxSize {
+		err := w.tx.Commit()
+
+		// Committing closes the transaction, failing or not
+		w.tx = nil
+
+		if err != nil {
+			return err
+		}
+
+		if w.tx, err = w.db.Begin(true); err != nil {
+			return err
+		}
+
+		w.size = 0
+	}
+
+	w.size += n
+
+	return nil
+}
+
+// bucket returns the bucket at path within the current transaction.
+func (w *compactWriter) bucket(path [][]byte) *bolt.Bucket {
+	b := w.tx.Bucket(path[0])
+
+	for _, name := range path[1:] {
+		b = b.Bucket(name)
+	}
+
+	// Keys are inserted in order, so pages can be filled completely
+	b.FillPercent = 1
+
+	return b
+}
+
+// copyBucket creates the bucket at path and copies the keys and nested buckets of src into it.
+// Buckets are looked up by path, as the transaction may be committed while copying.
+func (w *compactWriter) copyBucket(path [][]byte, src *bolt.Bucket) error {
+	name := path[len(path)-1]
+
+	if err := w.reserve(int64(len(name))); err != nil {
+		return err
+	}
+
+	var err error
+
+	if len(path) == 1 {
+		_, err = w.tx.CreateBucket(name)
+	} else {
+		_, err = w.bucket(path[:len(path)-1]).CreateBucket(name)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := w.bucket(path).SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return w.copyBucket(append(path[:len(path):len(path)], k), src.Bucket(k))
+		}
+
+		if err := w.reserve(int64(len(k) + len(v))); err != nil {
+			return err
+		}
+
+		return w.bucket(path).Put(k, v)
+	})
+}
+
+// Reopen opens the database file again, so a database opened read-only reads the file which replaced it since,
+// like a newer snapshot of a database in use by another process.
+// The file is opened before the previous one is closed, which is kept when opening fails.
+// Databases opened for writing hold an exclusive lock on the file, so they can not be reopened.
+func (s *Bolt) Reopen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.db.IsReadOnly() {
+		return errors.New("database opened for writing")
+	}
+
+	options := bolt.Options{}
+
+	if s.options != nil {
+		options = *s.options
+	}
+
+	options.ReadOnly = true
+
+	path := s.db.Path()
+
+	if err := CheckBolt(path); err != nil {
+		return err
+	}
+
+	db, err := boltOpen(path, s.mode, &options)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.Close(); err != nil {
+		_ = db.Close()
+
+		return err
+	}
+
+	s.db = db
+
+	return nil
+}
+
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+func (s *Bolt) ReadOnly() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.IsReadOnly()
+}
+
+func (s *Bolt) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Close()
+}
+
+func (t *boltTx) Writable() bool {
+	return t.tx.Writable()
+}
+
+func (t *boltTx) Bucket(name []byte) Bucket {
+	return wrapBoltBucket(t.tx.Bucket(name))
+}
+
+func (t *boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapBoltBucket(b), nil
+}
+
+func (t *boltTx) DeleteBucket(name []byte) error {
+	return t.tx.DeleteBucket(name)
+}
+
+// wrapBoltBucket wraps the bucket, a nil bucket results in a nil interface.
+func wrapBoltBucket(b *bolt.Bucket) Bucket {
+	if b == nil {
+		return nil
+	}
+
+	return &boltBucket{b: b}
+}
+
+func (b *boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b *boltBucket) Put(key, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b *boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b *boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b *boltBucket) Bucket(name []byte) Bucket {
+	return wrapBoltBucket(b.b.Bucket(name))
+}
+
+func (b *boltBucket) CreateBucket(name []byte) (Bucket, error) {
+	nb, err := b.b.CreateBucket(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapBoltBucket(nb), nil
+}
+
+func (b *boltBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	nb, err := b.b.CreateBucketIfNotExists(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapBoltBucket(nb), nil
+}
+
+func (b *boltBucket) DeleteBucket(name []byte) error {
+	return b.b.DeleteBucket(name)
+}
+
+// CheckBolt returns ErrTruncated when the database file is smaller than the number of pages recorded by its meta page.
+// bbolt does not check the size of the file, it faults reading the missing pages while opening it.
+// Files which are missing or not valid databases are left to bbolt to report.
+func CheckBolt(file string) error {
+	f, err := os.Open(file)
+
+	if err != nil {
+		return nil
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+
+	if err != nil {
+		return nil
+	}
+
+	pageSize, pages, txid, ok := readMeta(f, 0)
+
+	if !ok {
+		return nil
+	}
+
+	// bbolt uses the valid meta page of the latest transaction
+	if _, p, t, ok := readMeta(f, int64(pageSize)); ok && t > txid {
+		pages = p
+	}
+
+	if size := uint64(pageSize) * pages; uint64(info.Size()) < size {
+		return fmt.Errorf("%w: %d bytes, %d pages of %d bytes expected", ErrTruncated, info.Size(), pages, pageSize)
+	}
+
+	return nil
+}
+
+// readMeta reads the meta page at offset, returning its page size, number of pages and transaction id.
+// Meta pages are stored in the byte order of the platform, pages which do not validate, like those
+// of other platforms, are not ok.
+func readMeta(f *os.File, offset int64) (uint32, uint64, uint64, bool) {
+	b := make([]byte, metaSize)
+
+	if _, err := f.ReadAt(b, offset); err != nil {
+		return 0, 0, 0, false
+	}
+
+	m := b[16:]
+	o := binary.LittleEndian
+
+	if o.Uint32(m[0:]) != metaMagic || o.Uint32(m[4:]) != metaVersion {
+		return 0, 0, 0, false
+	}
+
+	h := fnv.New64a()
+
+	_, _ = h.Write(m[:56])
+
+	if h.Sum64() != o.Uint64(m[56:]) {
+		return 0, 0, 0, false
+	}
+
+	return o.Uint32(m[8:]), o.Uint64(m[40:]), o.Uint64(m[48:]), true
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+)
+
+// Op is an operation of a storage, see Faulty.
+type Op string
+
+const (
+	OpView         Op = "view"
+	OpUpdate       Op = "update"
+	OpCommit       Op = "commit"
+	OpPut          Op = "put"
+	OpDelete       Op = "delete"
+	OpForEach      Op = "for-each"
+	OpCreateBucket Op = "create-bucket"
+	OpDeleteBucket Op = "delete-bucket"
+	OpCompact      Op = "compact"
+)
+
+// Faulty wraps a storage and fails operations on demand, to test how failing storage is handled.
+// A failing commit returns the error after the update function succeeded, so the update is reverted.
+type Faulty struct {
+	Storage
+
+	faults map[Op]*fault
+
+	sync.Mutex
+}
+
+type fault struct {
+	// Number of operations to succeed before failing
+	after int
+	err   error
+}
+
+type faultyTx struct {
+	Tx
+	f *Faulty
+}
+
+type faultyBucket struct {
+	b Bucket
+	f *Faulty
+}
+
+// NewFaulty wraps the storage, no operations fail until requested.
+func NewFaulty(s Storage) *Faulty {
+	return &Faulty{
+		Storage: s,
+		faults:  make(map[Op]*fault),
+	}
+}
+
+// Fail fails every following operation op with err.
+func (f *Faulty) Fail(op Op, err error) {
+	f.FailAfter(op, 0, err)
+}
+
+// FailAfter lets n operations op succeed, after which every operation op fails with err.
+func (f *Faulty) FailAfter(op Op, n int, err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.faults[op] = &fault{
+		after: n,
+		err:   err,
+	}
+}
+
+// Reset stops failing operations.
+func (f *Faulty) Reset() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.faults = make(map[Op]*fault)
+}
+
+// fault returns the error for the operation, if it should fail.
+func (f *Faulty) fault(op Op) error {
+	f.Lock()
+	defer f.Unlock()
+
+	ft, ok := f.faults[op]
+
+	if !ok {
+		return nil
+	}
+
+	if ft.after > 0 {
+		ft.after--
+
+		return nil
+	}
+
+	return ft.err
+}
+
+func (f *Faulty) View(fn func(tx Tx) error) error {
+	if err := f.fault(OpView); err != nil {
+		return err
+	}
+
+	return f.Storage.View(func(tx Tx) error {
+		return fn(&faultyTx{Tx: tx, f: f})
+	})
+}
+
+func (f *Faulty) Update(fn func(tx Tx) error) error {
+	if err := f.fault(OpUpdate); err != nil {
+		return err
+	}
+
+	return f.Storage.Update(func(tx Tx) error {
+		if err := fn(&faultyTx{Tx: tx, f: f}); err != nil {
+			return err
+		}
+
+		return f.fault(OpCommit)
+	})
+}
+
+// Compact compacts the wrapped storage, when it can compact its database file, see Bolt.Compact.
+func (f *Faulty) Compact(dst string, swap bool) (int64, int64, error) {
+	c, ok := f.Storage.(interface {
+		Compact(dst string, swap bool) (int64, int64, error)
+	})
+
+	if !ok {
+		return 0, 0, errors.New("compaction not supported")
+	}
+
+	if err := f.fault(OpCompact); err != nil {
+		return 0, 0, err
+	}
+
+	return c.Compact(dst, swap)
+}
+
+func (t *faultyTx) Bucket(name []byte) Bucket {
+	return t.f.wrap(t.Tx.Bucket(name))
+}
+
+func (t *faultyTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if err := t.f.fault(OpCreateBucket); err != nil {
+		return nil, err
+	}
+
+	b, err := t.Tx.CreateBucketIfNotExists(name)
+
+	return t.f.wrap(b), err
+}
+
+func (t *faultyTx) DeleteBucket(name []byte) error {
+	if err := t.f.fault(OpDeleteBucket); err != nil {
+		return err
+	}
+
+	return t.Tx.DeleteBucket(name)
+}
+
+// wrap wraps the bucket, a nil bucket results in a nil interface.
+func (f *Faulty) wrap(b Bucket) Bucket {
+	if b == nil {
+		return nil
+	}
+
+	return &faultyBucket{b: b, f: f}
+}
+
+func (b *faultyBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b *faultyBucket) Put(key, value []byte) error {
+	if err := b.f.fault(OpPut); err != nil {
+		return err
+	}
+
+	return b.b.Put(key, value)
+}
+
+func (b *faultyBucket) Delete(key []byte) error {
+	if err := b.f.fault(OpDelete); err != nil {
+		return err
+	}
+
+	return b.b.Delete(key)
+}
+
+func (b *faultyBucket) ForEach(fn func(k, v []byte) error) error {
+	if err := b.f.fault(OpForEach); err != nil {
+		return err
+	}
+
+	return b.b.ForEach(fn)
+}
+
+func (b *faultyBucket) Bucket(name []byte) Bucket {
+	return b.f.wrap(b.b.Bucket(name))
+}
+
+func (b *faultyBucket) CreateBucket(name []byte) (Bucket, error) {
+	if err := b.f.fault(OpCreateBucket); err != nil {
+		return nil, err
+	}
+
+	nb, err := b.b.CreateBucket(name)
+
+	return b.f.wrap(nb), err
+}
+
+func (b *faultyBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if err := b.f.fault(OpCreateBucket); err != nil {
+		return nil, err
+	}
+
+	nb, err := b.b.CreateBucketIfNotExists(name)
+
+	return b.f.wrap(nb), err
+}
+
+func (b *faultyBucket) DeleteBucket(name []byte) error {
+	if err := b.f.fault(OpDeleteBucket); err != nil {
+		return err
+	}
+
+	return b.b.DeleteBucket(name)
+}
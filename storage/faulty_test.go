@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"errors"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+)
+
+func TestFaulty(t *testing.T) {
+	f := NewFaulty(NewMemory())
+
+	failed := errors.New("failed")
+
+	f.Fail(OpView, failed)
+
+	ExpectedEqual(t, f.View(func(tx Tx) error { return nil }), failed)
+
+	f.Reset()
+
+	ExpectedNoError(t, f.View(func(tx Tx) error { return nil }))
+
+	f.FailAfter(OpPut, 1, failed)
+
+	err := f.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("a"))
+
+		if err != nil {
+			return err
+		}
+
+		ExpectedNoError(t, b.Put([]byte("k1"), []byte("v1")))
+		ExpectedEqual(t, b.Put([]byte("k2"), []byte("v2")), failed)
+		ExpectedEqual(t, tx.Bucket([]byte("a")).Put([]byte("k2"), []byte("v2")), failed)
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	// A failing commit reverts the update
+	f.Reset()
+	f.Fail(OpCommit, failed)
+
+	err = f.Update(func(tx Tx) error {
+		return tx.Bucket([]byte("a")).Put([]byte("k1"), []byte("changed"))
+	})
+
+	ExpectedEqual(t, err, failed)
+
+	f.Reset()
+
+	err = f.View(func(tx Tx) error {
+		b := tx.Bucket([]byte("a"))
+
+		ExpectedEqual(t, b.Get([]byte("k1")), []byte("v1"))
+		ExpectedZeroValue(t, b.Get([]byte("k2")))
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	for _, op := range []Op{OpDelete, OpForEach, OpCreateBucket, OpDeleteBucket, OpUpdate} {
+		f.Reset()
+		f.Fail(op, failed)
+
+		err = f.Update(func(tx Tx) error {
+			b := tx.Bucket([]byte("a"))
+
+			switch op {
+			case OpDelete:
+				return b.Delete([]byte("k1"))
+			case OpForEach:
+				return b.ForEach(func(k, v []byte) error { return nil })
+			case OpCreateBucket:
+				_, err := b.CreateBucket([]byte("n"))
+
+				return err
+			case OpDeleteBucket:
+				return tx.DeleteBucket([]byte("a"))
+			}
+
+			return nil
+		})
+
+		ExpectedEqualF(t, err, failed, false, "expected operation "+string(op)+" to fail")
+	}
+
+	// Only storages which compact can be compacted
+	_, _, err = f.Compact("compact.db", false)
+
+	ExpectedError(t, err, "compaction not supported")
+}
@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// Memory keeps the buckets in memory only, nothing is persisted.
+// Updates are journaled, so a failing update is reverted.
+type Memory struct {
+	root   *memoryBucket
+	closed bool
+
+	sync.RWMutex
+}
+
+type memoryTx struct {
+	s        *Memory
+	writable bool
+	closed   bool
+
+	// Functions reverting the changes, in order of the changes
+	undo []func()
+}
+
+type memoryBucket struct {
+	values  map[string][]byte
+	buckets map[string]*memoryBucket
+}
+
+// memoryBucketTx is a bucket as seen by a transaction.
+type memoryBucketTx struct {
+	tx *memoryTx
+	b  *memoryBucket
+}
+
+// NewMemory creates an empty in-memory storage.
+func NewMemory() *Memory {
+	return &Memory{
+		root: newMemoryBucket(),
+	}
+}
+
+func newMemoryBucket() *memoryBucket {
+	return &memoryBucket{
+		values:  make(map[string][]byte),
+		buckets: make(map[string]*memoryBucket),
+	}
+}
+
+func (s *Memory) View(fn func(tx Tx) error) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	tx := &memoryTx{s: s}
+
+	defer tx.close()
+
+	return fn(tx)
+}
+
+func (s *Memory) Update(fn func(tx Tx) error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	tx := &memoryTx{s: s, writable: true}
+
+	committed := false
+
+	defer func() {
+		// Reverts on errors and panics alike
+		if !committed {
+			tx.rollback()
+		}
+
+		tx.close()
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	committed = true
+
+	return nil
+}
+
+func (s *Memory) ReadOnly() bool {
+	return false
+}
+
+// Close discards the buckets.
+func (s *Memory) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	s.closed = true
+	s.root = nil
+
+	return nil
+}
+
+func (t *memoryTx) Writable() bool {
+	return t.writable
+}
+
+func (t *memoryTx) Bucket(name []byte) Bucket {
+	return t.bucket(t.s.root).Bucket(name)
+}
+
+func (t *memoryTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return t.bucket(t.s.root).CreateBucketIfNotExists(name)
+}
+
+func (t *memoryTx) DeleteBucket(name []byte) error {
+	return t.bucket(t.s.root).DeleteBucket(name)
+}
+
+func (t *memoryTx) bucket(b *memoryBucket) Bucket {
+	if b == nil {
+		return nil
+	}
+
+	return &memoryBucketTx{tx: t, b: b}
+}
+
+// check returns an error when the transaction may not change the storage.
+func (t *memoryTx) check() error {
+	if t.closed {
+		return ErrTxClosed
+	}
+
+	if !t.writable {
+		return ErrTxNotWritable
+	}
+
+	return nil
+}
+
+func (t *memoryTx) onRollback(fn func()) {
+	t.undo = append(t.undo, fn)
+}
+
+// rollback reverts the changes, most recent first.
+func (t *memoryTx) rollback() {
+	for x := len(t.undo) - 1; x >= 0; x-- {
+		t.undo[x]()
+	}
+
+	t.undo = nil
+}
+
+func (t *memoryTx) close() {
+	t.closed = true
+	t.undo = nil
+}
+
+func (b *memoryBucketTx) Get(key []byte) []byte {
+	if b.tx.closed {
+		return nil
+	}
+
+	return b.b.values[string(key)]
+}
+
+func (b *memoryBucketTx) Put(key, value []byte) error {
+	if err := b.tx.check(); err != nil {
+		return err
+	}
+
+	if len(key) == 0 {
+		return ErrKeyEmpty
+	}
+
+	k := string(key)
+
+	if _, ok := b.b.buckets[k]; ok {
+		return ErrIncompatibleValue
+	}
+
+	old, existed := b.b.values[k]
+
+	b.tx.onRollback(func() {
+		if existed {
+			b.b.values[k] = old
+		} else {
+			delete(b.b.values, k)
+		}
+	})
+
+	// The caller may reuse the value after the transaction
+	b.b.values[k] = append([]byte{}, value...)
+
+	return nil
+}
+
+func (b *memoryBucketTx) Delete(key []byte) error {
+	if err := b.tx.check(); err != nil {
+		return err
+	}
+
+	k := string(key)
+
+	if _, ok := b.b.buckets[k]; ok {
+		return ErrIncompatibleValue
+	}
+
+	old, existed := b.b.values[k]
+
+	if !existed {
+		return nil
+	}
+
+	b.tx.onRollback(func() {
+		b.b.values[k] = old
+	})
+
+	delete(b.b.values, k)
+
+	return nil
+}
+
+func (b *memoryBucketTx) ForEach(fn func(k, v []byte) error) error {
+	if b.tx.closed {
+		return ErrTxClosed
+	}
+
+	keys := make([]string, 0, len(b.b.values)+len(b.b.buckets))
+
+	for k := range b.b.values {
+		keys = append(keys, k)
+	}
+
+	for k := range b.b.buckets {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := fn([]byte(k), b.b.values[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *memoryBucketTx) Bucket(name []byte) Bucket {
+	if b.tx.closed {
+		return nil
+	}
+
+	return b.tx.bucket(b.b.buckets[string(name)])
+}
+
+func (b *memoryBucketTx) CreateBucket(name []byte) (Bucket, error) {
+	if err := b.tx.check(); err != nil {
+		return nil, err
+	}
+
+	if len(name) == 0 {
+		return nil, ErrBucketNameEmpty
+	}
+
+	k := string(name)
+
+	if _, ok := b.b.buckets[k]; ok {
+		return nil, ErrBucketExists
+	}
+
+	if _, ok := b.b.values[k]; ok {
+		return nil, ErrIncompatibleValue
+	}
+
+	nb := newMemoryBucket()
+
+	b.tx.onRollback(func() {
+		delete(b.b.buckets, k)
+	})
+
+	b.b.buckets[k] = nb
+
+	return b.tx.bucket(nb), nil
+}
+
+func (b *memoryBucketTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if err := b.tx.check(); err != nil {
+		return nil, err
+	}
+
+	if nb, ok := b.b.buckets[string(name)]; ok {
+		return b.tx.bucket(nb), nil
+	}
+
+	return b.CreateBucket(name)
+}
+
+func (b *memoryBucketTx) DeleteBucket(name []byte) error {
+	if err := b.tx.check(); err != nil {
+		return err
+	}
+
+	k := string(name)
+
+	old, ok := b.b.buckets[k]
+
+	if !ok {
+		if _, ok := b.b.values[k]; ok {
+			return ErrIncompatibleValue
+		}
+
+		return ErrBucketNotFound
+	}
+
+	// The deleted bucket is unreachable, so it is not changed until it is put back
+	b.tx.onRollback(func() {
+		b.b.buckets[k] = old
+	})
+
+	delete(b.b.buckets, k)
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// Package storage abstracts the key/value store the collections persist their models in.
+// Data is kept in nested buckets of sorted key/value pairs, changed in transactions, like bbolt does.
+package storage
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// Storage persists buckets of key/value pairs.
+// Updates are serialized, a failing update leaves the storage unchanged.
+type Storage interface {
+	// View runs fn in a read-only transaction
+	View(fn func(tx Tx) error) error
+	// Update runs fn in a read-write transaction, which is committed unless fn returns an error
+	Update(fn func(tx Tx) error) error
+
+	ReadOnly() bool
+	Close() error
+}
+
+// Tx is a transaction of a storage, it is only valid within the function it is passed to.
+// Byte slices returned by a transaction are only valid during the transaction and should not be modified.
+type Tx interface {
+	Writable() bool
+
+	// Bucket returns the named top level bucket, nil when it does not exist
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// Bucket holds key/value pairs and nested buckets, ordered by key.
+type Bucket interface {
+	// Get returns the value of the key, nil when the key does not exist or is a nested bucket
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// ForEach calls fn for every key in order, the value of nested buckets is nil
+	ForEach(fn func(k, v []byte) error) error
+
+	// Bucket returns the nested bucket, nil when it does not exist
+	Bucket(name []byte) Bucket
+	CreateBucket(name []byte) (Bucket, error)
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// The errors are shared with bbolt, so they match regardless of the implementation.
+var (
+	ErrClosed            = bolt.ErrDatabaseNotOpen
+	ErrReadOnly          = bolt.ErrDatabaseReadOnly
+	ErrTxNotWritable     = bolt.ErrTxNotWritable
+	ErrTxClosed          = bolt.ErrTxClosed
+	ErrBucketNotFound    = bolt.ErrBucketNotFound
+	ErrBucketExists      = bolt.ErrBucketExists
+	ErrBucketNameEmpty   = bolt.ErrBucketNameRequired
+	ErrKeyEmpty          = bolt.ErrKeyRequired
+	ErrIncompatibleValue = bolt.ErrIncompatibleValue
+)
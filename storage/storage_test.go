@@ -0,0 +1,433 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "peterdekok.nl/gotools/test"
+	"testing"
+)
+
+func TestBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "borm-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	s, err := OpenBolt(filepath.Join(dir, "models.db"), 0600, nil)
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, s.ReadOnly(), false)
+	ExpectedEqual(t, s.DB().Path(), filepath.Join(dir, "models.db"))
+
+	testStorage(t, s)
+
+	ExpectedNoError(t, s.Close())
+
+	_, err = OpenBolt(filepath.Join(dir, "missing", "models.db"), 0600, nil)
+
+	ExpectedEqualF(t, os.IsNotExist(err), true, false, "expected the bolt error")
+}
+
+func TestBolt_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "borm-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	s, err := OpenBolt(filepath.Join(dir, "models.db"), 0600, nil)
+
+	ExpectedNoError(t, err)
+
+	value := bytes.Repeat([]byte("v"), 1024)
+
+	err = s.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+
+		if err != nil {
+			return err
+		}
+
+		nb, err := b.CreateBucket([]byte("nested"))
+
+		if err != nil {
+			return err
+		}
+
+		if err := nb.Put([]byte("key"), []byte("nested")); err != nil {
+			return err
+		}
+
+		for x := 0; x < 1000; x++ {
+			if err := b.Put([]byte(fmt.Sprintf("key-%04d", x)), value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	err = s.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte("bucket"))
+
+		for x := 10; x < 1000; x++ {
+			if err := b.Delete([]byte(fmt.Sprintf("key-%04d", x))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	// The buckets are copied in multiple transactions
+	compactTxMaxSize = 4096
+
+	defer func() {
+		compactTxMaxSize = 65536
+	}()
+
+	before, after, err := s.Compact(filepath.Join(dir, "compact.db"), false)
+
+	ExpectedNoError(t, err)
+	ExpectedEqualF(t, after < before, true, false, fmt.Sprintf("expected the file to shrink from %d, got %d", before, after))
+
+	_, _, err = s.Compact(filepath.Join(dir, "compact.db"), false)
+
+	ExpectedError(t, err, fmt.Sprintf("file %s already exists", filepath.Join(dir, "compact.db")))
+
+	compacted, err := OpenBolt(filepath.Join(dir, "compact.db"), 0600, nil)
+
+	ExpectedNoError(t, err)
+
+	testCompacted := func(s Storage) {
+		err := s.View(func(tx Tx) error {
+			b := tx.Bucket([]byte("bucket"))
+
+			ExpectedEqual(t, b.Get([]byte("key-0009")), value)
+			ExpectedEqual(t, b.Get([]byte("key-0010")), []byte(nil))
+			ExpectedEqual(t, b.Bucket([]byte("nested")).Get([]byte("key")), []byte("nested"))
+
+			return nil
+		})
+
+		ExpectedNoError(t, err)
+	}
+
+	testCompacted(compacted)
+
+	ExpectedNoError(t, compacted.Close())
+
+	// Swapping replaces the database file by the compacted file
+	before, after, err = s.Compact(filepath.Join(dir, "swap.db"), true)
+
+	ExpectedNoError(t, err)
+	ExpectedEqualF(t, after < before, true, false, fmt.Sprintf("expected the file to shrink from %d, got %d", before, after))
+
+	_, err = os.Stat(filepath.Join(dir, "swap.db"))
+
+	ExpectedEqualF(t, os.IsNotExist(err), true, false, "expected the compacted file to be moved")
+
+	fi, err := os.Stat(filepath.Join(dir, "models.db"))
+
+	ExpectedNoError(t, err)
+	ExpectedEqual(t, fi.Size(), after)
+	ExpectedEqual(t, s.DB().Path(), filepath.Join(dir, "models.db"))
+
+	testCompacted(s)
+
+	// The storage remains writable
+	err = s.Update(func(tx Tx) error {
+		return tx.Bucket([]byte("bucket")).Put([]byte("key-1000"), value)
+	})
+
+	ExpectedNoError(t, err)
+	ExpectedNoError(t, s.Close())
+}
+
+func TestBolt_Compact_reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "borm-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	s, err := OpenBolt(filepath.Join(dir, "models.db"), 0600, nil)
+
+	ExpectedNoError(t, err)
+
+	err = s.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte("key"), []byte("value"))
+	})
+
+	ExpectedNoError(t, err)
+
+	defer func() {
+		boltOpen = bolt.Open
+	}()
+
+	failed := errors.New("failed")
+	opened := 0
+
+	// The compacted file fails to open, the database file is restored
+	boltOpen = func(path string, mode os.FileMode, options *bolt.Options) (*bolt.DB, error) {
+		if opened++; opened == 1 {
+			return nil, failed
+		}
+
+		return bolt.Open(path, mode, options)
+	}
+
+	_, _, err = s.Compact(filepath.Join(dir, "swap.db"), true)
+
+	ExpectedEqual(t, err, failed)
+	ExpectedEqual(t, opened, 2)
+
+	err = s.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte("bucket"))
+
+		ExpectedEqual(t, b.Get([]byte("key")), []byte("value"))
+
+		return b.Put([]byte("key"), []byte("changed"))
+	})
+
+	ExpectedNoError(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "swap.db.orig"))
+
+	ExpectedEqualF(t, os.IsNotExist(err), true, false, "expected the link to the database file to be removed")
+
+	// Neither file opens, the storage is closed
+	boltOpen = func(path string, mode os.FileMode, options *bolt.Options) (*bolt.DB, error) {
+		return nil, failed
+	}
+
+	_, _, err = s.Compact(filepath.Join(dir, "swap-again.db"), true)
+
+	ExpectedEqualF(t, errors.Is(err, ErrClosed), true, false, "expected a closed error")
+	ExpectedEqual(t, s.View(func(tx Tx) error { return nil }), ErrClosed)
+
+	boltOpen = bolt.Open
+
+	// The database file is kept as it was
+	s, err = OpenBolt(filepath.Join(dir, "models.db"), 0600, nil)
+
+	ExpectedNoError(t, err)
+
+	err = s.View(func(tx Tx) error {
+		ExpectedEqual(t, tx.Bucket([]byte("bucket")).Get([]byte("key")), []byte("changed"))
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+	ExpectedNoError(t, s.Close())
+}
+
+func TestMemory(t *testing.T) {
+	s := NewMemory()
+
+	ExpectedEqual(t, s.ReadOnly(), false)
+
+	testStorage(t, s)
+
+	// Panics revert the update
+	func() {
+		defer func() {
+			ExpectedEqualF(t, recover(), interface{}("panic"), false, "panic should be passed on")
+		}()
+
+		_ = s.Update(func(tx Tx) error {
+			if err := tx.DeleteBucket([]byte("a")); err != nil {
+				return err
+			}
+
+			panic("panic")
+		})
+	}()
+
+	ExpectedNoError(t, s.View(func(tx Tx) error {
+		ExpectedNoZeroValueF(t, tx.Bucket([]byte("a")), false, "bucket should be restored")
+
+		return nil
+	}))
+
+	// Values are copied
+	v := []byte("value")
+
+	ExpectedNoError(t, s.Update(func(tx Tx) error {
+		return tx.Bucket([]byte("a")).Put([]byte("copy"), v)
+	}))
+
+	v[0] = 'x'
+
+	ExpectedNoError(t, s.View(func(tx Tx) error {
+		ExpectedEqual(t, tx.Bucket([]byte("a")).Get([]byte("copy")), []byte("value"))
+
+		return nil
+	}))
+
+	// Transactions can not be used after they finished
+	var closed Bucket
+
+	ExpectedNoError(t, s.Update(func(tx Tx) error {
+		closed = tx.Bucket([]byte("a"))
+
+		return nil
+	}))
+
+	ExpectedEqual(t, closed.Put([]byte("k"), []byte("v")), ErrTxClosed)
+
+	ExpectedNoError(t, s.Close())
+	ExpectedEqual(t, s.Close(), ErrClosed)
+	ExpectedEqual(t, s.View(func(tx Tx) error { return nil }), ErrClosed)
+	ExpectedEqual(t, s.Update(func(tx Tx) error { return nil }), ErrClosed)
+}
+
+// testStorage tests the behaviour every storage should share.
+func testStorage(t *testing.T, s Storage) {
+	err := s.Update(func(tx Tx) error {
+		ExpectedEqual(t, tx.Writable(), true)
+		ExpectedZeroValue(t, tx.Bucket([]byte("a")))
+
+		b, err := tx.CreateBucketIfNotExists([]byte("a"))
+
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put([]byte("k2"), []byte("v2")); err != nil {
+			return err
+		}
+
+		if err := b.Put([]byte("k1"), []byte("v1")); err != nil {
+			return err
+		}
+
+		nb, err := b.CreateBucket([]byte("n"))
+
+		if err != nil {
+			return err
+		}
+
+		return nb.Put([]byte("k3"), []byte("v3"))
+	})
+
+	ExpectedNoError(t, err)
+
+	err = s.View(func(tx Tx) error {
+		ExpectedEqual(t, tx.Writable(), false)
+
+		b := tx.Bucket([]byte("a"))
+
+		ExpectedEqual(t, b.Get([]byte("k1")), []byte("v1"))
+		ExpectedZeroValue(t, b.Get([]byte("n")))
+		ExpectedZeroValue(t, b.Get([]byte("missing")))
+		ExpectedZeroValue(t, b.Bucket([]byte("missing")))
+		ExpectedEqual(t, b.Bucket([]byte("n")).Get([]byte("k3")), []byte("v3"))
+
+		keys := make([]string, 0)
+		values := make([][]byte, 0)
+
+		ExpectedNoError(t, b.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			values = append(values, v)
+
+			return nil
+		}))
+
+		ExpectedEqual(t, keys, []string{"k1", "k2", "n"})
+		ExpectedZeroValue(t, values[2])
+
+		ExpectedEqual(t, b.Put([]byte("k1"), []byte("v")), ErrTxNotWritable)
+		ExpectedEqual(t, b.Delete([]byte("k1")), ErrTxNotWritable)
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	failed := errors.New("failed")
+
+	err = s.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte("a"))
+
+		ExpectedEqual(t, b.Put([]byte("n"), []byte("v")), ErrIncompatibleValue)
+		ExpectedEqual(t, b.Put([]byte{}, []byte("v")), ErrKeyEmpty)
+		ExpectedEqual(t, b.Delete([]byte("n")), ErrIncompatibleValue)
+		ExpectedEqual(t, b.DeleteBucket([]byte("k1")), ErrIncompatibleValue)
+		ExpectedEqual(t, b.DeleteBucket([]byte("missing")), ErrBucketNotFound)
+		ExpectedNoError(t, b.Delete([]byte("missing")))
+
+		_, err := b.CreateBucket([]byte("n"))
+
+		ExpectedEqual(t, err, ErrBucketExists)
+
+		_, err = b.CreateBucket([]byte("k1"))
+
+		ExpectedEqual(t, err, ErrIncompatibleValue)
+
+		// Reverted by the error
+		ExpectedNoError(t, b.Put([]byte("k1"), []byte("changed")))
+		ExpectedNoError(t, b.Delete([]byte("k2")))
+		ExpectedNoError(t, b.DeleteBucket([]byte("n")))
+
+		_, err = tx.CreateBucketIfNotExists([]byte("b"))
+
+		ExpectedNoError(t, err)
+
+		return failed
+	})
+
+	ExpectedEqual(t, err, failed)
+
+	err = s.View(func(tx Tx) error {
+		b := tx.Bucket([]byte("a"))
+
+		ExpectedEqual(t, b.Get([]byte("k1")), []byte("v1"))
+		ExpectedEqual(t, b.Get([]byte("k2")), []byte("v2"))
+		ExpectedNoZeroValueF(t, b.Bucket([]byte("n")), false, "nested bucket should be restored")
+		ExpectedZeroValue(t, tx.Bucket([]byte("b")))
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+
+	err = s.Update(func(tx Tx) error {
+		ExpectedEqual(t, tx.DeleteBucket([]byte("missing")), ErrBucketNotFound)
+
+		return tx.Bucket([]byte("a")).Delete([]byte("k2"))
+	})
+
+	ExpectedNoError(t, err)
+
+	err = s.View(func(tx Tx) error {
+		ExpectedZeroValue(t, tx.Bucket([]byte("a")).Get([]byte("k2")))
+
+		return nil
+	})
+
+	ExpectedNoError(t, err)
+}